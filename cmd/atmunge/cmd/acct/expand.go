@@ -37,6 +37,7 @@ atmunge acct expand list
 		if err != nil {
 			log.Fatal().Err(err).Msg("failed to create runtime")
 		}
+		defer rt.Close()
 
 		what := args[0]
 		handleOrDID := args[1]
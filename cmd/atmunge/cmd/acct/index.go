@@ -2,7 +2,6 @@ package acct
 
 import (
 	"fmt"
-	"path/filepath"
 
 	"github.com/blebbit/atmunge/pkg/acct"
 	"github.com/blebbit/atmunge/pkg/runtime"
@@ -40,6 +39,7 @@ var acctIndexCmd = &cobra.Command{
 		if err != nil {
 			log.Fatal().Err(err).Msg("failed to create runtime")
 		}
+		defer rt.Close()
 
 		handleOrDID := args[0]
 		did, _, err := rt.ResolveDid(ctx, handleOrDID)
@@ -47,7 +47,7 @@ var acctIndexCmd = &cobra.Command{
 			log.Fatal().Err(err).Msgf("failed to resolve %s", handleOrDID)
 		}
 
-		dbPath := filepath.Join(rt.Cfg.RepoDataDir, did, "repo.duckdb")
+		dbPath := rt.Layout().Path(did, "repo.duckdb")
 
 		err = acct.Index(ctx, dbPath, indexNames)
 		if err != nil {
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"path/filepath"
 
 	"github.com/blebbit/atmunge/pkg/acct"
 	"github.com/blebbit/atmunge/pkg/runtime"
@@ -44,6 +43,7 @@ var acctQueryCmd = &cobra.Command{
 		if err != nil {
 			log.Fatal().Err(err).Msg("failed to create runtime")
 		}
+		defer rt.Close()
 
 		handleOrDID := args[0]
 		did, _, err := rt.ResolveDid(ctx, handleOrDID)
@@ -51,7 +51,7 @@ var acctQueryCmd = &cobra.Command{
 			log.Fatal().Err(err).Msgf("failed to resolve %s", handleOrDID)
 		}
 
-		dbPath := filepath.Join(rt.Cfg.RepoDataDir, did, "repo.duckdb")
+		dbPath := rt.Layout().Path(did, "repo.duckdb")
 
 		results, err := acct.Query(ctx, dbPath, querySQLNames)
 		if err != nil {
@@ -18,6 +18,7 @@ var acctSyncCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		defer rt.Close()
 		return acct.Sync(rt, args[0], phases)
 	},
 }
@@ -30,6 +30,7 @@ var aiHackCmd = &cobra.Command{
 		if err != nil {
 			log.Fatal().Err(err).Msg("failed to create AI client")
 		}
+		defer a.Close()
 
 		ctx := cmd.Context()
 		if err := a.Hack(ctx, model, prompt, uri); err != nil {
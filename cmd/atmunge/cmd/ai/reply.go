@@ -24,6 +24,7 @@ var aiReplyCmd = &cobra.Command{
 		if err != nil {
 			log.Fatal().Err(err).Msg("failed to create AI client")
 		}
+		defer a.Close()
 
 		userPrompt, err := a.ResolveInput(args[0])
 		if err != nil {
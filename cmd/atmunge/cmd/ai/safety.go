@@ -24,6 +24,7 @@ var aiSafetyCmd = &cobra.Command{
 		if err != nil {
 			log.Fatal().Err(err).Msg("failed to create AI client")
 		}
+		defer a.Close()
 
 		uri, err := a.ResolveInput(args[0])
 		if err != nil {
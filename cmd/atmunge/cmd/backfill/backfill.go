@@ -12,3 +12,8 @@ var BackfillCmd = &cobra.Command{
 	Short: "Commands for backfilling from data sources",
 	Long:  "Commands for backfilling from data sources",
 }
+
+func init() {
+	BackfillCmd.PersistentFlags().IntVar(&BackfillParallel, "parallel", 1, "Number of workers to process with")
+	BackfillCmd.PersistentFlags().StringVar(&BackfillStart, "start", "", "Reprocess rows older than this timestamp")
+}
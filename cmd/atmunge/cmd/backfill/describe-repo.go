@@ -48,6 +48,8 @@ var backfillDescribeRepoCmd = &cobra.Command{
 			log.Error().Msgf("failed to create runtime: %s", err)
 			return err
 		}
+		defer r.Close()
+		r.ServeMetrics()
 
 		err = r.BackfillDescribeRepo(BackfillParallel, BackfillStart)
 		if err != nil {
@@ -43,6 +43,8 @@ var backfillPdsAccountsCmd = &cobra.Command{
 			log.Error().Msgf("failed to create runtime: %s", err)
 			return err
 		}
+		defer r.Close()
+		r.ServeMetrics()
 
 		// load repo list from json (TODO, should put this in a table for consistency, have some command to fetch and sync)
 		j, err := os.ReadFile("./data/atproto-scraping-state.json")
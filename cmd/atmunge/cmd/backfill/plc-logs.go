@@ -39,6 +39,8 @@ var backfillPlcLogsCmd = &cobra.Command{
 			log.Error().Msgf("failed to create runtime: %s", err)
 			return err
 		}
+		defer r.Close()
+		r.ServeMetrics()
 
 		err = r.BackfillPlcLogs()
 		if err != nil {
@@ -0,0 +1,68 @@
+package backfill
+
+import (
+	"context"
+	"os/signal"
+	"syscall"
+
+	"github.com/blebbit/atmunge/pkg/config"
+	"github.com/blebbit/atmunge/pkg/runtime"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+var backfillRelayHostsRelay string
+
+func init() {
+	BackfillCmd.AddCommand(backfillRelayHostsCmd)
+	backfillRelayHostsCmd.Flags().StringVar(&backfillRelayHostsRelay, "relay", "https://relay1.us-east.bsky.network", "Relay to list hosts from")
+}
+
+const backfillRelayHostsLongHelp = `
+Backfill the pds_hosts table from a relay's listHosts.
+
+Merges the relay reported status and account counts
+with our own view of the network from pds_repos,
+and reports where the two differ.
+`
+
+var backfillRelayHostsCmd = &cobra.Command{
+	Use:   "relay-hosts",
+	Short: "Backfill the PDS hosts from a relay",
+	Long:  backfillRelayHostsLongHelp,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		ctx, err := config.SetupLogging(ctx)
+		if err != nil {
+			return err
+		}
+		log := zerolog.Ctx(ctx).With().
+			Str("module", "backfill").
+			Str("method", "relay-hosts").
+			Logger()
+		log.Info().Msgf("Starting up...")
+
+		// create our runtime
+		r, err := runtime.NewRuntime(ctx)
+		if err != nil {
+			log.Error().Msgf("failed to create runtime: %s", err)
+			return err
+		}
+		defer r.Close()
+		r.ServeMetrics()
+
+		report, err := r.BackfillRelayHosts(backfillRelayHostsRelay)
+		if err != nil {
+			log.Error().Msgf("failed to backfill relay hosts: %s", err)
+			return err
+		}
+
+		log.Info().Msgf("Relay hosts: %d, known: %d, unknown: %d, missing from relay: %d, count mismatch: %d",
+			report.RelayHosts, report.KnownHosts, report.UnknownHosts, report.MissingHosts, report.Mismatched,
+		)
+
+		return nil
+	},
+}
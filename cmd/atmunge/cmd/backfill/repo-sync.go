@@ -46,6 +46,8 @@ var backfillRepoSyncCmd = &cobra.Command{
 			log.Error().Msgf("failed to create runtime: %s", err)
 			return err
 		}
+		defer r.Close()
+		r.ServeMetrics()
 
 		err = r.BackfillRepoSync(BackfillParallel, BackfillStart)
 		if err != nil {
@@ -0,0 +1,77 @@
+package backfill
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"syscall"
+
+	"github.com/blebbit/atmunge/pkg/config"
+	"github.com/blebbit/atmunge/pkg/runtime"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	BackfillCmd.AddCommand(backfillStatusCmd)
+}
+
+var backfillStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Report the backfill job queue per phase",
+	Long:  "Report the number of queued, running, failed, and done backfill jobs per phase",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		ctx, err := config.SetupLogging(ctx)
+		if err != nil {
+			return err
+		}
+		log := zerolog.Ctx(ctx).With().
+			Str("module", "backfill").
+			Str("method", "status").
+			Logger()
+
+		// create our runtime
+		r, err := runtime.NewRuntime(ctx)
+		if err != nil {
+			log.Error().Msgf("failed to create runtime: %s", err)
+			return err
+		}
+		defer r.Close()
+
+		counts, err := r.JobStatusCounts()
+		if err != nil {
+			log.Error().Msgf("failed to get backfill status: %s", err)
+			return err
+		}
+
+		// pivot into phase -> status -> count
+		phases := []string{}
+		byPhase := map[string]map[string]int64{}
+		for _, c := range counts {
+			if _, ok := byPhase[c.Phase]; !ok {
+				phases = append(phases, c.Phase)
+				byPhase[c.Phase] = map[string]int64{}
+			}
+			byPhase[c.Phase][c.Status] = c.Count
+		}
+
+		statuses := []string{runtime.JobQueued, runtime.JobRunning, runtime.JobFailed, runtime.JobDone}
+		fmt.Printf("%-16s", "phase")
+		for _, s := range statuses {
+			fmt.Printf("%12s", s)
+		}
+		fmt.Println()
+		for _, p := range phases {
+			fmt.Printf("%-16s", p)
+			for _, s := range statuses {
+				fmt.Printf("%12d", byPhase[p][s])
+			}
+			fmt.Println()
+		}
+
+		return nil
+	},
+}
@@ -5,7 +5,6 @@ import (
 	"database/sql"
 	"fmt"
 	"os/signal"
-	"path/filepath"
 	"syscall"
 
 	"github.com/blebbit/atmunge/pkg/config"
@@ -51,6 +50,7 @@ var dbClearCmd = &cobra.Command{
 			log.Error().Msgf("failed to create runtime: %s", err)
 			return err
 		}
+		defer r.Close()
 
 		switch dbName {
 		case "app":
@@ -70,7 +70,7 @@ var dbClearCmd = &cobra.Command{
 				return fmt.Errorf("failed to resolve did for %s: %w", handleOrDID, err)
 			}
 
-			dbPath := filepath.Join(r.Cfg.RepoDataDir, did, "repo.duckdb")
+			dbPath := r.Layout().Path(did, "repo.duckdb")
 
 			dbConn, err := sql.Open("duckdb", dbPath)
 			if err != nil {
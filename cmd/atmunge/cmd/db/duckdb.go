@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
 
 	"github.com/blebbit/atmunge/pkg/runtime"
 	"github.com/spf13/cobra"
@@ -25,6 +24,7 @@ var duckDBCmd = &cobra.Command{
 			fmt.Printf("failed to create runtime: %s\n", err)
 			return
 		}
+		defer rt.Close()
 
 		did, _, err := rt.ResolveDid(cmd.Context(), args[0])
 		if err != nil {
@@ -32,7 +32,7 @@ var duckDBCmd = &cobra.Command{
 			return
 		}
 
-		dbPath := filepath.Join(rt.Cfg.RepoDataDir, did, "repo.duckdb")
+		dbPath := rt.Layout().Path(did, "repo.duckdb")
 
 		// Check if the database file exists
 		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
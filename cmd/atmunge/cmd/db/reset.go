@@ -40,6 +40,7 @@ var dbResetCmd = &cobra.Command{
 			log.Error().Msgf("failed to create runtime: %s", err)
 			return err
 		}
+		defer r.Close()
 
 		// db migrations (if needed)
 		err = db.DropTables(r.DB)
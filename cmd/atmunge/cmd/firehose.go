@@ -27,6 +27,7 @@ var firehoseCmd = &cobra.Command{
 		if err != nil {
 			log.Fatal().Err(err).Msg("failed to create runtime")
 		}
+		defer r.Close()
 
 		fc, err := firehose.NewFirehoseClient(r)
 		if err != nil {
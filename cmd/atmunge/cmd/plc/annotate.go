@@ -45,6 +45,7 @@ var plcAnnotateCmd = &cobra.Command{
 			log.Error().Msgf("failed to create runtime: %s", err)
 			return err
 		}
+		defer r.Close()
 
 		err = r.AnnotatePlcLogs(plcAnnotateCmdStart, plcAnnotateCmdBatchSize)
 		if err != nil {
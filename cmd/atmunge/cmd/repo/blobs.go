@@ -0,0 +1,143 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"syscall"
+
+	"github.com/blebbit/atmunge/pkg/config"
+	"github.com/blebbit/atmunge/pkg/repo"
+	"github.com/blebbit/atmunge/pkg/runtime"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+var repoBlobsCmd = &cobra.Command{
+	Use:   "blobs",
+	Short: "Commands for the blobs in repo storage",
+	Long: `Commands for the blobs in repo storage.
+
+With ATMUNGE_BLOB_STORE=shared, each blob is stored once in blobs/<xy>/<cid>.blob
+with a ref per account referencing it, rather than under every account.`,
+}
+
+var repoBlobsShareCmd = &cobra.Command{
+	Use:   "share",
+	Short: "Move account blobs to the shared blob store",
+	Long: `Move account blobs to the shared blob store.
+
+Each <did>/blobs/<cid>.blob is moved to blobs/<xy>/<cid>.blob with a ref for the account,
+blobs already shared are not stored again. Rerun if interrupted, then set ATMUNGE_BLOB_STORE=shared.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, log, stop, err := blobsRuntime("share")
+		if err != nil {
+			return err
+		}
+		defer stop()
+
+		log.Info().Msgf("Sharing the account blobs in %s", blobsStoreName(r))
+		stats, err := repo.ShareBlobs(r.Ctx, r.RepoStore(), r.Layout())
+		if err != nil {
+			return err
+		}
+		log.Info().Msgf("Moved %d blobs, %d were already shared (%d bytes saved)", stats.Moved, stats.Deduped, stats.Bytes)
+		if r.Cfg.BlobStore != repo.BlobStoreShared {
+			log.Info().Msgf("Set ATMUNGE_BLOB_STORE=%s to keep syncing to the shared blob store", repo.BlobStoreShared)
+		}
+		return nil
+	},
+}
+
+var repoBlobsRefsCmd = &cobra.Command{
+	Use:   "refs <cid>",
+	Short: "List the accounts referencing a shared blob",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, _, stop, err := blobsRuntime("refs")
+		if err != nil {
+			return err
+		}
+		defer stop()
+
+		dids, err := repo.BlobRefs(r.Ctx, r.RepoStore(), args[0])
+		if err != nil {
+			return err
+		}
+		for _, did := range dids {
+			fmt.Println(did)
+		}
+		return nil
+	},
+}
+
+var repoBlobsGcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Delete shared blobs no account references",
+	Long: `Delete shared blobs no account references.
+
+Accounts drop their ref when a sync no longer finds the blob in their repo.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		r, log, stop, err := blobsRuntime("gc")
+		if err != nil {
+			return err
+		}
+		defer stop()
+
+		stats, err := repo.GCBlobs(r.Ctx, r.RepoStore(), dryRun)
+		if err != nil {
+			return err
+		}
+		verb := "Removed"
+		if dryRun {
+			verb = "Would remove"
+		}
+		log.Info().Msgf("%d shared blobs, %d referenced. %s %d (%d bytes)", stats.Blobs, stats.Referenced, verb, stats.Removed, stats.Bytes)
+		return nil
+	},
+}
+
+// blobsRuntime sets up the runtime for a blobs subcommand, stop closes it and releases the signal handler
+func blobsRuntime(method string) (*runtime.Runtime, zerolog.Logger, func(), error) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+
+	ctx, err := config.SetupLogging(ctx)
+	if err != nil {
+		stop()
+		return nil, zerolog.Logger{}, nil, err
+	}
+	log := zerolog.Ctx(ctx).With().
+		Str("module", "repo").
+		Str("method", "blobs-"+method).
+		Logger()
+
+	r, err := runtime.NewRuntime(ctx)
+	if err != nil {
+		stop()
+		log.Error().Msgf("failed to create runtime: %s", err)
+		return nil, log, nil, err
+	}
+	return r, log, func() {
+		r.Close()
+		stop()
+	}, nil
+}
+
+func blobsStoreName(r *runtime.Runtime) string {
+	if r.Cfg.RepoStorage != "" {
+		return r.Cfg.RepoStorage
+	}
+	return r.Cfg.RepoDataDir
+}
+
+func init() {
+	repoBlobsGcCmd.Flags().Bool("dry-run", false, "only count the unreferenced blobs")
+
+	repoBlobsCmd.AddCommand(repoBlobsShareCmd)
+	repoBlobsCmd.AddCommand(repoBlobsRefsCmd)
+	repoBlobsCmd.AddCommand(repoBlobsGcCmd)
+}
@@ -0,0 +1,106 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/blebbit/atmunge/pkg/config"
+	"github.com/blebbit/atmunge/pkg/repo"
+	"github.com/blebbit/atmunge/pkg/runtime"
+	"github.com/spf13/cobra"
+)
+
+var repoCompressCmd = &cobra.Command{
+	Use:   "compress [acct or car file...]",
+	Short: "Compress CAR files at rest with zstd",
+	Long: `Compress CAR files at rest with zstd.
+
+Each repo.car is replaced by repo.car.zst. Commands reading CARs decompress them
+transparently, and syncs inflate them while merging. Set ATMUNGE_REPO_COMPRESS=true
+to compress after every sync. Accounts are pulled from ATMUNGE_REPO_STORAGE first
+and pushed back after, --all covers every account there.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		level, _ := cmd.Flags().GetInt("level")
+		all, _ := cmd.Flags().GetBool("all")
+
+		r, sources := rewriteRuntime(args, all)
+		defer r.Close()
+		if level == 0 {
+			level = r.Cfg.RepoCompressLevel
+		}
+
+		var total repo.CompressStats
+		count := rewriteRepoCars(r, sources, func(f string) (bool, error) {
+			if strings.HasSuffix(f, repo.CompressedSuffix) || repo.IsCompressedCar(f) {
+				return false, nil
+			}
+			stats, err := repo.CompressCar(f, level)
+			if err != nil {
+				return false, err
+			}
+			total.Raw += stats.Raw
+			total.Compressed += stats.Compressed
+			fmt.Printf("%s: %d -> %d bytes (%.2fx)\n", f, stats.Raw, stats.Compressed, stats.Ratio())
+			return true, nil
+		})
+		if count > 1 {
+			fmt.Printf("compressed %d files, %d -> %d bytes (%.2fx)\n", count, total.Raw, total.Compressed, total.Ratio())
+		}
+	},
+}
+
+var repoDecompressCmd = &cobra.Command{
+	Use:   "decompress [acct or car file...]",
+	Short: "Decompress CAR files compressed with repo compress",
+	Run: func(cmd *cobra.Command, args []string) {
+		all, _ := cmd.Flags().GetBool("all")
+
+		r, sources := rewriteRuntime(args, all)
+		defer r.Close()
+
+		var total repo.CompressStats
+		count := rewriteRepoCars(r, sources, func(f string) (bool, error) {
+			if !strings.HasSuffix(f, repo.CompressedSuffix) && !repo.IsCompressedCar(f) {
+				return false, nil
+			}
+			stats, err := repo.DecompressCar(f)
+			if err != nil {
+				return false, err
+			}
+			total.Raw += stats.Raw
+			total.Compressed += stats.Compressed
+			fmt.Printf("%s: %d -> %d bytes\n", f, stats.Compressed, stats.Raw)
+			return true, nil
+		})
+		if count > 1 {
+			fmt.Printf("decompressed %d files, %d -> %d bytes (were %.2fx)\n", count, total.Compressed, total.Raw, total.Ratio())
+		}
+	},
+}
+
+func init() {
+	repoCompressCmd.Flags().Int("level", 0, "zstd level 1-22, defaults to ATMUNGE_REPO_COMPRESS_LEVEL")
+	repoCompressCmd.Flags().Bool("all", false, "compress the CAR of every account in repo storage")
+	repoDecompressCmd.Flags().Bool("all", false, "decompress the CAR of every account in repo storage")
+}
+
+// rewriteRuntime creates the runtime for the commands rewriting CARs in place,
+// and resolves their args to the CARs to rewrite
+func rewriteRuntime(args []string, all bool) (*runtime.Runtime, []repoSource) {
+	ctx, err := config.SetupLogging(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	r, err := runtime.NewRuntime(ctx)
+	if err != nil {
+		log.Fatalf("failed to create runtime: %v", err)
+	}
+	sources, err := repoSources(ctx, r, args, all)
+	if err != nil {
+		r.Close()
+		log.Fatal(err)
+	}
+	return r, sources
+}
@@ -0,0 +1,74 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/blebbit/atmunge/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var repoDiffCmd = &cobra.Command{
+	Use:   "diff [old car] [new car]",
+	Short: "Show the records created, updated and deleted between two CAR files",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		format, _ := cmd.Flags().GetString("format")
+		allowUnsigned, _ := cmd.Flags().GetBool("allow-unsigned")
+
+		oldBs, err := repo.OpenMemBlockstore(args[0])
+		if err != nil {
+			log.Fatalf("failed to open old car file: %v", err)
+		}
+		newBs, err := repo.OpenMemBlockstore(args[1])
+		if err != nil {
+			log.Fatalf("failed to open new car file: %v", err)
+		}
+		if !newBs.Root().Defined() {
+			log.Fatalf("car file %s does not exist or has no root", args[1])
+		}
+
+		changes, err := repo.Diff(oldBs, oldBs.Root(), newBs, newBs.Root(), repo.DiffOptions{AllowUnsigned: allowUnsigned})
+		if err != nil {
+			log.Fatalf("failed to diff repos: %v", err)
+		}
+
+		switch format {
+		case "jsonl":
+			enc := json.NewEncoder(os.Stdout)
+			for _, c := range changes {
+				if err := enc.Encode(c); err != nil {
+					log.Fatalf("failed to write change: %v", err)
+				}
+			}
+		case "text":
+			fmt.Printf("%s (%s) -> %s (%s)\n", oldBs.Root(), oldBs.Rev(), newBs.Root(), newBs.Rev())
+			marks := map[string]string{repo.OpCreate: "+", repo.OpUpdate: "~", repo.OpDelete: "-"}
+			for _, c := range changes {
+				fmt.Printf("%s %s/%s\n", marks[c.Op], c.Collection, c.Rkey)
+			}
+
+			summary := repo.SummarizeChanges(changes)
+			collections := make([]string, 0, len(summary))
+			for nsid := range summary {
+				collections = append(collections, nsid)
+			}
+			sort.Strings(collections)
+			fmt.Println()
+			for _, nsid := range collections {
+				s := summary[nsid]
+				fmt.Printf("%s: %d created, %d updated, %d deleted\n", nsid, s.Created, s.Updated, s.Deleted)
+			}
+		default:
+			log.Fatalf("unknown format %q, use text or jsonl", format)
+		}
+	},
+}
+
+func init() {
+	repoDiffCmd.Flags().String("format", "text", "output format, text or jsonl")
+	repoDiffCmd.Flags().Bool("allow-unsigned", false, "accept unsigned commits, such as repo pack fixtures")
+}
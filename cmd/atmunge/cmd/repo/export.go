@@ -0,0 +1,158 @@
+package repo
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/blebbit/atmunge/pkg/config"
+	"github.com/blebbit/atmunge/pkg/repo"
+	"github.com/blebbit/atmunge/pkg/runtime"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+var repoExportCmd = &cobra.Command{
+	Use:   "export [acct or car file...]",
+	Short: "Export account records to Parquet or JSONL",
+	Long: `Export account records to Parquet or JSONL.
+
+--format parquet writes one file per collection. Known lexicons (posts, likes, reposts,
+follows, blocks, profiles, lists and list items) get the typed columns of their DuckDB
+table, other collections the record as a JSON column. A single account is written to <out>/<nsid>.parquet,
+several accounts (or --partition) hive-style to <out>/<nsid>/did=<did>/.
+The account's repo.duckdb is built from its CAR when missing.
+
+--format jsonl streams {uri, cid, collection, rkey, record} lines straight from the CARs
+to stdout, or to the --out file. Logs go to stderr when streaming to stdout, so the
+output can be piped into jq. --dag-json writes CIDs and bytes as {"/": ...}.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, _ := cmd.Flags().GetString("format")
+		out, _ := cmd.Flags().GetString("out")
+		all, _ := cmd.Flags().GetBool("all")
+		partition, _ := cmd.Flags().GetBool("partition")
+		collections, _ := cmd.Flags().GetStringSlice("collections")
+		dagJSON, _ := cmd.Flags().GetBool("dag-json")
+		allowUnsigned, _ := cmd.Flags().GetBool("allow-unsigned")
+
+		if format != repo.ExportParquet && format != repo.ExportJSONL {
+			return fmt.Errorf("unknown export format %q, use %s or %s", format, repo.ExportParquet, repo.ExportJSONL)
+		}
+		toStdout := format == repo.ExportJSONL && (out == "" || out == "-")
+
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		ctx, err := config.SetupLogging(ctx)
+		if err != nil {
+			return err
+		}
+		if toStdout {
+			// keep stdout for the records
+			l := zerolog.Ctx(ctx).Output(os.Stderr)
+			ctx = l.WithContext(ctx)
+		}
+		log := zerolog.Ctx(ctx).With().
+			Str("module", "repo").
+			Str("method", "export").
+			Logger()
+
+		r, err := runtime.NewRuntime(ctx)
+		if err != nil {
+			log.Error().Msgf("failed to create runtime: %s", err)
+			return err
+		}
+		defer r.Close()
+		layout := r.Layout()
+
+		sources, err := repoSources(ctx, r, args, all)
+		if err != nil {
+			return err
+		}
+		for _, src := range sources {
+			if src.did == "" && format != repo.ExportJSONL {
+				return fmt.Errorf("%s: car files can only be exported to %s", src.car, repo.ExportJSONL)
+			}
+		}
+
+		opts := repo.ExportOptions{
+			Format:        format,
+			Partition:     partition || len(sources) > 1,
+			Collections:   collections,
+			DAGJSON:       dagJSON,
+			AllowUnsigned: allowUnsigned,
+		}
+
+		var w *bufio.Writer
+		if format == repo.ExportJSONL {
+			var dst io.Writer = os.Stdout
+			if !toStdout {
+				f, err := os.Create(out)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				dst = f
+			}
+			w = bufio.NewWriterSize(dst, 1<<20)
+		} else if out == "" {
+			out = "./data/export"
+		}
+
+		var records int64
+		for _, src := range sources {
+			if src.did != "" {
+				if err := r.PullRepoFiles(src.did); err != nil {
+					return fmt.Errorf("failed to pull repo files: %w", err)
+				}
+			}
+
+			var stats *repo.ExportStats
+			if format == repo.ExportJSONL {
+				if _, err := os.Stat(src.car); os.IsNotExist(err) && !repo.IsCompressedCar(src.car) {
+					log.Warn().Msgf("skipping %s, no %s", src.did, src.car)
+					continue
+				}
+				stats, err = repo.ExportCar(ctx, src.car, w, opts)
+			} else {
+				dbPath := layout.Path(src.did, "repo.duckdb")
+				if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+					log.Info().Msgf("Converting CAR to DuckDB for %s", src.did)
+					if err := repo.CarToDuckDB(ctx, src.car, dbPath, repo.UpdateOptions{AllowUnsigned: allowUnsigned}); err != nil {
+						log.Warn().Err(err).Msgf("skipping %s", src.did)
+						continue
+					}
+				}
+				stats, err = repo.Export(ctx, dbPath, out, opts)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to export %s: %w", src.car, err)
+			}
+			log.Info().Msgf("Exported %d records in %d collections from %s", stats.Records, stats.Collections, src.car)
+			records += stats.Records
+		}
+		if w != nil {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		if len(sources) > 1 {
+			log.Info().Msgf("Exported %d records from %d accounts", records, len(sources))
+		}
+		return nil
+	},
+}
+
+func init() {
+	repoExportCmd.Flags().String("format", repo.ExportParquet, "parquet or jsonl")
+	repoExportCmd.Flags().String("out", "", "directory for parquet (default ./data/export), file for jsonl (default stdout)")
+	repoExportCmd.Flags().Bool("all", false, "export every account under the repo data dir")
+	repoExportCmd.Flags().Bool("partition", false, "partition parquet by did even for a single account")
+	repoExportCmd.Flags().StringSlice("collections", nil, "only export these NSIDs")
+	repoExportCmd.Flags().Bool("dag-json", false, "encode CIDs and bytes in jsonl records as DAG-JSON")
+	repoExportCmd.Flags().Bool("allow-unsigned", false, "accept unsigned commits, such as repo pack fixtures")
+}
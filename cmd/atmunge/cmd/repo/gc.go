@@ -0,0 +1,54 @@
+package repo
+
+import (
+	"fmt"
+
+	"github.com/blebbit/atmunge/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var repoGcCmd = &cobra.Command{
+	Use:   "gc [acct or car file...]",
+	Short: "Compact CAR files to the blocks reachable from their latest commit",
+	Long: `Compact CAR files to the blocks reachable from their latest commit.
+
+Incremental syncs only append, so orphaned MST nodes and deleted records
+accumulate. This rewrites each CAR with the reachable blocks, optionally
+keeping the trees of the previous --keep commits as well. Accounts are pulled
+from ATMUNGE_REPO_STORAGE first and pushed back after, --all covers every account there.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		keep, _ := cmd.Flags().GetInt("keep")
+		level, _ := cmd.Flags().GetInt("level")
+		all, _ := cmd.Flags().GetBool("all")
+
+		r, sources := rewriteRuntime(args, all)
+		defer r.Close()
+		if level == 0 {
+			level = r.Cfg.RepoCompressLevel
+		}
+
+		var total int64
+		count := rewriteRepoCars(r, sources, func(f string) (bool, error) {
+			stats, err := repo.CompactCar(f, keep, level)
+			if err != nil {
+				return false, err
+			}
+			total += stats.Reclaimed()
+			fmt.Printf("%s: kept %d of %d blocks from %d commits, reclaimed %d bytes\n",
+				f, stats.Kept, stats.Blocks, stats.Commits, stats.Reclaimed())
+			if stats.Missing > 0 {
+				fmt.Printf("%s: %d reachable blocks were missing\n", f, stats.Missing)
+			}
+			return true, nil
+		})
+		if count > 1 {
+			fmt.Printf("reclaimed %d bytes across %d files\n", total, count)
+		}
+	},
+}
+
+func init() {
+	repoGcCmd.Flags().Int("keep", 0, "also keep the blocks of the previous N commits")
+	repoGcCmd.Flags().Int("level", 0, "zstd level compressed CARs are written back with, defaults to ATMUNGE_REPO_COMPRESS_LEVEL")
+	repoGcCmd.Flags().Bool("all", false, "compact the CAR of every account in repo storage")
+}
@@ -0,0 +1,108 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blebbit/atmunge/pkg/config"
+	"github.com/blebbit/atmunge/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var repoHistoryCmd = &cobra.Command{
+	Use:   "history [did, repo dir, or history file]",
+	Short: "Show the sync history of a repo",
+	Long: `Show the sync history of a repo.
+
+Each sync that moves a repo to a new commit appends the record ops to history.jsonl
+next to repo.car. With --record, show when one record was created, updated or deleted.
+With --at, replay the history to list the records the repo had at that rev.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		record, _ := cmd.Flags().GetString("record")
+		at, _ := cmd.Flags().GetString("at")
+		format, _ := cmd.Flags().GetString("format")
+		if format != "text" && format != "jsonl" {
+			log.Fatalf("unknown format %q, use text or jsonl", format)
+		}
+
+		path := args[0]
+		if strings.HasPrefix(path, "did:") {
+			cfg, err := config.GetConfig()
+			if err != nil {
+				log.Fatalf("failed to get config: %v", err)
+			}
+			layout, err := repo.NewLayout(cfg.RepoLayout, cfg.RepoDataDir)
+			if err != nil {
+				log.Fatal(err)
+			}
+			path = layout.Dir(path)
+		}
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			path = filepath.Join(path, repo.HistoryFile)
+		}
+
+		entries, err := repo.ReadHistory(path)
+		if err != nil {
+			log.Fatalf("failed to read history: %v", err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+
+		switch {
+		case record != "":
+			collection, rkey, ok := strings.Cut(record, "/")
+			if !ok {
+				log.Fatalf("record should be collection/rkey, got %q", record)
+			}
+			for _, op := range repo.RecordHistory(entries, collection, rkey) {
+				if format == "jsonl" {
+					enc.Encode(map[string]any{"rev": op.Rev, "time": op.Time, "op": op.RecordChange})
+					continue
+				}
+				fmt.Printf("%s\t%s\t%s\t%s\n", op.Time.Format(time.RFC3339), op.Rev, op.Op, op.CID)
+			}
+
+		case at != "":
+			records := repo.RecordsAt(entries, at)
+			paths := make([]string, 0, len(records))
+			for p := range records {
+				paths = append(paths, p)
+			}
+			sort.Strings(paths)
+			for _, p := range paths {
+				if format == "jsonl" {
+					enc.Encode(map[string]string{"path": p, "cid": records[p].String()})
+					continue
+				}
+				fmt.Printf("%s\t%s\n", p, records[p])
+			}
+
+		default:
+			for _, e := range entries {
+				if format == "jsonl" {
+					enc.Encode(e)
+					continue
+				}
+				var created, updated, deleted int
+				for _, s := range repo.SummarizeChanges(e.Ops) {
+					created += s.Created
+					updated += s.Updated
+					deleted += s.Deleted
+				}
+				fmt.Printf("%s\t%s\t%s\t+%d ~%d -%d\n", e.Time.Format(time.RFC3339), e.Rev, e.Commit, created, updated, deleted)
+			}
+		}
+	},
+}
+
+func init() {
+	repoHistoryCmd.Flags().String("record", "", "show the ops on one record, as collection/rkey")
+	repoHistoryCmd.Flags().String("at", "", "list the records as of this rev")
+	repoHistoryCmd.Flags().String("format", "text", "output format, text or jsonl")
+}
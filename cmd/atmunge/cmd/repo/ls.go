@@ -3,7 +3,6 @@ package repo
 import (
 	"fmt"
 	"log"
-	"os"
 
 	"github.com/blebbit/atmunge/pkg/repo"
 	"github.com/ipfs/go-cid"
@@ -17,7 +16,7 @@ var repoLsCmd = &cobra.Command{
 	Aliases: []string{"list"},
 	Run: func(cmd *cobra.Command, args []string) {
 		carFile := args[0]
-		f, err := os.Open(carFile)
+		f, err := repo.OpenCar(carFile)
 		if err != nil {
 			log.Fatalf("failed to open car file: %v", err)
 		}
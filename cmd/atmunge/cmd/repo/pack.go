@@ -0,0 +1,93 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/blebbit/atmunge/pkg/repo"
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/spf13/cobra"
+)
+
+var repoPackCmd = &cobra.Command{
+	Use:   "pack <dir>",
+	Short: "Build a repo CAR from a directory of records",
+	Long: `Build a repo CAR from a directory of records, the inverse of repo unpack.
+
+Records are read from <dir>/<collection>/<rkey>.json and written with their MST and
+a commit at --rev. The commit is signed with --key (or --key-file), a multibase
+private key, and left unsigned otherwise. Other repo commands reject unsigned
+commits unless given --allow-unsigned (duckdb, sqlite, diff and export), so unsigned
+CARs are for fixtures. The did defaults to the account directory of an unpacked repo.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir := filepath.Clean(args[0])
+		did, _ := cmd.Flags().GetString("did")
+		rev, _ := cmd.Flags().GetString("rev")
+		keyStr, _ := cmd.Flags().GetString("key")
+		keyFile, _ := cmd.Flags().GetString("key-file")
+		out, _ := cmd.Flags().GetString("out")
+
+		if did == "" {
+			// repo unpack writes to <did>/unpacked
+			if parent := filepath.Base(filepath.Dir(dir)); strings.HasPrefix(parent, "did:") {
+				did = parent
+			} else {
+				return fmt.Errorf("pass --did, it is not in the path of %s", dir)
+			}
+		}
+		if keyFile != "" {
+			b, err := os.ReadFile(keyFile)
+			if err != nil {
+				return fmt.Errorf("failed to read key file: %w", err)
+			}
+			keyStr = strings.TrimSpace(string(b))
+		}
+		opts := repo.PackOptions{DID: did, Rev: rev}
+		if keyStr != "" {
+			key, err := crypto.ParsePrivateMultibase(keyStr)
+			if err != nil {
+				return fmt.Errorf("invalid key: %w", err)
+			}
+			opts.Key = key
+		}
+		if out == "" {
+			out = dir + ".car"
+		}
+
+		// write next to the destination and rename, so a failed pack leaves no partial CAR
+		f, err := os.CreateTemp(filepath.Dir(out), filepath.Base(out)+".*.tmp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		stats, err := repo.PackDir(context.Background(), dir, f, opts)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to pack %s: %w", dir, err)
+		}
+		if err := os.Rename(f.Name(), out); err != nil {
+			return err
+		}
+
+		signed := "unsigned"
+		if opts.Key != nil {
+			signed = "signed"
+		}
+		fmt.Printf("packed %d records (%d blocks) into %s, %s commit %s rev %s\n", stats.Records, stats.Blocks, out, signed, stats.Root, stats.Rev)
+		return nil
+	},
+}
+
+func init() {
+	repoPackCmd.Flags().String("did", "", "did of the repo, defaults to the account directory of an unpacked repo")
+	repoPackCmd.Flags().String("rev", "", "rev (TID) of the commit, defaults to now")
+	repoPackCmd.Flags().String("key", "", "multibase private key to sign the commit with")
+	repoPackCmd.Flags().String("key-file", "", "file holding the multibase private key")
+	repoPackCmd.Flags().String("out", "", "CAR file to write, defaults to <dir>.car")
+}
@@ -0,0 +1,89 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"syscall"
+
+	"github.com/blebbit/atmunge/pkg/config"
+	"github.com/blebbit/atmunge/pkg/repo"
+	"github.com/blebbit/atmunge/pkg/runtime"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+var repoRelayoutCmd = &cobra.Command{
+	Use:   "relayout",
+	Short: "Move the repo data dir (and repo storage) to another layout",
+	Long: `Move the repo data dir (and repo storage) to another layout.
+
+Accounts are moved one at a time, so an interrupted relayout can be rerun.
+Stop syncs while this runs, and set ATMUNGE_REPO_LAYOUT to the new layout afterwards.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		ctx, err := config.SetupLogging(ctx)
+		if err != nil {
+			return err
+		}
+		log := zerolog.Ctx(ctx).With().
+			Str("module", "repo").
+			Str("method", "relayout").
+			Logger()
+
+		r, err := runtime.NewRuntime(ctx)
+		if err != nil {
+			log.Error().Msgf("failed to create runtime: %s", err)
+			return err
+		}
+		defer r.Close()
+
+		fromKind, _ := cmd.Flags().GetString("from")
+		toKind, _ := cmd.Flags().GetString("to")
+		if fromKind == "" {
+			fromKind = r.Cfg.RepoLayout
+		}
+		from, err := repo.NewLayout(fromKind, r.Cfg.RepoDataDir)
+		if err != nil {
+			return err
+		}
+		to, err := repo.NewLayout(toKind, r.Cfg.RepoDataDir)
+		if err != nil {
+			return err
+		}
+		if from.Kind == to.Kind {
+			return fmt.Errorf("repo data dir is already %s", to.Kind)
+		}
+
+		log.Info().Msgf("Moving %s from %s to %s", r.Cfg.RepoDataDir, from.Kind, to.Kind)
+		stats, err := repo.Relayout(from, to, func(did string, err error) {
+			log.Warn().Msgf("skipping %s: %s", did, err)
+		})
+		if err != nil {
+			return fmt.Errorf("relayout failed after moving %d accounts: %w", stats.Moved, err)
+		}
+		log.Info().Msgf("Moved %d accounts, skipped %d", stats.Moved, stats.Skipped)
+
+		if r.Store != nil {
+			log.Info().Msgf("Moving %s from %s to %s", r.Cfg.RepoStorage, from.Kind, to.Kind)
+			stats, err := repo.RelayoutStore(ctx, r.Store, from, to)
+			if err != nil {
+				return fmt.Errorf("storage relayout failed after moving %d objects: %w", stats.Moved, err)
+			}
+			log.Info().Msgf("Moved %d objects, %d were already copied", stats.Moved, stats.Skipped)
+		}
+
+		if r.Cfg.RepoLayout != to.Kind {
+			log.Info().Msgf("Set ATMUNGE_REPO_LAYOUT=%s to use the new layout", to.Kind)
+		}
+		return nil
+	},
+}
+
+func init() {
+	repoRelayoutCmd.Flags().String("from", "", "current layout, defaults to ATMUNGE_REPO_LAYOUT")
+	repoRelayoutCmd.Flags().String("to", repo.LayoutSharded, "new layout, flat or sharded")
+}
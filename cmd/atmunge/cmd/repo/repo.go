@@ -11,12 +11,23 @@ var RepoCmd = &cobra.Command{
 }
 
 func init() {
+	RepoCmd.AddCommand(repoBlobsCmd)
+	RepoCmd.AddCommand(repoCompressCmd)
+	RepoCmd.AddCommand(repoDecompressCmd)
+	RepoCmd.AddCommand(repoDiffCmd)
+	RepoCmd.AddCommand(repoExportCmd)
+	RepoCmd.AddCommand(repoGcCmd)
 	RepoCmd.AddCommand(repoHackCmd)
+	RepoCmd.AddCommand(repoHistoryCmd)
 	RepoCmd.AddCommand(repoInspectCmd)
 	RepoCmd.AddCommand(repoLsCmd)
 	RepoCmd.AddCommand(repoMstCmd)
+	RepoCmd.AddCommand(repoPackCmd)
+	RepoCmd.AddCommand(repoRelayoutCmd)
 	RepoCmd.AddCommand(repoSyncCmd)
 	RepoCmd.AddCommand(repoUnpackCmd)
+	RepoCmd.AddCommand(repoValidateCmd)
 	RepoCmd.AddCommand(repoSqliteCmd)
 	RepoCmd.AddCommand(repoDuckDBCmd)
+	RepoCmd.AddCommand(repoVerifyCmd)
 }
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"os/signal"
-	"path/filepath"
 	"syscall"
 
 	"github.com/blebbit/atmunge/pkg/config"
@@ -17,7 +16,11 @@ import (
 var repoSqliteCmd = &cobra.Command{
 	Use:   "sqlite [acct]",
 	Short: "Convert a CAR file to an SQLite database for an account",
-	Args:  cobra.ExactArgs(1),
+	Long: `Convert a CAR file to an SQLite database for an account.
+
+An existing database is updated to the CAR's commit: records are diffed from the commit
+it reflects (the repo_state table), new and updated ones written and deleted ones removed.`,
+	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 		defer stop()
@@ -37,6 +40,7 @@ var repoSqliteCmd = &cobra.Command{
 			log.Error().Msgf("failed to create runtime: %s", err)
 			return err
 		}
+		defer r.Close()
 
 		handleOrDID := args[0]
 
@@ -45,18 +49,29 @@ var repoSqliteCmd = &cobra.Command{
 			return fmt.Errorf("failed to resolve did for %s: %w", handleOrDID, err)
 		}
 
-		carFile := filepath.Join(r.Cfg.RepoDataDir, did, "repo.car")
-		dbPath := filepath.Join(r.Cfg.RepoDataDir, did, "repo.sqlite")
+		carFile := r.Layout().Path(did, "repo.car")
+		dbPath := r.Layout().Path(did, "repo.sqlite")
+
+		bs, err := repo.OpenMemBlockstore(carFile)
+		if err != nil {
+			return fmt.Errorf("failed to open car file: %w", err)
+		}
+		if !bs.Root().Defined() {
+			return fmt.Errorf("car file %s does not exist or has no root", carFile)
+		}
 
 		log.Info().Msgf("Converting %s to %s", carFile, dbPath)
-		if err := repo.CarToSQLite(carFile, dbPath); err != nil {
+		allowUnsigned, _ := cmd.Flags().GetBool("allow-unsigned")
+		up, err := repo.UpdateSQLite(ctx, bs, dbPath, repo.UpdateOptions{AllowUnsigned: allowUnsigned})
+		if err != nil {
 			return fmt.Errorf("failed to convert CAR to SQLite: %w", err)
 		}
-		log.Info().Msgf("Successfully converted %s to %s", carFile, dbPath)
+		log.Info().Msgf("Successfully converted %s to %s at rev %s, %d created, %d updated, %d deleted",
+			carFile, dbPath, up.Rev, up.Created, up.Updated, up.Deleted)
 		return nil
 	},
 }
 
 func init() {
-	// no-op
+	repoSqliteCmd.Flags().Bool("allow-unsigned", false, "accept an unsigned commit, such as a repo pack fixture")
 }
@@ -19,6 +19,7 @@ var repoSyncCmd = &cobra.Command{
 		if err != nil {
 			log.Fatalf("failed to create runtime: %v", err)
 		}
+		defer rt.Close()
 
 		// The `acct.Sync` function handles car, duckdb, and blob syncing.
 		// We can specify which phases to run, by default it runs all.
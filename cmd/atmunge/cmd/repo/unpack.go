@@ -42,6 +42,7 @@ var repoUnpackCmd = &cobra.Command{
 			log.Error().Msgf("failed to create runtime: %s", err)
 			return err
 		}
+		defer r.Close()
 
 		handleOrDID := args[0]
 		did, _, err := r.ResolveDid(ctx, handleOrDID)
@@ -49,10 +50,10 @@ var repoUnpackCmd = &cobra.Command{
 			return fmt.Errorf("failed to resolve did for %s: %w", handleOrDID, err)
 		}
 
-		carFile := filepath.Join(r.Cfg.RepoDataDir, did, "repo.car")
-		outputDir := filepath.Join(r.Cfg.RepoDataDir, did, "unpacked")
+		carFile := r.Layout().Path(did, "repo.car")
+		outputDir := r.Layout().Path(did, "unpacked")
 
-		f, err := os.Open(carFile)
+		f, err := repo.OpenCar(carFile)
 		if err != nil {
 			return fmt.Errorf("failed to open car file %s: %w", carFile, err)
 		}
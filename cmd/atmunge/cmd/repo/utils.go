@@ -3,10 +3,15 @@ package repo
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
+	atrepo "github.com/blebbit/atmunge/pkg/repo"
+	"github.com/blebbit/atmunge/pkg/runtime"
 	"github.com/bluesky-social/indigo/atproto/repo"
 	"github.com/bluesky-social/indigo/atproto/repo/mst"
 	"github.com/bluesky-social/indigo/atproto/syntax"
@@ -14,7 +19,7 @@ import (
 )
 
 func loadCar(ctx context.Context, carFile string) (*repo.Repo, error) {
-	f, err := os.Open(carFile)
+	f, err := atrepo.OpenCar(carFile)
 	if err != nil {
 		log.Fatalf("failed to open car file: %w", err)
 	}
@@ -67,3 +72,94 @@ func loadCar(ctx context.Context, carFile string) (*repo.Repo, error) {
 
 	return r, nil
 }
+
+// repoSource is an account by did, or a car file given directly (did empty)
+type repoSource struct{ did, car string }
+
+// repoSources resolves the handles, dids and car files in args, and every account
+// under the repo data dir when all is set, to the CARs to read
+func repoSources(ctx context.Context, r *runtime.Runtime, args []string, all bool) ([]repoSource, error) {
+	layout := r.Layout()
+	var sources []repoSource
+	for _, arg := range args {
+		if _, err := os.Stat(arg); err == nil {
+			// a CAR in the repo data dir is the cached copy of an account
+			sources = append(sources, repoSource{did: cachedAccount(layout, arg), car: arg})
+			continue
+		}
+		did := arg
+		if !strings.HasPrefix(did, "did:") {
+			var err error
+			if did, _, err = r.ResolveDid(ctx, arg); err != nil {
+				return nil, fmt.Errorf("failed to resolve did for %s: %w", arg, err)
+			}
+		}
+		sources = append(sources, repoSource{did: did, car: layout.Path(did, "repo.car")})
+	}
+	if all {
+		err := r.WalkRepos(func(did string) error {
+			sources = append(sources, repoSource{did: did, car: layout.Path(did, "repo.car")})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to find repos: %w", err)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no accounts given, pass handles, dids or car files, or --all")
+	}
+	return sources, nil
+}
+
+// cachedAccount is the did of an account file under the repo data dir, empty for other paths
+func cachedAccount(layout atrepo.Layout, path string) string {
+	root, err := filepath.Abs(layout.Root)
+	if err != nil {
+		return ""
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	did, name, ok := layout.ParseKey(filepath.ToSlash(rel))
+	if !ok || name == "" {
+		return ""
+	}
+	return did
+}
+
+// rewriteRepoCars calls rewrite with the CAR of every source, it reports whether the file was rewritten.
+// Rewrites only change the local copy, so accounts are pulled from repo storage before
+// and pushed after, otherwise the next sync would pull the old CAR back.
+// Failures are logged and skipped, it returns how many CARs were rewritten.
+func rewriteRepoCars(r *runtime.Runtime, sources []repoSource, rewrite func(car string) (bool, error)) int {
+	count := 0
+	for _, src := range sources {
+		if src.did != "" {
+			if err := r.PullRepoFiles(src.did); err != nil {
+				log.Printf("failed to pull repo files for %s: %v", src.did, err)
+				continue
+			}
+		}
+		ok, err := rewrite(src.car)
+		if err != nil {
+			log.Printf("failed to rewrite %s: %v", src.car, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if src.did != "" {
+			if err := r.PushRepoFiles(src.did); err != nil {
+				log.Printf("failed to push repo files for %s: %v", src.did, err)
+				continue
+			}
+		}
+		count++
+	}
+	return count
+}
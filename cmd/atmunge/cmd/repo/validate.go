@@ -0,0 +1,110 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"syscall"
+
+	"github.com/blebbit/atmunge/pkg/config"
+	"github.com/blebbit/atmunge/pkg/lexicon"
+	"github.com/blebbit/atmunge/pkg/repo"
+	"github.com/blebbit/atmunge/pkg/runtime"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+var repoValidateCmd = &cobra.Command{
+	Use:   "validate [acct or car file...]",
+	Short: "Validate account records against their Lexicon schemas",
+	Long: `Validate account records against their Lexicon schemas.
+
+Schemas are the bundled app.bsky, chat.bsky and com.atproto lexicons plus the directories in
+ATMUNGE_LEXICON_DIRS and --lexicons, a schema there replaces a bundled one with the same id.
+Records of collections without a schema are counted as unknown.
+
+Invalid records are listed with their error, up to --errors (-1 for all), then the
+valid, invalid and unknown counts by NSID, summed over all accounts given (or --all).`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		all, _ := cmd.Flags().GetBool("all")
+		dirs, _ := cmd.Flags().GetStringSlice("lexicons")
+		maxErrors, _ := cmd.Flags().GetInt("errors")
+
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		ctx, err := config.SetupLogging(ctx)
+		if err != nil {
+			return err
+		}
+		log := zerolog.Ctx(ctx).With().
+			Str("module", "repo").
+			Str("method", "validate").
+			Logger()
+
+		r, err := runtime.NewRuntime(ctx)
+		if err != nil {
+			log.Error().Msgf("failed to create runtime: %s", err)
+			return err
+		}
+		defer r.Close()
+
+		v, err := lexicon.New(append(r.Cfg.LexiconDirs, dirs...)...)
+		if err != nil {
+			return err
+		}
+
+		sources, err := repoSources(ctx, r, args, all)
+		if err != nil {
+			return err
+		}
+
+		total := repo.NewValidationReport()
+		listed := 0
+		for _, src := range sources {
+			if src.did != "" {
+				if err := r.PullRepoFiles(src.did); err != nil {
+					return fmt.Errorf("failed to pull repo files: %w", err)
+				}
+			}
+			limit := -1
+			if maxErrors >= 0 {
+				limit = max(maxErrors-listed, 0)
+			}
+			rep, err := repo.ValidateCar(ctx, src.car, v, limit)
+			if err != nil {
+				if len(sources) == 1 {
+					return fmt.Errorf("failed to validate %s: %w", src.car, err)
+				}
+				log.Warn().Err(err).Msgf("skipping %s", src.car)
+				continue
+			}
+			for _, inv := range rep.Invalid {
+				fmt.Printf("%s: %s\n", inv.URI, inv.Error)
+			}
+			listed += len(rep.Invalid)
+			total.Merge(rep)
+		}
+		if listed > 0 {
+			fmt.Println()
+		}
+
+		fmt.Printf("%-40s %10s %10s %10s\n", "NSID", "VALID", "INVALID", "UNKNOWN")
+		for _, nsid := range total.NSIDs() {
+			c := total.Collections[nsid]
+			fmt.Printf("%-40s %10d %10d %10d\n", nsid, c.Valid, c.Invalid, c.Unknown)
+		}
+		t := total.Totals()
+		fmt.Printf("%-40s %10d %10d %10d\n", "total", t.Valid, t.Invalid, t.Unknown)
+		if len(sources) > 1 {
+			log.Info().Msgf("Validated %d records from %d accounts", total.Records, len(sources))
+		}
+		return nil
+	},
+}
+
+func init() {
+	repoValidateCmd.Flags().Bool("all", false, "validate every account under the repo data dir")
+	repoValidateCmd.Flags().StringSlice("lexicons", nil, "extra directories of Lexicon schema files")
+	repoValidateCmd.Flags().Int("errors", 20, "invalid records to list, -1 for all")
+}
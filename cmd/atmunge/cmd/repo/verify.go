@@ -0,0 +1,85 @@
+package repo
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/blebbit/atmunge/pkg/repo"
+	"github.com/blebbit/atmunge/pkg/runtime"
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/spf13/cobra"
+)
+
+var repoVerifyCmd = &cobra.Command{
+	Use:   "verify [car file]",
+	Short: "Verify the commit signature and MST completeness of a CAR file",
+	Long: `Verify the commit signature and MST completeness of a CAR file.
+
+The signing key comes from the PLC mirror (or the identity directory for other DIDs)
+unless given with --key. Every MST node and record referenced from the commit must be present.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		carFile := args[0]
+		didKey, _ := cmd.Flags().GetString("key")
+
+		// loaded in memory so the file is left untouched
+		bs, err := repo.OpenMemBlockstore(carFile)
+		if err != nil {
+			log.Fatalf("failed to open car file: %v", err)
+		}
+		if !bs.Root().Defined() {
+			log.Fatalf("car file %s does not exist or has no root", carFile)
+		}
+
+		report, err := repo.VerifyTree(bs, bs.Root())
+		if err != nil {
+			log.Fatalf("failed to walk repo: %v", err)
+		}
+		fmt.Printf("DID: %s\n", report.DID)
+		fmt.Printf("Rev: %s\n", report.Rev)
+		fmt.Printf("Commit: %s\n", bs.Root())
+
+		var key crypto.PublicKey
+		if didKey != "" {
+			key, err = crypto.ParsePublicDIDKey(didKey)
+		} else {
+			var rt *runtime.Runtime
+			rt, err = runtime.NewRuntime(cmd.Context())
+			if err != nil {
+				log.Fatalf("failed to create runtime: %v", err)
+			}
+			defer rt.Close()
+			key, err = rt.SigningKey(cmd.Context(), report.DID)
+		}
+		if err != nil {
+			log.Fatalf("failed to get signing key for %s: %v", report.DID, err)
+		}
+
+		ok := true
+		if _, err := repo.VerifyCommit(bs, bs.Root(), key); err != nil {
+			fmt.Printf("Signature: FAILED (%v)\n", err)
+			ok = false
+		} else {
+			fmt.Printf("Signature: ok (%s)\n", key.DIDKey())
+		}
+
+		fmt.Printf("MST nodes: %d\n", report.Nodes)
+		fmt.Printf("Records: %d\n", report.Records)
+		if len(report.Missing) > 0 {
+			fmt.Printf("Missing blocks: %d\n", len(report.Missing))
+			for _, c := range report.Missing {
+				fmt.Printf("  - %s\n", c)
+			}
+			ok = false
+		}
+
+		if !ok {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	repoVerifyCmd.Flags().String("key", "", "verify against this did:key instead of looking it up")
+}
@@ -10,6 +10,8 @@ import (
 	"github.com/blebbit/atmunge/cmd/atmunge/cmd/db"
 	"github.com/blebbit/atmunge/cmd/atmunge/cmd/plc"
 	"github.com/blebbit/atmunge/cmd/atmunge/cmd/repo"
+	"github.com/blebbit/atmunge/pkg/config"
+	"github.com/blebbit/atmunge/pkg/util/cassette"
 	"github.com/spf13/cobra"
 )
 
@@ -23,6 +25,29 @@ var rootCmd = &cobra.Command{
 	Use:   "atmunge",
 	Short: "AT Mirror is a set of tools for backfilling and mirroring the AT Protocol network",
 	Long:  rootLong,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		record, _ := cmd.Flags().GetString("record")
+		replay, _ := cmd.Flags().GetString("replay")
+		if record == "" && replay == "" {
+			return nil
+		}
+		if record != "" && replay != "" {
+			return fmt.Errorf("--record and --replay are mutually exclusive")
+		}
+
+		cfg, err := config.GetConfig()
+		if err != nil {
+			return err
+		}
+		if record != "" {
+			cfg.HTTPCassette = record
+			cfg.HTTPCassetteMode = string(cassette.ModeRecord)
+		} else {
+			cfg.HTTPCassette = replay
+			cfg.HTTPCassetteMode = string(cassette.ModeReplay)
+		}
+		return nil
+	},
 }
 
 func Execute() {
@@ -33,6 +58,9 @@ func Execute() {
 }
 
 func init() {
+	rootCmd.PersistentFlags().String("record", "", "record HTTP traffic to a cassette file, for use as test fixtures")
+	rootCmd.PersistentFlags().String("replay", "", "replay HTTP traffic from a cassette file instead of the network")
+
 	rootCmd.AddCommand(acct.AcctCmd)
 	rootCmd.AddCommand(ai.AICmd)
 	rootCmd.AddCommand(backfill.BackfillCmd)
@@ -39,6 +39,7 @@ var runCmd = &cobra.Command{
 			log.Error().Msgf("failed to create runtime: %s", err)
 			return err
 		}
+		defer r.Close()
 		jsonBytes, jerr := json.MarshalIndent(r.Cfg, "", "  ")
 		if jerr != nil {
 			fmt.Println("Error marshalling config to JSON:", jerr)
@@ -3,7 +3,6 @@ package acct
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 
 	"github.com/blebbit/atmunge/pkg/repo"
 	"github.com/blebbit/atmunge/pkg/runtime"
@@ -38,7 +37,7 @@ func Expand(rt *runtime.Runtime, did string, what string) error {
 func ExpandRefRecords(rt *runtime.Runtime, did string) error {
 	log.Info().Str("did", did).Msg("expanding ref repos for account")
 
-	dbPath := filepath.Join(rt.Cfg.RepoDataDir, did, "repo.duckdb")
+	dbPath := rt.Layout().Path(did, "repo.duckdb")
 	db, err := repo.InitDuckDB(dbPath)
 	if err != nil {
 		// if the duckdb file doesn't exist, that's fine, we just don't have any refs yet
@@ -72,7 +71,7 @@ func ExpandRefRecords(rt *runtime.Runtime, did string) error {
 		log.Info().Str("did", refDid).Int("n", i+1).Int("total", total).Msg("processing ref repo")
 
 		// 1. load duckdb for refDid
-		refDbPath := filepath.Join(rt.Cfg.RepoDataDir, refDid, "repo.duckdb")
+		refDbPath := rt.Layout().Path(refDid, "repo.duckdb")
 		refDb, err := repo.InitDuckDB(refDbPath)
 		if err != nil {
 			if os.IsNotExist(err) {
@@ -121,7 +120,7 @@ func ExpandRefRecords(rt *runtime.Runtime, did string) error {
 func ExpandRefRepos(rt *runtime.Runtime, did string) error {
 	log.Info().Str("did", did).Msg("expanding ref repos for account")
 
-	dbPath := filepath.Join(rt.Cfg.RepoDataDir, did, "repo.duckdb")
+	dbPath := rt.Layout().Path(did, "repo.duckdb")
 	db, err := repo.InitDuckDB(dbPath)
 	if err != nil {
 		// if the duckdb file doesn't exist, that's fine, we just don't have any refs yet
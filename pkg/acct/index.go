@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 
+	"github.com/blebbit/atmunge/pkg/repo"
 	_ "github.com/marcboeker/go-duckdb/v2"
 	"github.com/rs/zerolog/log"
 )
@@ -17,6 +18,11 @@ func Index(ctx context.Context, dbPath string, indexNames []string) error {
 	}
 	defer db.Close()
 
+	// databases converted before the typed tables existed get them here
+	if err := repo.UpdateTypedTables(ctx, db); err != nil {
+		return fmt.Errorf("failed to update typed tables: %w", err)
+	}
+
 	if len(indexNames) == 0 {
 		// Default behavior: run all index queries
 		_, err := runAllSQLFiles(ctx, db, "index")
@@ -0,0 +1,83 @@
+package acct
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blebbit/atmunge/pkg/repo"
+	"github.com/blebbit/atmunge/pkg/util/fakepds"
+)
+
+func TestIndexTypedTables(t *testing.T) {
+	// duckdb migrations are read relative to the repo root
+	t.Chdir("../..")
+
+	pds := fakepds.New()
+	defer pds.Close()
+	acct, err := pds.CreateRepo("alice.test", fakepds.SampleRecords("alice.test", 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pds.Commit(acct.DID, fakepds.Records{
+		"app.bsky.feed.like/3kabc": {
+			"$type":     "app.bsky.feed.like",
+			"subject":   map[string]any{"uri": "at://did:plc:bob/app.bsky.feed.post/3kxyz", "cid": "bafyreig2fjxi3rptqdgylg7e5hmjl6mcke7rn2b6cugzlqq3i4zu6rq52q"},
+			"createdAt": "2024-01-01T00:00:00.000Z",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	car, err := acct.CAR("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	carPath := filepath.Join(dir, "repo.car")
+	if err := os.WriteFile(carPath, car, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "repo.duckdb")
+	if err := repo.CarToDuckDB(context.Background(), carPath, dbPath, repo.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a database converted before the typed tables existed
+	db, err := sql.Open("duckdb", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range repo.TypedTables {
+		if _, err := db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	likes, err := Query(context.Background(), dbPath, []string{"count_likes_by_did"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(likes) != 1 || likes[0]["did"] != "did:plc:bob" {
+		t.Errorf("got %+v, want one like of did:plc:bob", likes)
+	}
+	if _, err := Query(context.Background(), dbPath, []string{"SELECT count(*) AS n FROM posts"}); err == nil {
+		t.Error("a query created the typed tables")
+	}
+
+	// acct index adds them
+	if err := Index(context.Background(), dbPath, nil); err != nil {
+		t.Fatal(err)
+	}
+	posts, err := Query(context.Background(), dbPath, []string{"SELECT count(*) AS n FROM posts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 1 || posts[0]["n"] != int64(3) {
+		t.Errorf("got %+v, want 3 posts", posts)
+	}
+}
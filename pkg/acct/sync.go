@@ -2,12 +2,12 @@ package acct
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/blebbit/atmunge/pkg/repo"
+	"github.com/blebbit/atmunge/pkg/rlproxy"
 	"github.com/blebbit/atmunge/pkg/runtime"
 	"github.com/rs/zerolog/log"
 )
@@ -15,6 +15,9 @@ import (
 func Sync(rt *runtime.Runtime, handleOrDID string, phases []string) error {
 	if len(phases) == 0 {
 		phases = []string{"car", "duckdb", "blobs"}
+		if rt.Cfg.RepoCompact {
+			phases = []string{"car", "gc", "duckdb", "blobs"}
+		}
 	}
 	log.Info().Msgf("Syncing account: %s, with phases: %v", handleOrDID, phases)
 	ctx := context.Background()
@@ -26,7 +29,7 @@ func Sync(rt *runtime.Runtime, handleOrDID string, phases []string) error {
 	}
 	log.Info().Msgf("Resolved %s to %s on PDS %s", handleOrDID, did, pds)
 
-	repoDir := filepath.Join(rt.Cfg.RepoDataDir, did)
+	repoDir := rt.Layout().Dir(did)
 	if err := os.MkdirAll(repoDir, 0755); err != nil {
 		return fmt.Errorf("failed to create repo directory for %s: %w", did, err)
 	}
@@ -38,38 +41,96 @@ func Sync(rt *runtime.Runtime, handleOrDID string, phases []string) error {
 		switch phase {
 		case "car":
 			log.Info().Msgf("Syncing CAR file to %s", carPath)
-			blockstore, since, err := repo.LoadLocalCar(carPath)
-			if err != nil && !errors.Is(err, os.ErrNotExist) {
+			if err := rt.PullRepoFiles(did); err != nil {
+				return fmt.Errorf("failed to pull repo files: %w", err)
+			}
+			bs, err := repo.OpenBlockstore(rt.Cfg.RepoBlockstore, carPath)
+			if err != nil {
 				return fmt.Errorf("failed to load local car: %w", err)
 			}
+			defer bs.Close()
+			since := bs.Rev()
+			oldRoot := bs.Root()
 
-			carData, err := repo.GetRepo(rt.Ctx, rt.Proxy, pds, did, since)
+			updatePath, updateSize, err := repo.GetRepo(rlproxy.WithRetry(rt.Ctx, rt.Retry), rt.Proxy, pds, did, since, rt.RepoFetchOptions(repoDir, did))
 			if err != nil {
 				return fmt.Errorf("failed to get repo: %w", err)
 			}
+			defer os.Remove(updatePath)
+
+			if updateSize > 0 {
+				updateFile, err := os.Open(updatePath)
+				if err != nil {
+					return fmt.Errorf("failed to open update: %w", err)
+				}
+				defer updateFile.Close()
 
-			if len(carData) > 0 {
-				newRoot, _, _, err := repo.MergeUpdate(blockstore, carData)
+				newRoot, _, _, err := repo.MergeUpdate(bs, updateFile)
 				if err != nil {
 					return fmt.Errorf("failed to merge update: %w", err)
 				}
-				if err := repo.WriteCar(carPath, newRoot, blockstore); err != nil {
+				if err := bs.Commit(newRoot); err != nil {
 					return fmt.Errorf("failed to write car: %w", err)
 				}
+				if err := rt.VerifyRepo(bs, did); err != nil {
+					log.Warn().Err(err).Msg("Repo failed verification")
+				}
+				if _, err := rt.RecordRepoChanges(bs, repoDir, oldRoot, since); err != nil {
+					log.Warn().Err(err).Msg("Failed to record repo changes")
+				}
 				log.Info().Msg("CAR file updated")
 			} else {
 				log.Info().Msg("CAR file is up to date")
 			}
+			if err := bs.Close(); err != nil {
+				return fmt.Errorf("failed to close car: %w", err)
+			}
+			if rt.Cfg.RepoCompress && !repo.IsCompressedCar(carPath) {
+				stats, err := repo.CompressCar(carPath, rt.Cfg.RepoCompressLevel)
+				if err != nil {
+					return fmt.Errorf("failed to compress car: %w", err)
+				}
+				log.Info().Msgf("Compressed CAR file to %d bytes (%.2fx)", stats.Compressed, stats.Ratio())
+			}
+			if err := rt.PushRepoFiles(did); err != nil {
+				return err
+			}
+		case "gc":
+			log.Info().Msgf("Compacting CAR file %s", carPath)
+			stats, err := repo.CompactCar(carPath, rt.Cfg.RepoCompactKeep, rt.Cfg.RepoCompressLevel)
+			if err != nil {
+				return fmt.Errorf("failed to compact car: %w", err)
+			}
+			log.Info().Msgf("Kept %d of %d blocks, reclaimed %d bytes", stats.Kept, stats.Blocks, stats.Reclaimed())
+			if err := rt.PushRepoFiles(did); err != nil {
+				return err
+			}
 		case "duckdb":
 			log.Info().Msgf("Converting CAR to DuckDB at %s", duckdbPath)
-			if err := repo.CarToDuckDB(rt.Ctx, carPath, duckdbPath); err != nil {
+			if err := repo.CarToDuckDB(rt.Ctx, carPath, duckdbPath, repo.UpdateOptions{}); err != nil {
 				return fmt.Errorf("failed to convert car to duckdb: %w", err)
 			}
 			log.Info().Msg("DuckDB conversion complete")
 		case "blobs":
 			log.Info().Msg("Syncing blobs")
-			repo.SyncBlobs(pds, did, rt.Cfg.RepoDataDir)
-			log.Info().Msg("Blob sync complete")
+			if err := rt.PullRepoFiles(did); err != nil {
+				return fmt.Errorf("failed to pull repo files: %w", err)
+			}
+			opts := rt.BlobSyncOptions(did)
+			if rt.Cfg.BlobRefsOnly {
+				if opts.Refs, err = blobRefs(rt.Ctx, duckdbPath); err != nil {
+					return err
+				}
+			}
+			stats, err := repo.SyncBlobs(rlproxy.WithRetry(rt.Ctx, rt.Retry), rt.Proxy, pds, did, rt.RepoStore(), rt.Layout(), opts)
+			if err != nil {
+				return fmt.Errorf("failed to sync blobs: %w", err)
+			}
+			if err := rt.PushRepoFiles(did); err != nil {
+				return err
+			}
+			log.Info().Msgf("Blob sync complete, %d listed, %d filtered, %d already synced, %d fetched (%d bytes), %d deduped, %d failed, %d removed",
+				stats.Listed, stats.Filtered, stats.Skipped, stats.Fetched, stats.Bytes, stats.Deduped, stats.Failed, stats.Removed)
 		default:
 			return fmt.Errorf("unknown phase: %s", phase)
 		}
@@ -78,3 +139,20 @@ func Sync(rt *runtime.Runtime, handleOrDID string, phases []string) error {
 	log.Info().Msgf("Successfully synced account %s", handleOrDID)
 	return nil
 }
+
+// blobRefs extracts the blob refs from the account's records in DuckDB
+func blobRefs(ctx context.Context, dbPath string) ([]repo.BlobRef, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, fmt.Errorf("blob refs need the duckdb phase first: %w", err)
+	}
+	db, err := repo.InitDuckDB(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if _, err := runSQLFile(ctx, db, "index", "0200_extract_blobs"); err != nil {
+		return nil, err
+	}
+	return repo.ReadBlobRefs(ctx, db)
+}
@@ -0,0 +1,125 @@
+package acct
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/ipfs/go-cid"
+
+	"github.com/blebbit/atmunge/pkg/repo"
+	"github.com/blebbit/atmunge/pkg/rlproxy"
+	"github.com/blebbit/atmunge/pkg/storage"
+	"github.com/blebbit/atmunge/pkg/util/fakepds"
+)
+
+func TestBlobRefs(t *testing.T) {
+	// duckdb migrations are read relative to the repo root
+	t.Chdir("../..")
+
+	pds := fakepds.New()
+	defer pds.Close()
+	acct, err := pds.CreateRepo("alice.test", fakepds.SampleRecords("alice.test", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := func(b []byte, mimeType string) data.Blob {
+		t.Helper()
+		c, err := pds.AddBlob(acct.DID, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data.Blob{Ref: data.CIDLink(c), MimeType: mimeType, Size: int64(len(b))}
+	}
+	avatar := blob([]byte("\xff\xd8\xff avatar"), "image/jpeg")
+	image := blob([]byte("\x89PNG\r\n\x1a\n image"), "image/png")
+	video := blob([]byte("video bytes"), "video/mp4")
+	// listed by the PDS but not referenced by any record
+	blob([]byte("orphan"), "image/png")
+
+	_, err = pds.Commit(acct.DID, fakepds.Records{
+		"app.bsky.actor.profile/self": {
+			"$type":       "app.bsky.actor.profile",
+			"displayName": "alice",
+			"avatar":      avatar,
+		},
+		"app.bsky.feed.post/3kabc": {
+			"$type": "app.bsky.feed.post",
+			"text":  "pics",
+			"embed": map[string]any{
+				"$type": "app.bsky.embed.images",
+				"images": []any{
+					map[string]any{"alt": "one", "image": image},
+					// the same blob twice
+					map[string]any{"alt": "two", "image": image},
+				},
+			},
+		},
+		"app.bsky.feed.post/3kdef": {
+			"$type": "app.bsky.feed.post",
+			"text":  "clip",
+			"embed": map[string]any{"$type": "app.bsky.embed.video", "video": video},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	car, err := acct.CAR("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	carPath := filepath.Join(dir, "repo.car")
+	if err := os.WriteFile(carPath, car, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "repo.duckdb")
+	if err := repo.CarToDuckDB(context.Background(), carPath, dbPath, repo.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := blobRefs(context.Background(), dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[cid.Cid]string{
+		cid.Cid(avatar.Ref): "image/jpeg",
+		cid.Cid(image.Ref):  "image/png",
+		cid.Cid(video.Ref):  "video/mp4",
+	}
+	if len(refs) != len(want) {
+		t.Fatalf("got %d blob refs %+v, want %d", len(refs), refs, len(want))
+	}
+	for _, ref := range refs {
+		c, _ := cid.Decode(ref.CID)
+		if want[c] != ref.MimeType || ref.Size == 0 {
+			t.Errorf("got ref %+v, want %s", ref, want[c])
+		}
+	}
+	// indexing again does not duplicate refs
+	if again, err := blobRefs(context.Background(), dbPath); err != nil || len(again) != len(refs) {
+		t.Errorf("got %d refs reindexing, want %d: %v", len(again), len(refs), err)
+	}
+
+	// only referenced images are fetched
+	store := storage.NewLocal(t.TempDir())
+	layout, _ := repo.NewLayout(repo.LayoutFlat, t.TempDir())
+	stats, err := repo.SyncBlobs(context.Background(), rlproxy.New(&http.Client{}), pds.URL, acct.DID, store, layout, repo.BlobSyncOptions{
+		Refs:      refs,
+		MimeTypes: []string{"image/*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Listed != 3 || stats.Filtered != 1 || stats.Fetched != 2 {
+		t.Errorf("got stats %+v, want 3 refs, 1 filtered, 2 fetched", stats)
+	}
+	if ok, _ := storage.Exists(context.Background(), store, layout.Key(acct.DID, "blobs/"+video.Ref.String()+".blob")); ok {
+		t.Error("filtered video blob was fetched")
+	}
+}
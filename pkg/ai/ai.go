@@ -29,6 +29,8 @@ func NewAI() (*AI, error) {
 	}, nil
 }
 
-func (a *AI) GetRepoDataDir() string {
-	return a.r.Cfg.RepoDataDir
+// Close closes the runtime, saving its learned proxy state and recorded cassette.
+// Commands defer it after NewAI.
+func (a *AI) Close() error {
+	return a.r.Close()
 }
@@ -9,7 +9,7 @@ type Config struct {
 	// ops config
 	LogFormat   string `split_words:"true" default:"text"`
 	LogLevel    int64  `split_words:"true" default:"1"`
-	MetricsPort string `split_words:"true"`
+	MetricsPort string `split_words:"true"` // /metrics during backfills, run serves it on HTTPPort
 	DBUrl       string `envconfig:"POSTGRES_URL"`
 
 	// plc config
@@ -17,8 +17,75 @@ type Config struct {
 	PlcFilter      bool   `split_words:"true" default:"false"`
 	PlcMirrorDelay int    `split_words:"true" default:"10"`
 
+	// backfill config, how long (seconds) a run waits for failed jobs to come due for a retry,
+	// retries scheduled further out are left for the next run
+	BackfillRetryWait int `split_words:"true" default:"900"`
+	// how long (seconds) a job is leased to a worker, renewed while it runs,
+	// so this only bounds how long the jobs of a crashed worker wait to be picked up again
+	BackfillJobLease int `split_words:"true" default:"900"`
+
 	// repo config
 	RepoDataDir string `split_words:"true" default:"./data/repos"`
+	// how accounts are arranged under RepoDataDir, "flat" (<did>/) or "sharded" (<ab>/<cd>/<did>/),
+	// change with `atmunge repo relayout`
+	RepoLayout string `split_words:"true" default:"flat"`
+	// getRepo download limits, size in MB and timeout in seconds (0 disables)
+	RepoMaxSizeMb    int `split_words:"true" default:"4096"`
+	RepoFetchTimeout int `split_words:"true" default:"600"`
+	// blob sync, blobs fetched at once per account, size limit in MB and per blob timeout in seconds (0 disables)
+	BlobConcurrency  int `split_words:"true" default:"4"`
+	BlobMaxSizeMb    int `split_words:"true" default:"100"`
+	BlobFetchTimeout int `split_words:"true" default:"120"`
+	// only fetch blobs referenced by records (from the account's DuckDB), optionally of these MIME types (image/*)
+	BlobRefsOnly  bool     `split_words:"true" default:"false"`
+	BlobMimeTypes []string `split_words:"true"`
+	// where blob bytes are kept in repo storage, "account" (<did>/blobs/<cid>.blob) or
+	// "shared" (blobs/<xy>/<cid>.blob, once for all accounts, with a ref per account),
+	// move with `atmunge repo blobs share` and collect unreferenced blobs with `atmunge repo blobs gc`
+	BlobStore string `split_words:"true" default:"account"`
+	// directories of Lexicon schema files to validate records with during DuckDB/SQLite conversion,
+	// alongside the bundled app.bsky, chat.bsky and com.atproto lexicons (a schema here replaces a bundled one)
+	LexiconDirs []string `split_words:"true"`
+	// local repo blockstore, "car" appends to an indexed CARv2, "memory" loads and rewrites the whole CAR
+	RepoBlockstore string `split_words:"true" default:"car"`
+	// compact the CAR to the reachable blocks after each sync that changed it,
+	// keeping the blocks of the previous RepoCompactKeep commits
+	RepoCompact     bool `split_words:"true" default:"false"`
+	RepoCompactKeep int  `split_words:"true" default:"0"`
+	// keep CARs zstd compressed at rest (repo.car.zst), they are inflated while a sync merges into them
+	RepoCompress      bool `split_words:"true" default:"false"`
+	RepoCompressLevel int  `split_words:"true" default:"3"`
+	// update the account's repo.duckdb / repo.sqlite after each repo-sync that changed the repo,
+	// applying only the record changes (off by default, the databases add to the disk footprint)
+	RepoSyncDuckDB bool `envconfig:"REPO_SYNC_DUCKDB" default:"false"`
+	RepoSyncSQLite bool `envconfig:"REPO_SYNC_SQLITE" default:"false"`
+
+	// where repo artifacts (CARs, history, blobs) are kept: a directory, file:///dir or s3://bucket/prefix,
+	// when set RepoDataDir is a local cache, otherwise everything stays in RepoDataDir
+	RepoStorage string `split_words:"true"`
+	S3Endpoint  string `split_words:"true"`
+	S3Region    string `split_words:"true"`
+	S3AccessKey string `split_words:"true"`
+	S3SecretKey string `split_words:"true"`
+	// plain http, for a local MinIO
+	S3Insecure bool `split_words:"true" default:"false"`
+
+	// rate limited proxy config
+	ProxyRetryAttempts int `split_words:"true" default:"5"`
+	ProxyRetryBaseMs   int `split_words:"true" default:"1000"`
+	ProxyRetryMaxMs    int `split_words:"true" default:"60000"`
+	// per host (group) caps and circuit breaker, cooldown in seconds
+	ProxyMaxConcurrency   int      `split_words:"true" default:"16"`
+	ProxyBreakerThreshold int      `split_words:"true" default:"5"`
+	ProxyBreakerCooldown  int      `split_words:"true" default:"60"`
+	ProxyHostGroups       []string `split_words:"true" default:"*.host.bsky.network"`
+	// pinned rate limits per host (group), host:policy pairs like "plc.directory:500;w=300"
+	ProxyHostLimits map[string]string `split_words:"true"`
+	// where learned rate limits are kept across restarts, empty disables
+	ProxyStateFile string `split_words:"true" default:"./data/rlproxy-state.json"`
+	// record HTTP traffic to, or replay it from, a cassette file (mode is record or replay)
+	HTTPCassette     string `envconfig:"HTTP_CASSETTE"`
+	HTTPCassetteMode string `envconfig:"HTTP_CASSETTE_MODE" default:"replay"`
 
 	// server config
 	RunPlcMirror  bool   `split_words:"true" default:"true"`
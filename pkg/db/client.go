@@ -60,12 +60,21 @@ func MigrateModels(db *gorm.DB) error {
 	if err := db.AutoMigrate(&AccountInfo{}); err != nil {
 		return fmt.Errorf("auto-migrating DB schema: %w", err)
 	}
+	if err := dedupePdsRepos(db); err != nil {
+		return err
+	}
 	if err := db.AutoMigrate(&PdsRepo{}); err != nil {
 		return fmt.Errorf("auto-migrating DB schema: %w", err)
 	}
 	if err := db.AutoMigrate(&AccountRepo{}); err != nil {
 		return fmt.Errorf("auto-migrating DB schema: %w", err)
 	}
+	if err := db.AutoMigrate(&PdsHost{}); err != nil {
+		return fmt.Errorf("auto-migrating DB schema: %w", err)
+	}
+	if err := db.AutoMigrate(&BackfillJob{}); err != nil {
+		return fmt.Errorf("auto-migrating DB schema: %w", err)
+	}
 
 	return nil
 }
@@ -77,6 +86,8 @@ func ClearTables(db *gorm.DB, tables []string) error {
 			"plc_log_entries",
 			"account_infos",
 			"pds_repos",
+			"pds_hosts",
+			"backfill_jobs",
 		}
 	}
 	for _, table := range tables {
@@ -94,6 +105,8 @@ func DropTables(db *gorm.DB) error {
 		"plc_log_entries",
 		"account_infos",
 		"pds_repos",
+		"pds_hosts",
+		"backfill_jobs",
 	}
 	for _, table := range tables {
 		if res := db.Exec("DROP TABLE IF EXISTS " + table); res.Error != nil {
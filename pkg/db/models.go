@@ -66,14 +66,37 @@ type PdsRepo struct {
 	UpdatedAt time.Time
 	DeletedAt time.Time
 
-	PDS    string `gorm:"column:pds;index:idx_pds"`
-	DID    string `gorm:"column:did;index:idx_did"`
+	// unique together for the pds-accounts upsert, see schema.go
+	PDS    string `gorm:"column:pds;index:idx_pds;uniqueIndex:idx_pds_repos_pds_did"`
+	DID    string `gorm:"column:did;index:idx_did;uniqueIndex:idx_pds_repos_pds_did"`
 	Head   string `gorm:"column:head"`
 	Rev    string `gorm:"column:rev"`
 	Active bool   `gorm:"column:active;default:true"`
 	Status string `gorm:"column:status"`
 }
 
+// PdsHost is our registry of PDS hosts,
+// merged from the various sources we discover them from (scraping json, relays, plc logs)
+type PdsHost struct {
+	ID        ID `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt time.Time
+
+	PDS      string `gorm:"column:pds;uniqueIndex:idx_pds_hosts_pds"`
+	Hostname string `gorm:"column:hostname;index:idx_pds_hosts_hostname"`
+
+	// what the relay reports about the host
+	Relay             string    `gorm:"column:relay"`
+	RelayAccountCount int64     `gorm:"column:relay_account_count"`
+	RelaySeq          int64     `gorm:"column:relay_seq"`
+	RelayStatus       string    `gorm:"column:relay_status"`
+	RelaySeenAt       time.Time `gorm:"column:relay_seen_at"`
+
+	// what we know about the host, from pds_repos
+	AccountCount int64 `gorm:"column:account_count"`
+}
+
 type AccountInfo struct {
 	ID        ID `gorm:"primarykey"`
 	CreatedAt time.Time
@@ -96,16 +119,44 @@ type AccountInfo struct {
 }
 
 type AccountRepo struct {
-	DID string `gorm:"primarykey;column:did;index:did_timestamp;uniqueIndex:did"`
+	// the primary key is its index, see schema.go
+	DID string `gorm:"primarykey;column:did"`
 
 	Rev         string `gorm:"column:rev;index:idx_rev"`
 	LastChanged time.Time
 
+	// signature check of the commit at rev against the mirrored DID doc
+	Verified    bool   `gorm:"column:verified;default:false"`
+	VerifyError string `gorm:"column:verify_error"`
+
+	// record changes per collection in the last sync that changed the repo
+	Changes JSONRaw `gorm:"column:changes;type:JSONB"`
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt time.Time
 }
 
+// BackfillJob is a durable work item for a backfill phase,
+// leased by workers with SELECT ... FOR UPDATE SKIP LOCKED
+type BackfillJob struct {
+	ID        ID `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Phase string `gorm:"column:phase;uniqueIndex:idx_backfill_jobs_phase_did;index:idx_backfill_jobs_lease,priority:1"`
+	DID   string `gorm:"column:did;uniqueIndex:idx_backfill_jobs_phase_did"`
+
+	// queued, running, failed, done
+	Status     string    `gorm:"column:status;default:queued;index:idx_backfill_jobs_lease,priority:2"`
+	Attempts   int       `gorm:"column:attempts;default:0"`
+	NextRunAt  time.Time `gorm:"column:next_run_at;index:idx_backfill_jobs_lease,priority:3"`
+	LeaseUntil time.Time `gorm:"column:lease_until"`
+	// LeaseToken is set on each lease, completions and failures must hold it
+	LeaseToken string `gorm:"column:lease_token"`
+	LastError  string `gorm:"column:last_error"`
+}
+
 const PlcLogEntryConflictPsqlfunction = `
 create or replace function before_update_on_plc_log_entries()
 returns trigger language plpgsql as $$
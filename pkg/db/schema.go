@@ -0,0 +1,35 @@
+package db
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// Schema fixes to tables of the original schema, applied by MigrateModels.
+//
+// pds_repos gets a unique (pds, did) index, which the pds-accounts upsert (ON CONFLICT (pds, did))
+// always needed, it failed without one. Duplicate rows are removed first, see dedupePdsRepos.
+//
+// account_repos no longer declares the did_timestamp and did indexes on its did column.
+// The primary key already indexes it, and the names were copied from account_infos,
+// so creating them clashed with that table's indexes of the same name.
+// AutoMigrate does not drop indexes, existing databases keep them.
+
+// dedupePdsRepos removes duplicate (pds, did) rows before AutoMigrate adds their unique index.
+// Earlier schemas only had separate indexes, so listRepos runs could insert an account twice,
+// the newest row is kept. It only runs while the index is missing.
+func dedupePdsRepos(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&PdsRepo{}) || m.HasIndex(&PdsRepo{}, "idx_pds_repos_pds_did") {
+		return nil
+	}
+	err := db.Exec(`
+		DELETE FROM pds_repos
+		WHERE id NOT IN (SELECT max(id) FROM pds_repos GROUP BY pds, did)
+	`).Error
+	if err != nil {
+		return fmt.Errorf("deduplicating pds_repos: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// legacyPdsRepo is pds_repos before (pds, did) was unique
+type legacyPdsRepo struct {
+	ID  ID     `gorm:"primarykey"`
+	PDS string `gorm:"column:pds;index:idx_pds"`
+	DID string `gorm:"column:did;index:idx_did"`
+	Rev string `gorm:"column:rev"`
+}
+
+func (legacyPdsRepo) TableName() string { return "pds_repos" }
+
+func TestMigrateDedupesPdsRepos(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "atmunge.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&legacyPdsRepo{}); err != nil {
+		t.Fatal(err)
+	}
+	rows := []legacyPdsRepo{
+		{PDS: "https://pds.test", DID: "did:plc:a", Rev: "1"},
+		{PDS: "https://pds.test", DID: "did:plc:a", Rev: "2"},
+		{PDS: "https://pds.test", DID: "did:plc:b", Rev: "1"},
+		{PDS: "https://other.test", DID: "did:plc:a", Rev: "1"},
+	}
+	if err := db.Create(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateModels(db); err != nil {
+		t.Fatal(err)
+	}
+	if !db.Migrator().HasIndex(&PdsRepo{}, "idx_pds_repos_pds_did") {
+		t.Error("unique index not created")
+	}
+	var repos []PdsRepo
+	if err := db.Order("id").Find(&repos).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 3 || repos[0].Rev != "2" {
+		t.Errorf("got %d repos, want 3 keeping the newest duplicate: %+v", len(repos), repos)
+	}
+
+	// migrating again leaves the rows alone
+	if err := MigrateModels(db); err != nil {
+		t.Fatal(err)
+	}
+}
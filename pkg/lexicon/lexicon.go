@@ -0,0 +1,140 @@
+// Package lexicon validates records against Lexicon schemas, the bundled
+// app.bsky, chat.bsky and com.atproto lexicons plus schema directories given by the user.
+package lexicon
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	indigoLexicon "github.com/bluesky-social/indigo/atproto/lexicon"
+)
+
+// bundled holds the upstream app.bsky, chat.bsky and com.atproto lexicons,
+// unmodified (see lexicons/README.md for the commit they came from)
+//
+//go:embed lexicons
+var bundled embed.FS
+
+// validation statuses
+const (
+	// StatusValid records match their collection's schema
+	StatusValid = "valid"
+	// StatusInvalid records do not match their collection's schema
+	StatusInvalid = "invalid"
+	// StatusUnknown records are in a collection without a schema
+	StatusUnknown = "unknown"
+)
+
+// Result is the outcome of validating a record, stored as extra.validation by the converters.
+type Result struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Validator checks records against a catalog of Lexicon schemas.
+type Validator struct {
+	cat   indigoLexicon.BaseCatalog
+	flags indigoLexicon.ValidateFlags
+}
+
+// New loads the schemas in dirs and the bundled ones. A schema in dirs replaces
+// the bundled schema with the same id, so newer versions can be dropped in.
+func New(dirs ...string) (*Validator, error) {
+	v := &Validator{
+		cat: indigoLexicon.NewBaseCatalog(),
+		// repos hold records from 2023 on, legacy blobs and datetimes without a timezone included
+		flags: indigoLexicon.LenientMode,
+	}
+	loaded := make(map[string]bool)
+	for _, dir := range dirs {
+		if err := v.load(os.DirFS(dir), loaded, false); err != nil {
+			return nil, fmt.Errorf("failed to load lexicons from %s: %w", dir, err)
+		}
+	}
+	if err := v.load(bundled, loaded, true); err != nil {
+		return nil, fmt.Errorf("failed to load bundled lexicons: %w", err)
+	}
+	return v, nil
+}
+
+// load adds the .json schema files under fsys, skipping ids already loaded when skip is set
+func (v *Validator) load(fsys fs.FS, loaded map[string]bool, skip bool) error {
+	return fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(p, ".json") {
+			return nil
+		}
+		b, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		var sf indigoLexicon.SchemaFile
+		if err := json.Unmarshal(b, &sf); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		if skip && loaded[sf.ID] {
+			return nil
+		}
+		if err := v.cat.AddSchemaFile(sf); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		loaded[sf.ID] = true
+		return nil
+	})
+}
+
+// Has reports whether there is a record schema for the collection.
+func (v *Validator) Has(nsid string) bool {
+	s, err := v.cat.Resolve(nsid)
+	if err != nil {
+		return false
+	}
+	_, ok := s.Def.(indigoLexicon.SchemaRecord)
+	return ok
+}
+
+// Validate checks a decoded record (atproto data model, as from data.UnmarshalCBOR)
+// against the schema of its collection.
+func (v *Validator) Validate(nsid string, rec map[string]any) Result {
+	if !v.Has(nsid) {
+		return Result{Status: StatusUnknown}
+	}
+	if err := indigoLexicon.ValidateRecord(&v.cat, rec, nsid, v.flags); err != nil {
+		return Result{Status: StatusInvalid, Error: err.Error()}
+	}
+	return Result{Status: StatusValid}
+}
+
+var (
+	bundledOnce      sync.Once
+	bundledValidator *Validator
+	bundledErr       error
+
+	defaultValidator atomic.Pointer[Validator]
+)
+
+// Default is the validator used by the record converters,
+// the bundled schemas (loaded once) unless SetDefault was called.
+func Default() (*Validator, error) {
+	if v := defaultValidator.Load(); v != nil {
+		return v, nil
+	}
+	bundledOnce.Do(func() {
+		bundledValidator, bundledErr = New()
+	})
+	return bundledValidator, bundledErr
+}
+
+// SetDefault replaces the validator used by the record converters,
+// the runtime sets one with the configured lexicon directories.
+func SetDefault(v *Validator) {
+	defaultValidator.Store(v)
+}
@@ -0,0 +1,179 @@
+package lexicon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/ipfs/go-cid"
+)
+
+func TestValidate(t *testing.T) {
+	v, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref := map[string]any{
+		"uri": "at://did:plc:abc123/app.bsky.feed.post/3l3qo2vuowo2b",
+		"cid": "bafyreig2fjxi3rptqdgylg7e5hmjl6mcke7rn2b6cugzlqq3i4zu6rq52q",
+	}
+	blob := data.Blob{
+		Ref:      data.CIDLink(cid.MustParse("bafkreiabgxv3rxk6r2n5fmnz4wsfcvpvvvo5aukzphgvsmvrrg3hqbutcu")),
+		MimeType: "image/png",
+		Size:     1234,
+	}
+	tests := []struct {
+		name   string
+		nsid   string
+		rec    map[string]any
+		status string
+	}{
+		{"post", "app.bsky.feed.post", map[string]any{
+			"$type":     "app.bsky.feed.post",
+			"text":      "hello #atproto",
+			"createdAt": "2024-01-01T00:00:00.000Z",
+			"langs":     []any{"en"},
+			"reply":     map[string]any{"root": ref, "parent": ref},
+			"facets": []any{map[string]any{
+				"index":    map[string]any{"byteStart": int64(6), "byteEnd": int64(14)},
+				"features": []any{map[string]any{"$type": "app.bsky.richtext.facet#tag", "tag": "atproto"}},
+			}},
+			"embed": map[string]any{
+				"$type":  "app.bsky.embed.recordWithMedia",
+				"record": map[string]any{"record": ref},
+				"media": map[string]any{
+					"$type":  "app.bsky.embed.images",
+					"images": []any{map[string]any{"image": blob, "alt": ""}},
+				},
+			},
+		}, StatusValid},
+		{"post without createdAt", "app.bsky.feed.post", map[string]any{
+			"$type": "app.bsky.feed.post",
+			"text":  "hello",
+		}, StatusInvalid},
+		{"post too long", "app.bsky.feed.post", map[string]any{
+			"$type":     "app.bsky.feed.post",
+			"text":      string(make([]byte, 3001)),
+			"createdAt": "2024-01-01T00:00:00.000Z",
+		}, StatusInvalid},
+		{"like of a bad uri", "app.bsky.feed.like", map[string]any{
+			"$type":     "app.bsky.feed.like",
+			"subject":   map[string]any{"uri": "not a uri", "cid": ref["cid"]},
+			"createdAt": "2024-01-01T00:00:00.000Z",
+		}, StatusInvalid},
+		{"mismatched type", "app.bsky.feed.like", map[string]any{
+			"$type":     "app.bsky.feed.repost",
+			"subject":   ref,
+			"createdAt": "2024-01-01T00:00:00.000Z",
+		}, StatusInvalid},
+		{"profile", "app.bsky.actor.profile", map[string]any{
+			"$type":       "app.bsky.actor.profile",
+			"displayName": "alice",
+			"avatar":      blob,
+		}, StatusValid},
+		{"unknown embed", "app.bsky.feed.post", map[string]any{
+			"$type":     "app.bsky.feed.post",
+			"text":      "",
+			"createdAt": "2024-01-01T00:00:00.000Z",
+			"embed":     map[string]any{"$type": "com.example.embed", "x": int64(1)},
+		}, StatusValid},
+		{"threadgate", "app.bsky.feed.threadgate", map[string]any{
+			"$type":     "app.bsky.feed.threadgate",
+			"post":      ref["uri"],
+			"allow":     []any{map[string]any{"$type": "app.bsky.feed.threadgate#mentionRule"}},
+			"createdAt": "2024-01-01T00:00:00.000Z",
+		}, StatusValid},
+		{"chat declaration", "chat.bsky.actor.declaration", map[string]any{
+			"$type":         "chat.bsky.actor.declaration",
+			"allowIncoming": "following",
+		}, StatusValid},
+		{"unknown collection", "com.example.thing", map[string]any{
+			"$type": "com.example.thing",
+		}, StatusUnknown},
+	}
+	for _, tt := range tests {
+		res := v.Validate(tt.nsid, tt.rec)
+		if res.Status != tt.status {
+			t.Errorf("%s: got %+v, want %s", tt.name, res, tt.status)
+		}
+		if (res.Status == StatusInvalid) != (res.Error != "") {
+			t.Errorf("%s: got error %q for status %s", tt.name, res.Error, res.Status)
+		}
+	}
+
+	for _, nsid := range []string{
+		"app.bsky.feed.postgate",
+		"app.bsky.feed.generator",
+		"app.bsky.graph.listblock",
+		"app.bsky.graph.starterpack",
+		"app.bsky.labeler.service",
+	} {
+		if !v.Has(nsid) {
+			t.Errorf("no bundled schema for %s", nsid)
+		}
+	}
+}
+
+func TestUserLexicons(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, schema string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(schema), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("thing.json", `{"lexicon": 1, "id": "com.example.thing", "defs": {"main": {
+		"type": "record", "key": "any",
+		"record": {"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}}}
+	}}}`)
+	// replaces the bundled follow
+	write("follow.json", `{"lexicon": 1, "id": "app.bsky.graph.follow", "defs": {"main": {
+		"type": "record", "key": "tid",
+		"record": {"type": "object", "required": ["subject", "note"], "properties": {"subject": {"type": "string"}, "note": {"type": "string"}}}
+	}}}`)
+
+	v, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := v.Validate("com.example.thing", map[string]any{"$type": "com.example.thing", "name": "x"}); res.Status != StatusValid {
+		t.Errorf("got %+v for a user lexicon record", res)
+	}
+	if res := v.Validate("com.example.thing", map[string]any{"$type": "com.example.thing"}); res.Status != StatusInvalid {
+		t.Errorf("got %+v for an invalid user lexicon record", res)
+	}
+	follow := map[string]any{"$type": "app.bsky.graph.follow", "subject": "did:plc:abc123", "createdAt": "2024-01-01T00:00:00.000Z"}
+	if res := v.Validate("app.bsky.graph.follow", follow); res.Status != StatusInvalid {
+		t.Errorf("got %+v, the user follow schema should replace the bundled one", res)
+	}
+	if !v.Has("app.bsky.feed.post") {
+		t.Error("bundled schemas missing alongside user lexicons")
+	}
+
+	write("dup.json", `{"lexicon": 1, "id": "com.example.thing", "defs": {"main": {"type": "token"}}}`)
+	if _, err := New(dir); err == nil {
+		t.Error("loaded two schemas with the same id")
+	}
+}
+
+func TestDefault(t *testing.T) {
+	v, err := Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := Default(); again != v {
+		t.Error("the bundled schemas were loaded twice")
+	}
+
+	custom, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetDefault(custom)
+	defer SetDefault(nil)
+	if got, _ := Default(); got != custom {
+		t.Error("SetDefault did not replace the default validator")
+	}
+}
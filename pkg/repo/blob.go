@@ -1,21 +1,42 @@
 package repo
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/wandb/parallel"
+
+	"github.com/blebbit/atmunge/pkg/rlproxy"
+	"github.com/blebbit/atmunge/pkg/storage"
 )
 
-// TODO, these should be using the rate limiter proxy
-// check other repo functions for similar places we should be
+// BlobIndexFile lists the blobs synced for an account, kept next to repo.car
+const BlobIndexFile = "blobs.jsonl"
+
+var (
+	// ErrBlobMismatch is returned when a blob's bytes do not hash to its CID.
+	ErrBlobMismatch = errors.New("blob does not match its cid")
+	// ErrBlobTooLarge is returned when a blob is over BlobSyncOptions.MaxBytes.
+	ErrBlobTooLarge = errors.New("blob too large")
+)
 
 // ListBlobs fetches the list of all blob CIDs for a given repo, handling pagination.
-func ListBlobs(pdsHost, did string) ([]string, error) {
+func ListBlobs(ctx context.Context, proxy *rlproxy.Proxy, pdsHost, did string) ([]string, error) {
 	var allCids []string
 	var cursor string
 
@@ -24,29 +45,18 @@ func ListBlobs(pdsHost, did string) ([]string, error) {
 		endpoint.Path = "/xrpc/com.atproto.sync.listBlobs"
 		queryParams := url.Values{}
 		queryParams.Set("did", did)
-		queryParams.Set("limit", "1000") // Adjust limit as needed
+		queryParams.Set("limit", "1000")
 		if cursor != "" {
 			queryParams.Set("cursor", cursor)
 		}
 		endpoint.RawQuery = queryParams.Encode()
 
-		resp, err := http.Get(endpoint.String())
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			return nil, fmt.Errorf("bad response status: %s, body: %s", resp.Status, string(body))
-		}
-
 		var listResp struct {
 			Cursor *string  `json:"cursor"`
 			Cids   []string `json:"cids"`
 		}
-		if err := json.NewDecoder(resp.Body).Decode(&listResp); err != nil {
-			return nil, fmt.Errorf("failed to decode listBlobs response: %w", err)
+		if err := getJSON(ctx, proxy, endpoint.String(), &listResp); err != nil {
+			return nil, fmt.Errorf("failed to list blobs: %w", err)
 		}
 
 		allCids = append(allCids, listResp.Cids...)
@@ -60,67 +70,413 @@ func ListBlobs(pdsHost, did string) ([]string, error) {
 	return allCids, nil
 }
 
-// GetBlob fetches a single blob.
-func GetBlob(pdsHost, did, cid string) ([]byte, error) {
+func getJSON(ctx context.Context, proxy *rlproxy.Proxy, endpoint string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := proxy.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("bad response status: %s, body: %s", resp.Status, string(body))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// GetBlob streams a blob to w, checking its bytes against the CID as they arrive.
+// It returns the MIME type the PDS served it with and the size.
+// On ErrBlobMismatch or ErrBlobTooLarge, w has received bytes that should be discarded.
+func GetBlob(ctx context.Context, proxy *rlproxy.Proxy, pdsHost, did string, c cid.Cid, w io.Writer, maxBytes int64) (string, int64, error) {
+	h, err := blobHasher(c)
+	if err != nil {
+		return "", 0, err
+	}
+
 	endpoint, _ := url.Parse(pdsHost)
 	endpoint.Path = "/xrpc/com.atproto.sync.getBlob"
 	queryParams := url.Values{}
 	queryParams.Set("did", did)
-	queryParams.Set("cid", cid)
+	queryParams.Set("cid", c.String())
 	endpoint.RawQuery = queryParams.Encode()
 
-	resp, err := http.Get(endpoint.String())
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := proxy.Do(req)
 	if err != nil {
-		return nil, err
+		return "", 0, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("bad response status: %s, body: %s", resp.Status, string(body))
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", 0, fmt.Errorf("bad response status: %s, body: %s", resp.Status, string(body))
 	}
+	if maxBytes > 0 && resp.ContentLength > maxBytes {
+		return "", 0, fmt.Errorf("%w: %d > %d bytes", ErrBlobTooLarge, resp.ContentLength, maxBytes)
+	}
+
+	var body io.Reader = resp.Body
+	if maxBytes > 0 {
+		// one more byte than allowed, so we can tell when it is exceeded
+		body = io.LimitReader(body, maxBytes+1)
+	}
+	n, err := io.Copy(io.MultiWriter(w, h), body)
+	if err != nil {
+		return "", n, fmt.Errorf("failed to download blob: %w", err)
+	}
+	if maxBytes > 0 && n > maxBytes {
+		return "", n, fmt.Errorf("%w: more than %d bytes", ErrBlobTooLarge, maxBytes)
+	}
+
+	got, err := multihash.Encode(h.Sum(nil), multihash.SHA2_256)
+	if err != nil {
+		return "", n, err
+	}
+	if !cid.NewCidV1(c.Prefix().Codec, got).Equals(c) {
+		return "", n, fmt.Errorf("%w: %s", ErrBlobMismatch, c)
+	}
+	return resp.Header.Get("Content-Type"), n, nil
+}
+
+// blobHasher checks the CID is one we can verify, atproto blobs are sha256
+func blobHasher(c cid.Cid) (hash.Hash, error) {
+	if c.Prefix().MhType != multihash.SHA2_256 {
+		return nil, fmt.Errorf("unsupported blob hash in %s", c)
+	}
+	return sha256.New(), nil
+}
+
+// BlobEntry is a synced blob in the blob index.
+type BlobEntry struct {
+	CID      string    `json:"cid"`
+	MimeType string    `json:"mimeType,omitempty"`
+	Size     int64     `json:"size"`
+	Time     time.Time `json:"time"`
+}
+
+// ReadBlobIndex reads the blob index at path, keyed by CID.
+// A missing file is an empty index, and a torn last line from a crash is skipped.
+func ReadBlobIndex(path string) (map[string]BlobEntry, error) {
+	index := make(map[string]BlobEntry)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob index: %w", err)
+	}
+	defer f.Close()
+
+	var pending error
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		if pending != nil {
+			return nil, pending
+		}
+		var e BlobEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			pending = fmt.Errorf("invalid blob index entry on line %d: %w", line, err)
+			continue
+		}
+		index[e.CID] = e
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read blob index: %w", err)
+	}
+	return index, nil
+}
+
+// BlobRef is a blob referenced by a record ($type: blob), with the MIME type and size the record declares.
+type BlobRef struct {
+	CID      string
+	MimeType string
+	Size     int64
+}
+
+// MatchMimeType reports whether mimeType matches one of patterns,
+// a pattern ending in /* matches the whole major type (image/*). No patterns matches everything.
+func MatchMimeType(mimeType string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if major, ok := strings.CutSuffix(p, "/*"); ok {
+			if strings.HasPrefix(mimeType, major+"/") {
+				return true
+			}
+		} else if mimeType == p {
+			return true
+		}
+	}
+	return false
+}
+
+// BlobSyncOptions bound a blob sync.
+type BlobSyncOptions struct {
+	// Concurrency is the number of blobs fetched at once, 1 when unset
+	Concurrency int
+	// MaxBytes skips larger blobs (0 disables)
+	MaxBytes int64
+	// Timeout per blob (0 disables)
+	Timeout time.Duration
+	// Report is called after each blob is fetched or fails
+	Report func(c string, size int64, err error)
+
+	// Refs limits the sync to blobs referenced by records, rather than every blob the PDS lists,
+	// nil lists them all while empty means the records reference none
+	Refs []BlobRef
+	// MimeTypes keeps only refs of these types (see MatchMimeType),
+	// refs declaring a size over MaxBytes are skipped without fetching
+	MimeTypes []string
 
-	return io.ReadAll(resp.Body)
+	// Shared keeps blobs once in the shared store (BlobStoreShared) with a ref for the account,
+	// rather than under the account
+	Shared bool
 }
 
-// SyncBlobs fetches and saves blobs for a repo.
-func SyncBlobs(pdsHost, did, dataDir string) {
-	cids, err := ListBlobs(pdsHost, did)
+// BlobSyncStats counts what a blob sync did.
+type BlobSyncStats struct {
+	Listed   int
+	Skipped  int // already in the index
+	Filtered int // refs left out by MIME type or size
+	Fetched  int
+	Deduped  int // already in the shared store, only the ref was added
+	Failed   int
+	Removed  int // in the index but no longer listed
+	Bytes    int64
+}
+
+// SyncBlobs fetches the blobs of a repo not yet in its blob index, to blobs/<cid>.blob of the account in the store,
+// or to the shared store with opts.Shared.
+// With opts.Refs, only the referenced blobs passing the filters are fetched, otherwise every blob the PDS lists.
+// Blobs are downloaded to a temp file in the account dir, verified against their CID, uploaded,
+// then appended to the index, so an interrupted sync resumes where it stopped.
+// Blobs in the index the PDS no longer lists are dropped from it, along with their object or shared ref.
+// Nothing is dropped with opts.Refs, the refs of a stale or partial DuckDB, or the filtered ones,
+// do not tell which blobs the account still has.
+// Failed blobs are counted and reported, only listing failures are returned.
+func SyncBlobs(ctx context.Context, proxy *rlproxy.Proxy, pdsHost, did string, store storage.Storage, layout Layout, opts BlobSyncOptions) (*BlobSyncStats, error) {
+	stats := &BlobSyncStats{}
+	cids, listed, err := blobsToSync(ctx, proxy, pdsHost, did, opts, stats)
+	if err != nil {
+		return stats, err
+	}
+
+	dir := layout.Dir(did)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return stats, err
+	}
+	indexPath := layout.Path(did, BlobIndexFile)
+	index, err := ReadBlobIndex(indexPath)
 	if err != nil {
-		log.Printf("failed to list blobs: %v", err)
-		return
+		return stats, err
+	}
+	if listed != nil {
+		if stats.Removed, err = pruneBlobIndex(ctx, store, layout, did, indexPath, index, listed, opts.Shared); err != nil {
+			return stats, err
+		}
+	}
+	indexFile, err := os.OpenFile(indexPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return stats, fmt.Errorf("failed to open blob index: %w", err)
+	}
+	defer indexFile.Close()
+
+	var mu sync.Mutex
+	done := func(e BlobEntry, deduped bool, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err == nil {
+			var b []byte
+			if b, err = json.Marshal(e); err == nil {
+				_, err = indexFile.Write(append(b, '\n'))
+			}
+		}
+		switch {
+		case err != nil:
+			stats.Failed++
+		case deduped:
+			stats.Deduped++
+		default:
+			stats.Fetched++
+			stats.Bytes += e.Size
+		}
+		if opts.Report != nil {
+			opts.Report(e.CID, e.Size, err)
+		}
 	}
 
-	if len(cids) == 0 {
-		fmt.Println("No blobs found for repo.")
-		return
+	group := parallel.Limited(ctx, max(opts.Concurrency, 1))
+	for _, s := range cids {
+		if _, ok := index[s]; ok {
+			stats.Skipped++
+			continue
+		}
+		group.Go(func(ctx context.Context) {
+			e, deduped, err := syncBlob(ctx, proxy, pdsHost, did, s, store, layout, opts)
+			done(e, deduped, err)
+		})
 	}
+	group.Wait()
 
-	fmt.Printf("Found %d blobs for repo. Checking for missing blobs...\n", len(cids))
+	if err := indexFile.Sync(); err != nil {
+		return stats, err
+	}
+	return stats, ctx.Err()
+}
 
-	blobsDir := filepath.Join(dataDir, did, "blobs")
-	if err := os.MkdirAll(blobsDir, 0o755); err != nil {
-		log.Printf("failed to create blobs directory: %v", err)
-		return
+// blobsToSync lists the blob CIDs to fetch, from the refs or the PDS,
+// and the blobs the PDS listed, nil when syncing refs
+func blobsToSync(ctx context.Context, proxy *rlproxy.Proxy, pdsHost, did string, opts BlobSyncOptions, stats *BlobSyncStats) ([]string, map[string]bool, error) {
+	if opts.Refs == nil {
+		cids, err := ListBlobs(ctx, proxy, pdsHost, did)
+		listed := make(map[string]bool, len(cids))
+		for _, s := range cids {
+			listed[s] = true
+		}
+		stats.Listed = len(cids)
+		return cids, listed, err
 	}
 
-	for _, c := range cids {
-		blobPath := filepath.Join(blobsDir, c+".blob")
-		if _, err := os.Stat(blobPath); err == nil {
-			// file exists, skip
+	// records may share a blob, keep the first ref
+	seen := make(map[string]bool)
+	var cids []string
+	for _, ref := range opts.Refs {
+		if seen[ref.CID] {
+			continue
+		}
+		seen[ref.CID] = true
+		stats.Listed++
+		if !MatchMimeType(ref.MimeType, opts.MimeTypes) || (opts.MaxBytes > 0 && ref.Size > opts.MaxBytes) {
+			stats.Filtered++
 			continue
 		}
+		cids = append(cids, ref.CID)
+	}
+	return cids, nil, nil
+}
 
-		blobData, err := GetBlob(pdsHost, did, c)
-		if err != nil {
-			log.Printf("failed to get blob %s: %v", c, err)
-			continue // continue to next blob
+// pruneBlobIndex drops the index entries of blobs the PDS no longer lists,
+// deleting the blob (or the account's ref to the shared blob), then rewrites the index
+func pruneBlobIndex(ctx context.Context, store storage.Storage, layout Layout, did, indexPath string, index map[string]BlobEntry, listed map[string]bool, shared bool) (int, error) {
+	var removed []string
+	for s := range index {
+		if !listed[s] {
+			removed = append(removed, s)
 		}
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+
+	for _, s := range removed {
+		key := layout.BlobKey(did, s)
+		if shared {
+			key = BlobRefKey(s, did)
+		}
+		if err := store.Delete(ctx, key); err != nil {
+			return 0, fmt.Errorf("failed to remove blob %s: %w", s, err)
+		}
+		delete(index, s)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(indexPath), "blobs-*.jsonl")
+	if err != nil {
+		return 0, fmt.Errorf("failed to rewrite blob index: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range index {
+		if err = enc.Encode(e); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), indexPath)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to rewrite blob index: %w", err)
+	}
+	return len(removed), nil
+}
+
+// syncBlob fetches one blob to a temp file and uploads it.
+// In the shared store, the account's ref is added first and a blob already stored is not fetched again (deduped).
+func syncBlob(ctx context.Context, proxy *rlproxy.Proxy, pdsHost, did, s string, store storage.Storage, layout Layout, opts BlobSyncOptions) (e BlobEntry, deduped bool, err error) {
+	e = BlobEntry{CID: s}
+	c, err := cid.Decode(s)
+	if err != nil {
+		return e, false, fmt.Errorf("invalid blob cid: %w", err)
+	}
+	key := layout.BlobKey(did, s)
+	if opts.Shared {
+		key = SharedBlobKey(s)
+		// the ref comes before the blob, so GCBlobs does not collect a blob being synced
+		if err := AddBlobRef(ctx, store, s, did); err != nil {
+			return e, false, err
+		}
+		defer func() {
+			if err != nil {
+				store.Delete(ctx, BlobRefKey(s, did))
+			}
+		}()
+		info, err := store.Stat(ctx, key)
+		if err == nil {
+			e.Size = info.Size
+			e.MimeType = refMimeType(opts.Refs, s)
+			e.Time = time.Now().UTC()
+			return e, true, nil
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			return e, false, fmt.Errorf("failed to stat shared blob: %w", err)
+		}
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	f, err := os.CreateTemp(layout.Dir(did), "getblob-*.blob")
+	if err != nil {
+		return e, false, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	e.MimeType, e.Size, err = GetBlob(ctx, proxy, pdsHost, did, c, f, opts.MaxBytes)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return e, false, err
+	}
+	if err = storage.PutFile(ctx, store, key, f.Name()); err != nil {
+		return e, false, fmt.Errorf("failed to store blob: %w", err)
+	}
+	e.Time = time.Now().UTC()
+	return e, false, nil
+}
 
-		if err := os.WriteFile(blobPath, blobData, 0o644); err != nil {
-			log.Printf("failed to write blob %s: %v", c, err)
-			continue // continue to next blob
+// refMimeType is the MIME type a record declares for a blob, when syncing from refs
+func refMimeType(refs []BlobRef, s string) string {
+	for _, ref := range refs {
+		if ref.CID == s {
+			return ref.MimeType
 		}
-		fmt.Printf("Saved blob: %s\n", blobPath)
 	}
+	return ""
 }
@@ -0,0 +1,179 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/blebbit/atmunge/pkg/rlproxy"
+	"github.com/blebbit/atmunge/pkg/storage"
+	"github.com/blebbit/atmunge/pkg/util/fakepds"
+)
+
+func TestSyncBlobs(t *testing.T) {
+	pds := fakepds.New()
+	defer pds.Close()
+
+	acct, err := pds.CreateRepo("alice.test", fakepds.SampleRecords("alice.test", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := map[cid.Cid][]byte{}
+	var cids []cid.Cid
+	for i := range 12 {
+		b := []byte(fmt.Sprintf("blob %d %s", i, bytes.Repeat([]byte{'x'}, i*100)))
+		if i == 0 {
+			b = append([]byte("\x89PNG\r\n\x1a\n"), b...)
+		}
+		c, err := pds.AddBlob(acct.DID, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blobs[c] = b
+		cids = append(cids, c)
+	}
+	// the PDS serves bad bytes for one blob
+	if err := pds.SetBlobData(acct.DID, cids[3], []byte("not the blob")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := rlproxy.WithRetry(context.Background(), rlproxy.RetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: time.Second})
+	proxy := rlproxy.New(&http.Client{})
+	store := storage.NewLocal(t.TempDir())
+	layout, _ := NewLayout(LayoutSharded, t.TempDir())
+
+	var mu sync.Mutex
+	failed := map[string]error{}
+	opts := BlobSyncOptions{
+		Concurrency: 4,
+		MaxBytes:    1050,
+		Report: func(c string, size int64, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed[c] = err
+			}
+		},
+	}
+
+	// a transient failure is retried by the proxy
+	pds.Fail("com.atproto.sync.getBlob", http.StatusServiceUnavailable, 1)
+	stats, err := SyncBlobs(ctx, proxy, pds.URL, acct.DID, store, layout, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// blob 11 is over the size limit
+	if stats.Listed != 12 || stats.Fetched != 10 || stats.Failed != 2 {
+		t.Errorf("got stats %+v, want 12 listed, 10 fetched, 2 failed", stats)
+	}
+	if !errors.Is(failed[cids[3].String()], ErrBlobMismatch) {
+		t.Errorf("got %v for the corrupt blob, want ErrBlobMismatch", failed[cids[3].String()])
+	}
+	if !errors.Is(failed[cids[11].String()], ErrBlobTooLarge) {
+		t.Errorf("got %v for the large blob, want ErrBlobTooLarge", failed[cids[11].String()])
+	}
+	if ok, _ := storage.Exists(ctx, store, layout.Key(acct.DID, "blobs/"+cids[3].String()+".blob")); ok {
+		t.Error("corrupt blob was stored")
+	}
+
+	index, err := ReadBlobIndex(layout.Path(acct.DID, BlobIndexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 10 {
+		t.Errorf("got %d blobs in the index, want 10", len(index))
+	}
+	png := index[cids[0].String()]
+	if png.MimeType != "image/png" || png.Size != int64(len(blobs[cids[0]])) {
+		t.Errorf("got index entry %+v, want an image/png of %d bytes", png, len(blobs[cids[0]]))
+	}
+	rc, err := store.Get(ctx, layout.Key(acct.DID, "blobs/"+cids[5].String()+".blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(got, blobs[cids[5]]) {
+		t.Error("stored blob differs from the PDS")
+	}
+
+	// the next sync resumes with only the blobs missing from the index
+	if err := pds.SetBlobData(acct.DID, cids[3], blobs[cids[3]]); err != nil {
+		t.Fatal(err)
+	}
+	before := pds.Requests("com.atproto.sync.getBlob")
+	stats, err = SyncBlobs(ctx, proxy, pds.URL, acct.DID, store, layout, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Skipped != 10 || stats.Fetched != 1 || stats.Failed != 1 {
+		t.Errorf("got stats %+v, want 10 skipped, 1 fetched, 1 failed", stats)
+	}
+	if n := pds.Requests("com.atproto.sync.getBlob") - before; n != 2 {
+		t.Errorf("got %d getBlob requests on resume, want 2", n)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(layout.Dir(acct.DID), "getblob-*")); len(matches) != 0 {
+		t.Errorf("temp files left behind: %v", matches)
+	}
+}
+
+// TestSyncBlobsRefsKeepsIndex checks switching an account synced in full to refs only,
+// with a partial set of refs, does not drop the blobs the refs leave out
+func TestSyncBlobsRefsKeepsIndex(t *testing.T) {
+	ctx := context.Background()
+	pds := fakepds.New()
+	defer pds.Close()
+
+	acct, err := pds.CreateRepo("alice.test", fakepds.SampleRecords("alice.test", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cids []cid.Cid
+	for i := range 3 {
+		c, err := pds.AddBlob(acct.DID, []byte(fmt.Sprintf("blob %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cids = append(cids, c)
+	}
+
+	proxy := rlproxy.New(&http.Client{})
+	store := storage.NewLocal(t.TempDir())
+	layout, _ := NewLayout(LayoutFlat, t.TempDir())
+	if stats, err := SyncBlobs(ctx, proxy, pds.URL, acct.DID, store, layout, BlobSyncOptions{}); err != nil || stats.Fetched != 3 {
+		t.Fatalf("got stats %+v, want 3 fetched: %v", stats, err)
+	}
+
+	// one ref, and one filtered out by its type
+	opts := BlobSyncOptions{
+		Refs: []BlobRef{
+			{CID: cids[0].String(), MimeType: "image/png"},
+			{CID: cids[1].String(), MimeType: "video/mp4"},
+		},
+		MimeTypes: []string{"image/*"},
+	}
+	stats, err := SyncBlobs(ctx, proxy, pds.URL, acct.DID, store, layout, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != 0 || stats.Skipped != 1 || stats.Filtered != 1 {
+		t.Errorf("got stats %+v, want 1 skipped, 1 filtered, none removed", stats)
+	}
+	if index, _ := ReadBlobIndex(layout.Path(acct.DID, BlobIndexFile)); len(index) != 3 {
+		t.Errorf("got %d blobs in the index, want 3", len(index))
+	}
+	for _, c := range cids {
+		if ok, _ := storage.Exists(ctx, store, layout.BlobKey(acct.DID, c.String())); !ok {
+			t.Errorf("blob %s removed", c)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/blebbit/atmunge/pkg/storage"
+)
+
+// blob stores, where SyncBlobs keeps the blob bytes
+const (
+	// BlobStoreAccount keeps the blobs of each account under it, in <did>/blobs/<cid>.blob
+	BlobStoreAccount = "account"
+	// BlobStoreShared keeps each blob once in blobs/<xy>/<cid>.blob at the store root,
+	// where xy are the last characters of the CID, with a ref per account in blobs/<xy>/<cid>.refs/<did>
+	BlobStoreShared = "shared"
+)
+
+// CheckBlobStore checks the blob store kind, empty is the account store.
+func CheckBlobStore(kind string) error {
+	switch kind {
+	case "", BlobStoreAccount, BlobStoreShared:
+		return nil
+	default:
+		return fmt.Errorf("unknown blob store %q, use %s or %s", kind, BlobStoreAccount, BlobStoreShared)
+	}
+}
+
+// BlobKey is the key of an account's blob in the account blob store.
+func (l Layout) BlobKey(did, c string) string {
+	return l.Key(did, "blobs/"+c+".blob")
+}
+
+// SharedBlobKey is the key of a blob in the shared blob store.
+func SharedBlobKey(c string) string {
+	return sharedBlobPrefix(c) + ".blob"
+}
+
+// BlobRefKey is the key of an account's ref to a shared blob.
+func BlobRefKey(c, did string) string {
+	return sharedBlobPrefix(c) + ".refs/" + did
+}
+
+// the first characters of a CID are its multibase and codec, the last ones vary
+func sharedBlobPrefix(c string) string {
+	shard := c
+	if len(c) > 2 {
+		shard = c[len(c)-2:]
+	}
+	return "blobs/" + shard + "/" + c
+}
+
+// parseSharedKey splits a key of the shared blob store into the CID and,
+// for refs, the DID. ok is false for other keys.
+func parseSharedKey(key string) (c, did string, ok bool) {
+	parts := strings.Split(key, "/")
+	if parts[0] != "blobs" || len(parts) < 3 {
+		return "", "", false
+	}
+	switch {
+	case len(parts) == 3 && strings.HasSuffix(parts[2], ".blob"):
+		c = strings.TrimSuffix(parts[2], ".blob")
+	case len(parts) == 4 && strings.HasSuffix(parts[2], ".refs") && strings.HasPrefix(parts[3], "did:"):
+		c, did = strings.TrimSuffix(parts[2], ".refs"), parts[3]
+	default:
+		return "", "", false
+	}
+	return c, did, sharedBlobPrefix(c) == "blobs/"+parts[1]+"/"+c
+}
+
+// AddBlobRef records that an account references a shared blob.
+func AddBlobRef(ctx context.Context, store storage.Storage, c, did string) error {
+	if err := store.Put(ctx, BlobRefKey(c, did), bytes.NewReader(nil), 0); err != nil {
+		return fmt.Errorf("failed to add blob ref: %w", err)
+	}
+	return nil
+}
+
+// BlobRefs lists the accounts referencing a shared blob.
+func BlobRefs(ctx context.Context, store storage.Storage, c string) ([]string, error) {
+	var dids []string
+	err := store.List(ctx, BlobRefKey(c, ""), func(oi storage.ObjectInfo) error {
+		if _, did, ok := parseSharedKey(oi.Key); ok && did != "" {
+			dids = append(dids, did)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blob refs: %w", err)
+	}
+	return dids, nil
+}
+
+// BlobGCStats counts what a shared blob GC found and removed.
+type BlobGCStats struct {
+	Blobs      int
+	Referenced int
+	Removed    int
+	Bytes      int64 // of the removed blobs
+}
+
+// GCBlobs deletes the shared blobs no account references, dryRun only counts them.
+// Syncs add their ref before looking for the blob, and the refs of each unreferenced blob
+// are listed again right before deleting it, so a blob a sync just deduped against is kept.
+func GCBlobs(ctx context.Context, store storage.Storage, dryRun bool) (*BlobGCStats, error) {
+	stats := &BlobGCStats{}
+	sizes := make(map[string]int64)
+	refs := make(map[string]int)
+	err := store.List(ctx, "blobs/", func(oi storage.ObjectInfo) error {
+		c, did, ok := parseSharedKey(oi.Key)
+		switch {
+		case !ok:
+		case did == "":
+			sizes[c] = oi.Size
+		default:
+			refs[c]++
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to list shared blobs: %w", err)
+	}
+
+	for c, size := range sizes {
+		stats.Blobs++
+		if refs[c] > 0 {
+			stats.Referenced++
+			continue
+		}
+		if !dryRun {
+			if dids, err := BlobRefs(ctx, store, c); err != nil {
+				return stats, err
+			} else if len(dids) > 0 {
+				stats.Referenced++
+				continue
+			}
+			if err := store.Delete(ctx, SharedBlobKey(c)); err != nil {
+				return stats, fmt.Errorf("failed to remove blob %s: %w", c, err)
+			}
+		}
+		stats.Removed++
+		stats.Bytes += size
+	}
+	return stats, nil
+}
+
+// BlobShareStats counts the account blobs ShareBlobs moved to the shared store.
+type BlobShareStats struct {
+	Moved   int
+	Deduped int   // already in the shared store
+	Bytes   int64 // no longer stored twice
+}
+
+// ShareBlobs moves the blobs of every account in the store from the account blob store to the shared one,
+// adding a ref for each account. The account's copy is deleted once the shared one exists,
+// so an interrupted run can be repeated. Blob indexes are unchanged, they are keyed by CID.
+func ShareBlobs(ctx context.Context, store storage.Storage, layout Layout) (*BlobShareStats, error) {
+	var objects []storage.ObjectInfo
+	err := store.List(ctx, "", func(oi storage.ObjectInfo) error {
+		_, name, ok := layout.ParseKey(oi.Key)
+		if ok && strings.HasPrefix(name, "blobs/") && strings.HasSuffix(name, ".blob") {
+			objects = append(objects, oi)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list account blobs: %w", err)
+	}
+
+	stats := &BlobShareStats{}
+	for _, oi := range objects {
+		did, name, _ := layout.ParseKey(oi.Key)
+		c := strings.TrimSuffix(strings.TrimPrefix(name, "blobs/"), ".blob")
+		if err := AddBlobRef(ctx, store, c, did); err != nil {
+			return stats, err
+		}
+
+		key := SharedBlobKey(c)
+		info, err := store.Stat(ctx, key)
+		switch {
+		case err == nil && info.Size == oi.Size:
+			stats.Deduped++
+			stats.Bytes += oi.Size
+		case err == nil, errors.Is(err, storage.ErrNotFound):
+			if err := copyObject(ctx, store, oi, key); err != nil {
+				return stats, fmt.Errorf("failed to share blob %s: %w", c, err)
+			}
+			stats.Moved++
+		default:
+			return stats, fmt.Errorf("failed to stat shared blob: %w", err)
+		}
+		if err := store.Delete(ctx, oi.Key); err != nil {
+			return stats, fmt.Errorf("failed to remove account blob %s: %w", oi.Key, err)
+		}
+	}
+	return stats, nil
+}
+
+func copyObject(ctx context.Context, store storage.Storage, src storage.ObjectInfo, dst string) error {
+	rc, err := store.Get(ctx, src.Key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return store.Put(ctx, dst, rc, src.Size)
+}
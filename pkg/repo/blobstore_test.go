@@ -0,0 +1,186 @@
+package repo
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/blebbit/atmunge/pkg/rlproxy"
+	"github.com/blebbit/atmunge/pkg/storage"
+	"github.com/blebbit/atmunge/pkg/util/fakepds"
+)
+
+func TestSharedBlobs(t *testing.T) {
+	ctx := context.Background()
+	pds := fakepds.New()
+	defer pds.Close()
+
+	alice, err := pds.CreateRepo("alice.test", fakepds.SampleRecords("alice.test", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := pds.CreateRepo("bob.test", fakepds.SampleRecords("bob.test", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same image uploaded by both, and one of alice's own
+	shared := []byte("\x89PNG\r\n\x1a\n reposted")
+	c, err := pds.AddBlob(alice.DID, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pds.AddBlob(bob.DID, shared); err != nil {
+		t.Fatal(err)
+	}
+	own, err := pds.AddBlob(alice.DID, []byte("alice only"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := func(cids ...string) []BlobRef {
+		// empty, not nil, so no refs are not every listed blob
+		refs := []BlobRef{}
+		for _, s := range cids {
+			refs = append(refs, BlobRef{CID: s, MimeType: "image/png"})
+		}
+		return refs
+	}
+
+	proxy := rlproxy.New(&http.Client{})
+	store := storage.NewLocal(t.TempDir())
+	layout, _ := NewLayout(LayoutSharded, t.TempDir())
+	sync := func(did string, opts BlobSyncOptions) *BlobSyncStats {
+		t.Helper()
+		opts.Shared = true
+		stats, err := SyncBlobs(ctx, proxy, pds.URL, did, store, layout, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	if stats := sync(alice.DID, BlobSyncOptions{}); stats.Fetched != 2 {
+		t.Errorf("got stats %+v, want 2 fetched", stats)
+	}
+	// bob's copy is already stored
+	before := pds.Requests("com.atproto.sync.getBlob")
+	stats := sync(bob.DID, BlobSyncOptions{Refs: refs(c.String())})
+	if stats.Fetched != 0 || stats.Deduped != 1 {
+		t.Errorf("got stats %+v, want 1 deduped", stats)
+	}
+	if n := pds.Requests("com.atproto.sync.getBlob") - before; n != 0 {
+		t.Errorf("got %d getBlob requests for a deduped blob, want 0", n)
+	}
+	index, err := ReadBlobIndex(layout.Path(bob.DID, BlobIndexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := index[c.String()]; e.Size != int64(len(shared)) || e.MimeType != "image/png" {
+		t.Errorf("got index entry %+v for the deduped blob", e)
+	}
+	if ok, _ := storage.Exists(ctx, store, layout.BlobKey(alice.DID, c.String())); ok {
+		t.Error("shared blob stored under the account")
+	}
+	dids, err := BlobRefs(ctx, store, c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(dids)
+	if want := []string{alice.DID, bob.DID}; !slices.Equal(dids, want) {
+		t.Errorf("got refs %v, want %v", dids, want)
+	}
+
+	// alice deleted her own blob
+	if err := pds.RemoveBlob(alice.DID, own); err != nil {
+		t.Fatal(err)
+	}
+	if stats := sync(alice.DID, BlobSyncOptions{}); stats.Removed != 1 || stats.Skipped != 1 {
+		t.Errorf("got stats %+v, want 1 skipped, 1 removed", stats)
+	}
+	if index, _ := ReadBlobIndex(layout.Path(alice.DID, BlobIndexFile)); len(index) != 1 {
+		t.Errorf("got %d blobs in alice's index, want 1", len(index))
+	}
+	gc, err := GCBlobs(ctx, store, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.Blobs != 2 || gc.Removed != 1 {
+		t.Errorf("got gc %+v, want 1 of 2 removed", gc)
+	}
+	if ok, _ := storage.Exists(ctx, store, SharedBlobKey(own.String())); !ok {
+		t.Error("dry run removed a blob")
+	}
+	if _, err := GCBlobs(ctx, store, false); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := storage.Exists(ctx, store, SharedBlobKey(own.String())); ok {
+		t.Error("unreferenced blob not collected")
+	}
+
+	// the shared blob stays until neither account has it
+	for _, did := range []string{alice.DID, bob.DID} {
+		if err := pds.RemoveBlob(did, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync(alice.DID, BlobSyncOptions{})
+	if gc, _ := GCBlobs(ctx, store, false); gc.Removed != 0 {
+		t.Errorf("got gc %+v, want bob's blob kept", gc)
+	}
+	sync(bob.DID, BlobSyncOptions{})
+	if gc, _ := GCBlobs(ctx, store, false); gc.Removed != 1 {
+		t.Errorf("got gc %+v, want the blob collected", gc)
+	}
+}
+
+func TestShareBlobs(t *testing.T) {
+	ctx := context.Background()
+	pds := fakepds.New()
+	defer pds.Close()
+
+	var dids []string
+	for _, handle := range []string{"alice.test", "bob.test"} {
+		acct, err := pds.CreateRepo(handle, fakepds.SampleRecords(handle, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dids = append(dids, acct.DID)
+	}
+	shared := []byte("reposted")
+	c, err := pds.AddBlob(dids[0], shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pds.AddBlob(dids[1], shared); err != nil {
+		t.Fatal(err)
+	}
+
+	store := storage.NewLocal(t.TempDir())
+	layout, _ := NewLayout(LayoutFlat, t.TempDir())
+	for _, did := range dids {
+		if _, err := SyncBlobs(ctx, rlproxy.New(&http.Client{}), pds.URL, did, store, layout, BlobSyncOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := ShareBlobs(ctx, store, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Moved != 1 || stats.Deduped != 1 || stats.Bytes != int64(len(shared)) {
+		t.Errorf("got stats %+v, want 1 moved, 1 deduped", stats)
+	}
+	for _, did := range dids {
+		if ok, _ := storage.Exists(ctx, store, layout.BlobKey(did, c.String())); ok {
+			t.Errorf("account blob left behind for %s", did)
+		}
+	}
+	if refs, _ := BlobRefs(ctx, store, c.String()); len(refs) != 2 {
+		t.Errorf("got refs %v, want both accounts", refs)
+	}
+
+	// rerunning finds nothing left to move
+	if stats, err := ShareBlobs(ctx, store, layout); err != nil || stats.Moved+stats.Deduped != 0 {
+		t.Errorf("got stats %+v rerunning: %v", stats, err)
+	}
+}
@@ -0,0 +1,645 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/ipld/go-car/v2/storage"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+// ErrBlockNotFound is returned by Blockstore.Get for missing blocks.
+var ErrBlockNotFound = errors.New("block not found")
+
+// Blockstore holds the blocks of a local repo copy.
+// Puts are only durable after a Commit, which also sets the root.
+type Blockstore interface {
+	Get(c cid.Cid) ([]byte, error)
+	Has(c cid.Cid) (bool, error)
+	Put(c cid.Cid, data []byte) error
+	// ForEach calls fn for every committed block, stopping at the first error
+	ForEach(fn func(c cid.Cid, data []byte) error) error
+	// Root is the commit CID, cid.Undef for a new store
+	Root() cid.Cid
+	// Rev is the rev of the root commit, empty for a new store
+	Rev() string
+	Commit(root cid.Cid) error
+	Close() error
+}
+
+const (
+	// BlockstoreCar appends to an indexed CARv2 on disk
+	BlockstoreCar = "car"
+	// BlockstoreMemory loads the whole CAR into a map and rewrites it on commit
+	BlockstoreMemory = "memory"
+)
+
+// OpenBlockstore opens the repo CAR at path with the given kind of blockstore.
+// A missing file is an empty store, the file is created on the first Commit.
+func OpenBlockstore(kind, path string) (Blockstore, error) {
+	switch kind {
+	case BlockstoreCar, "":
+		return OpenCarStore(path)
+	case BlockstoreMemory:
+		return OpenMemBlockstore(path)
+	default:
+		return nil, fmt.Errorf("unknown blockstore: %q", kind)
+	}
+}
+
+// rootRev reads the rev from a root commit block
+func rootRev(bs Blockstore, root cid.Cid) (string, error) {
+	if !root.Defined() {
+		return "", nil
+	}
+	raw, err := bs.Get(root)
+	if err != nil {
+		return "", fmt.Errorf("failed to read root commit: %w", err)
+	}
+	rev, _ := tryExtractRev(raw)
+	return rev, nil
+}
+
+//
+// in-memory
+//
+
+// MemBlockstore keeps every block in a map, fine for small repos.
+type MemBlockstore struct {
+	Blocks map[cid.Cid][]byte
+
+	path string
+	root cid.Cid
+	rev  string
+}
+
+// OpenMemBlockstore loads the CAR at path into memory.
+func OpenMemBlockstore(path string) (*MemBlockstore, error) {
+	bs := &MemBlockstore{
+		Blocks: make(map[cid.Cid][]byte),
+		path:   path,
+	}
+
+	br, f, err := OpenCarBlockReader(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return bs, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	if len(br.Roots) > 0 {
+		bs.root = br.Roots[0]
+	}
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed reading block from existing CAR: %w", err)
+		}
+		bs.Blocks[blk.Cid()] = blk.RawData()
+	}
+
+	if bs.rev, err = rootRev(bs, bs.root); err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
+func (bs *MemBlockstore) Get(c cid.Cid) ([]byte, error) {
+	data, ok := bs.Blocks[c]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, c)
+	}
+	return data, nil
+}
+
+func (bs *MemBlockstore) Has(c cid.Cid) (bool, error) {
+	_, ok := bs.Blocks[c]
+	return ok, nil
+}
+
+func (bs *MemBlockstore) Put(c cid.Cid, data []byte) error {
+	bs.Blocks[c] = data
+	return nil
+}
+
+func (bs *MemBlockstore) ForEach(fn func(c cid.Cid, data []byte) error) error {
+	for c, data := range bs.Blocks {
+		if err := fn(c, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bs *MemBlockstore) Root() cid.Cid { return bs.root }
+
+func (bs *MemBlockstore) Rev() string { return bs.rev }
+
+// Commit rewrites the whole CAR file with the new root.
+func (bs *MemBlockstore) Commit(root cid.Cid) error {
+	rev, err := rootRev(bs, root)
+	if err != nil {
+		return err
+	}
+	if err := WriteCar(bs.path, root, bs.Blocks); err != nil {
+		return err
+	}
+	// the raw CAR supersedes a compressed one it was loaded from
+	os.Remove(bs.path + CompressedSuffix)
+	bs.root, bs.rev = root, rev
+	return nil
+}
+
+func (bs *MemBlockstore) Close() error { return nil }
+
+//
+// on-disk CARv2
+//
+
+// CarStore is an append-only CARv2 file with a multihash index.
+// Opening only reads the headers and index, Put appends sections to the data payload,
+// and Commit writes a fresh index and points the CARv1 header at the new root.
+// Blocks are never removed here, see compaction for that.
+//
+// Crash safety comes from the CARv2 header: until a Commit updates it,
+// readers only see the previously committed data size and index.
+type CarStore struct {
+	path string
+	f    *os.File
+	// tmp is set while a new file is written, it is renamed over path on the first Commit
+	tmp string
+
+	header  car.Header
+	v1Size  int64 // size of the CARv1 header at the start of the data payload
+	dataEnd int64 // absolute offset where the next section is appended
+	idx     *index.InsertionIndex
+	dirty   bool
+
+	root cid.Cid
+	rev  string
+}
+
+// placeholderRoot has the length of an atproto commit CID,
+// so the header of a new file can be rewritten in place on Commit
+var placeholderRoot, _ = cid.V1Builder{Codec: cid.DagCBOR, MhType: multihash.SHA2_256}.Sum(nil)
+
+// OpenCarStore opens the CAR at path for appending, converting a CARv1
+// or inflating a compressed CAR (path.zst) if needed.
+func OpenCarStore(path string) (*CarStore, error) {
+	if err := InflateCar(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return newCarStore(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open car file: %w", err)
+	}
+
+	version, err := car.ReadVersion(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read car version: %w", err)
+	}
+	if version == 1 {
+		f.Close()
+		if err := convertCarV1(path); err != nil {
+			return nil, err
+		}
+		return OpenCarStore(path)
+	}
+
+	cs := &CarStore{path: path, f: f}
+	if err := cs.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return cs, nil
+}
+
+// newCarStore starts a CARv2 in a temp file next to path
+func newCarStore(path string) (*CarStore, error) {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create car file: %w", err)
+	}
+	cs := &CarStore{
+		path: path,
+		f:    f,
+		tmp:  f.Name(),
+		idx:  index.NewInsertionIndex(),
+	}
+
+	v1h, err := encodeCarV1Header(placeholderRoot)
+	if err != nil {
+		cs.abort()
+		return nil, err
+	}
+	cs.header = car.NewHeader(uint64(len(v1h)))
+	cs.header.IndexOffset = 0
+	cs.v1Size = int64(len(v1h))
+	cs.dataEnd = int64(cs.header.DataOffset) + cs.v1Size
+
+	if _, err := f.Write(car.Pragma); err != nil {
+		cs.abort()
+		return nil, err
+	}
+	if _, err := cs.header.WriteTo(f); err != nil {
+		cs.abort()
+		return nil, err
+	}
+	if _, err := f.Write(v1h); err != nil {
+		cs.abort()
+		return nil, err
+	}
+	return cs, nil
+}
+
+// load reads the CARv2 header, CARv1 header and index
+func (cs *CarStore) load() error {
+	if _, err := cs.header.ReadFrom(io.NewSectionReader(cs.f, car.PragmaSize, car.HeaderSize)); err != nil {
+		return fmt.Errorf("failed to read CARv2 header: %w", err)
+	}
+	cs.dataEnd = int64(cs.header.DataOffset + cs.header.DataSize)
+
+	data := io.NewSectionReader(cs.f, int64(cs.header.DataOffset), int64(cs.header.DataSize))
+	br, err := car.NewBlockReader(data)
+	if err != nil {
+		return fmt.Errorf("failed to read CARv1 header: %w", err)
+	}
+	if len(br.Roots) > 0 {
+		cs.root = br.Roots[0]
+	}
+	// the CARv1 header is a varint length followed by that many bytes
+	hlen, err := binary.ReadUvarint(bufio.NewReader(io.NewSectionReader(cs.f, int64(cs.header.DataOffset), binary.MaxVarintLen64)))
+	if err != nil {
+		return fmt.Errorf("failed to read CARv1 header length: %w", err)
+	}
+	cs.v1Size = int64(hlen) + int64(uvarintSize(hlen))
+
+	cs.idx = index.NewInsertionIndex()
+	if cs.header.HasIndex() {
+		idx, err := index.ReadFrom(io.NewSectionReader(cs.f, int64(cs.header.IndexOffset), 1<<62))
+		if err != nil {
+			return fmt.Errorf("failed to read car index: %w", err)
+		}
+		iter, ok := idx.(index.IterableIndex)
+		if !ok {
+			return fmt.Errorf("car index %s is not iterable", idx.Codec())
+		}
+		// the index is keyed by multihash, so the codec we give it does not matter
+		err = iter.ForEach(func(mh multihash.Multihash, offset uint64) error {
+			cs.idx.InsertNoReplace(cid.NewCidV1(cid.Raw, mh), offset)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to load car index: %w", err)
+		}
+	} else {
+		// a previous session did not finish, rebuild from the committed data
+		if err := car.LoadIndex(cs.idx, io.NewSectionReader(cs.f, 0, cs.dataEnd)); err != nil {
+			return fmt.Errorf("failed to rebuild car index: %w", err)
+		}
+	}
+
+	rev, err := rootRev(cs, cs.root)
+	if err != nil {
+		return err
+	}
+	cs.rev = rev
+	return nil
+}
+
+func (cs *CarStore) Root() cid.Cid { return cs.root }
+
+func (cs *CarStore) Rev() string { return cs.rev }
+
+// Len is the number of indexed blocks.
+func (cs *CarStore) Len() int {
+	n := 0
+	cs.idx.ForEach(func(multihash.Multihash, uint64) error {
+		n++
+		return nil
+	})
+	return n
+}
+
+func (cs *CarStore) Has(c cid.Cid) (bool, error) {
+	_, err := cs.idx.Get(c)
+	if errors.Is(err, index.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (cs *CarStore) Get(c cid.Cid) ([]byte, error) {
+	offset, err := cs.idx.Get(c)
+	if errors.Is(err, index.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, c)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(cs.f, int64(cs.header.DataOffset+offset), 1<<62))
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read section length for %s: %w", c, err)
+	}
+	section := make([]byte, l)
+	if _, err := io.ReadFull(r, section); err != nil {
+		return nil, fmt.Errorf("failed to read section for %s: %w", c, err)
+	}
+	n, sc, err := cid.CidFromBytes(section)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read section cid for %s: %w", c, err)
+	}
+	if !bytes.Equal(sc.Hash(), c.Hash()) {
+		return nil, fmt.Errorf("car index points %s at %s", c, sc)
+	}
+	return section[n:], nil
+}
+
+// ForEach reads the committed data payload in file order.
+func (cs *CarStore) ForEach(fn func(c cid.Cid, data []byte) error) error {
+	data := io.NewSectionReader(cs.f, int64(cs.header.DataOffset), int64(cs.header.DataSize))
+	br, err := car.NewBlockReader(data)
+	if err != nil {
+		return fmt.Errorf("failed to read car data: %w", err)
+	}
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed reading block: %w", err)
+		}
+		if err := fn(blk.Cid(), blk.RawData()); err != nil {
+			return err
+		}
+	}
+}
+
+// Put appends a block, blocks already in the store are skipped.
+func (cs *CarStore) Put(c cid.Cid, data []byte) error {
+	if ok, err := cs.Has(c); err != nil || ok {
+		return err
+	}
+	if err := cs.begin(); err != nil {
+		return err
+	}
+
+	cb := c.Bytes()
+	buf := binary.AppendUvarint(nil, uint64(len(cb)+len(data)))
+	buf = append(buf, cb...)
+	buf = append(buf, data...)
+	if _, err := cs.f.WriteAt(buf, cs.dataEnd); err != nil {
+		return fmt.Errorf("failed to append block %s: %w", c, err)
+	}
+	cs.idx.InsertNoReplace(c, uint64(cs.dataEnd)-cs.header.DataOffset)
+	cs.dataEnd += int64(len(buf))
+	return nil
+}
+
+// begin drops the index before the first append, so a crash leaves
+// a file without an index rather than one with a stale index
+func (cs *CarStore) begin() error {
+	if cs.dirty {
+		return nil
+	}
+	if cs.tmp == "" && cs.header.HasIndex() {
+		h := cs.header
+		h.IndexOffset = 0
+		if err := cs.writeHeader(h); err != nil {
+			return err
+		}
+		if err := cs.f.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := cs.f.Truncate(cs.dataEnd); err != nil {
+		return fmt.Errorf("failed to truncate car file: %w", err)
+	}
+	cs.dirty = true
+	return nil
+}
+
+// Commit writes the index and points the CAR at root, which must be in the store.
+func (cs *CarStore) Commit(root cid.Cid) error {
+	rev, err := rootRev(cs, root)
+	if err != nil {
+		return err
+	}
+	if err := cs.begin(); err != nil {
+		return err
+	}
+
+	// the index goes right after the appended data
+	flat, err := cs.idx.Flatten(multicodec.CarMultihashIndexSorted)
+	if err != nil {
+		return fmt.Errorf("failed to flatten car index: %w", err)
+	}
+	if _, err := index.WriteTo(flat, io.NewOffsetWriter(cs.f, cs.dataEnd)); err != nil {
+		return fmt.Errorf("failed to write car index: %w", err)
+	}
+	if err := cs.f.Sync(); err != nil {
+		return err
+	}
+
+	// then the new blocks and index become visible, still under the old root
+	h := cs.header
+	h.DataSize = uint64(cs.dataEnd) - h.DataOffset
+	h.IndexOffset = uint64(cs.dataEnd)
+	if err := cs.writeHeader(h); err != nil {
+		return err
+	}
+	cs.header = h
+	cs.dirty = false
+
+	// and finally the root moves
+	if !root.Equals(cs.root) {
+		if err := cs.setRoot(root); err != nil {
+			return err
+		}
+	}
+	if err := cs.f.Sync(); err != nil {
+		return err
+	}
+
+	if cs.tmp != "" {
+		if err := os.Rename(cs.tmp, cs.path); err != nil {
+			return fmt.Errorf("failed to move new car file into place: %w", err)
+		}
+		cs.tmp = ""
+	}
+
+	cs.root, cs.rev = root, rev
+	return nil
+}
+
+// setRoot rewrites the CARv1 header in place when the size is unchanged,
+// which is always the case for atproto commit CIDs, otherwise it rewrites the file
+func (cs *CarStore) setRoot(root cid.Cid) error {
+	v1h, err := encodeCarV1Header(root)
+	if err != nil {
+		return err
+	}
+	if int64(len(v1h)) == cs.v1Size {
+		if _, err := cs.f.WriteAt(v1h, int64(cs.header.DataOffset)); err != nil {
+			return fmt.Errorf("failed to write CARv1 header: %w", err)
+		}
+		return nil
+	}
+
+	// blocks shift by the header size difference, reindex them as we copy
+	if err := cs.f.Sync(); err != nil {
+		return err
+	}
+	blocks := io.NewSectionReader(cs.f, int64(cs.header.DataOffset)+cs.v1Size, cs.dataEnd-int64(cs.header.DataOffset)-cs.v1Size)
+	tmp := cs.path + ".rewrite"
+	if err := writeCarV2(tmp, v1h, blocks); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, cs.path); err != nil {
+		return fmt.Errorf("failed to replace car file: %w", err)
+	}
+	cs.f.Close()
+	if cs.tmp != "" {
+		os.Remove(cs.tmp)
+	}
+
+	f, err := os.OpenFile(cs.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	cs.f, cs.tmp = f, ""
+	if err := cs.load(); err != nil {
+		return err
+	}
+	// the rewritten file has no index yet
+	return cs.Commit(root)
+}
+
+// Close commits blocks put since the last Commit under the current root,
+// a new store that was never committed is removed.
+func (cs *CarStore) Close() error {
+	if cs.f == nil {
+		return nil
+	}
+	if cs.tmp != "" {
+		cs.abort()
+		return nil
+	}
+	var err error
+	if cs.dirty {
+		err = cs.Commit(cs.root)
+	}
+	if cerr := cs.f.Close(); err == nil {
+		err = cerr
+	}
+	cs.f = nil
+	return err
+}
+
+func (cs *CarStore) abort() {
+	cs.f.Close()
+	os.Remove(cs.tmp)
+	cs.f = nil
+}
+
+func (cs *CarStore) writeHeader(h car.Header) error {
+	if _, err := h.WriteTo(io.NewOffsetWriter(cs.f, car.PragmaSize)); err != nil {
+		return fmt.Errorf("failed to write CARv2 header: %w", err)
+	}
+	return nil
+}
+
+// encodeCarV1Header encodes the CARv1 header for a single root
+func encodeCarV1Header(root cid.Cid) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := storage.NewWritable(buf, []cid.Cid{root}, car.WriteAsCarV1(true)); err != nil {
+		return nil, fmt.Errorf("failed to encode CARv1 header: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeCarV2 writes a CARv2 without an index from a CARv1 header and sections,
+// the index is rebuilt when it is next opened as a CarStore
+func writeCarV2(path string, v1h []byte, sections io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create car file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(car.PragmaSize+car.HeaderSize, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := f.Write(v1h); err != nil {
+		return err
+	}
+	n, err := io.Copy(f, sections)
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to copy car data: %w", err)
+	}
+
+	h := car.NewHeader(uint64(len(v1h)) + uint64(n))
+	h.IndexOffset = 0
+	if _, err := f.WriteAt(car.Pragma, 0); err != nil {
+		return err
+	}
+	if _, err := h.WriteTo(io.NewOffsetWriter(f, car.PragmaSize)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// convertCarV1 wraps a CARv1 file in a CARv2
+func convertCarV1(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hlen, err := binary.ReadUvarint(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("failed to read CARv1 header length: %w", err)
+	}
+	size := int64(hlen) + int64(uvarintSize(hlen))
+	v1h := make([]byte, size)
+	if _, err := f.ReadAt(v1h, 0); err != nil {
+		return fmt.Errorf("failed to read CARv1 header: %w", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".convert"
+	if err := writeCarV2(tmp, v1h, io.NewSectionReader(f, size, st.Size()-size)); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func uvarintSize(v uint64) int {
+	return len(binary.AppendUvarint(nil, v))
+}
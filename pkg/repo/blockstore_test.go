@@ -0,0 +1,141 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	"github.com/blebbit/atmunge/pkg/util/fakepds"
+)
+
+func TestBlockstores(t *testing.T) {
+	for _, kind := range []string{BlockstoreCar, BlockstoreMemory} {
+		t.Run(kind, func(t *testing.T) {
+			testBlockstore(t, kind)
+		})
+	}
+}
+
+func testBlockstore(t *testing.T, kind string) {
+	ctx := context.Background()
+	pds := fakepds.New()
+	defer pds.Close()
+
+	acct, err := pds.CreateRepo("alice.test", fakepds.SampleRecords("alice.test", 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "repo.car")
+
+	// sync merges the update since the stored rev and commits, as repo-sync does
+	sync := func() {
+		t.Helper()
+		bs, err := OpenBlockstore(kind, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+
+		update, err := acct.CAR(bs.Rev())
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, rev, _, err := MergeUpdate(bs, bytes.NewReader(update))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev != acct.Rev() || !root.Equals(acct.Head()) {
+			t.Fatalf("got root %s rev %s, want %s %s", root, rev, acct.Head(), acct.Rev())
+		}
+		if err := bs.Commit(root); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sync()
+
+	rkey := syntax.NewTIDNow(0).String()
+	if _, err := pds.Commit(acct.DID, fakepds.Records{
+		"app.bsky.feed.post/" + rkey: {
+			"$type":     "app.bsky.feed.post",
+			"text":      "new post",
+			"createdAt": syntax.DatetimeNow().String(),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sync()
+
+	// reopened, the store is at the latest commit
+	bs, err := OpenBlockstore(kind, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs.Rev() != acct.Rev() || !bs.Root().Equals(acct.Head()) {
+		t.Errorf("reopened at %s %s, want %s %s", bs.Root(), bs.Rev(), acct.Head(), acct.Rev())
+	}
+	if err := bs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// and the file is a CAR other tools can read
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := ReadRepoFromCar(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.GetRecordBytes(ctx, "app.bsky.feed.post", syntax.RecordKey(rkey)); err != nil {
+		t.Errorf("new post missing: %v", err)
+	}
+
+	// including the car store, whichever store wrote it
+	cs, err := OpenCarStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	if cs.Rev() != acct.Rev() {
+		t.Errorf("car store opened at %s, want %s", cs.Rev(), acct.Rev())
+	}
+}
+
+func TestCarStoreConvertsCarV1(t *testing.T) {
+	pds := fakepds.New()
+	defer pds.Close()
+
+	acct, err := pds.CreateRepo("bob.test", fakepds.SampleRecords("bob.test", 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, err := acct.CAR("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "repo.car")
+	if err := os.WriteFile(path, v1, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := OpenCarStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	if cs.Rev() != acct.Rev() {
+		t.Errorf("got rev %q, want %q", cs.Rev(), acct.Rev())
+	}
+	if cs.Len() == 0 {
+		t.Error("converted store has no blocks")
+	}
+	if _, err := cs.Get(acct.Head()); err != nil {
+		t.Error(err)
+	}
+}
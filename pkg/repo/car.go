@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"time"
 
 	"github.com/blebbit/atmunge/pkg/rlproxy"
 	cbor "github.com/fxamacker/cbor/v2"
@@ -67,10 +69,27 @@ func GetPlcInfo(account string) (*PlcInfo, error) {
 	return &plcInfo, nil
 }
 
-// GetRepo fetches a repo's CAR file from a PDS.
+// ErrRepoTooLarge is returned when a repo download exceeds GetRepoOptions.MaxBytes.
+var ErrRepoTooLarge = errors.New("repo exceeds the download size limit")
+
+// GetRepoOptions bounds a repo download.
+type GetRepoOptions struct {
+	// Dir is where the temp file is created, the system temp dir when empty
+	Dir string
+	// MaxBytes fails the download once it is larger, 0 is unlimited
+	MaxBytes int64
+	// Timeout bounds the whole download, including retries, 0 is none
+	Timeout time.Duration
+	// Progress is called about once a second with the bytes read so far,
+	// and the total when the PDS sent a Content-Length (otherwise -1)
+	Progress func(read, total int64)
+}
+
+// GetRepo streams a repo's CAR file from a PDS into a temp file, returning its path and size.
+// The caller is responsible for removing the file, which is empty when there are no updates.
 // NOTE: We now pass the most recent commit TID (rev) as the `since` parameter
 // instead of the root CID.
-func GetRepo(ctx context.Context, proxy *rlproxy.Proxy, pdsHost, did, since string) ([]byte, error) {
+func GetRepo(ctx context.Context, proxy *rlproxy.Proxy, pdsHost, did, since string, opts GetRepoOptions) (string, int64, error) {
 	endpoint, _ := url.Parse(pdsHost)
 	endpoint.Path = "/xrpc/com.atproto.sync.getRepo"
 	queryParams := url.Values{}
@@ -80,25 +99,86 @@ func GetRepo(ctx context.Context, proxy *rlproxy.Proxy, pdsHost, did, since stri
 	}
 	endpoint.RawQuery = queryParams.Encode()
 
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
 	req, err := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
 	if err != nil {
-		return nil, err
+		return "", 0, err
 	}
 
 	resp, err := proxy.Do(req)
 	if err != nil {
-		return nil, err
+		return "", 0, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("bad response status: %s, body: %s", resp.Status, string(body))
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", 0, fmt.Errorf("bad response status: %s, body: %s", resp.Status, string(body))
+	}
+	if opts.MaxBytes > 0 && resp.ContentLength > opts.MaxBytes {
+		return "", 0, fmt.Errorf("%w: %d > %d bytes", ErrRepoTooLarge, resp.ContentLength, opts.MaxBytes)
+	}
+
+	f, err := os.CreateTemp(opts.Dir, "getrepo-*.car")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create temp file: %w", err)
+	}
+
+	var body io.Reader = resp.Body
+	if opts.MaxBytes > 0 {
+		// one more byte than allowed, so we can tell when it is exceeded
+		body = io.LimitReader(body, opts.MaxBytes+1)
+	}
+	var w io.Writer = f
+	if opts.Progress != nil {
+		w = &progressWriter{w: f, total: resp.ContentLength, report: opts.Progress}
+	}
+
+	n, err := io.Copy(w, body)
+	if err == nil && opts.MaxBytes > 0 && n > opts.MaxBytes {
+		err = fmt.Errorf("%w: more than %d bytes", ErrRepoTooLarge, opts.MaxBytes)
+	}
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = cerr
 	}
-	return io.ReadAll(resp.Body)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, fmt.Errorf("failed to download repo: %w", err)
+	}
+
+	if opts.Progress != nil {
+		opts.Progress(n, resp.ContentLength)
+	}
+
+	return f.Name(), n, nil
+}
+
+// progressWriter reports the bytes written at most once a second
+type progressWriter struct {
+	w      io.Writer
+	n      int64
+	total  int64
+	last   time.Time
+	report func(read, total int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	if time.Since(p.last) >= time.Second {
+		p.last = time.Now()
+		p.report(p.n, p.total)
+	}
+	return n, err
 }
 
-func OpenCarBlockReader(filePath string) (*car.BlockReader, *os.File, error) {
-	f, err := os.Open(filePath)
+// OpenCarBlockReader streams the blocks of a CAR, raw or compressed.
+func OpenCarBlockReader(filePath string) (*car.BlockReader, io.Closer, error) {
+	f, err := OpenCar(filePath)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to open car file: %w", err)
 	}
@@ -179,42 +259,12 @@ func tryExtractRev(raw []byte) (string, bool) {
 	return "", false
 }
 
-// LoadLocalCar loads an existing CAR file, returning its blocks and the latest commit TID.
-func LoadLocalCar(filePath string) (map[cid.Cid][]byte, string, error) {
-	blockstoreMem := make(map[cid.Cid][]byte)
-
-	br, f, err := OpenCarBlockReader(filePath)
-	if err != nil {
-		// we do want to return an initialized blockstore, even when erroring
-		return blockstoreMem, "", fmt.Errorf("failed to open CAR as block reader: %w", err)
-	}
-	defer f.Close()
-
-	var latestRev string
-	for {
-		blk, err := br.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, "", fmt.Errorf("failed reading block from existing CAR: %w", err)
-		}
-		blockstoreMem[blk.Cid()] = blk.RawData()
-		if rev, ok := tryExtractRev(blk.RawData()); ok {
-			if latestRev == "" || rev > latestRev {
-				latestRev = rev
-			}
-		}
-	}
-
-	return blockstoreMem, latestRev, nil
-}
-
-// MergeUpdate reads blocks from an update CAR, adds them to the block map,
-// and returns the new root CID and the latest commit TID from the update.
-func MergeUpdate(blockstoreMem map[cid.Cid][]byte, updateCarData []byte) (cid.Cid, string, map[cid.Cid][]byte, error) {
-	newBlocks := make(map[cid.Cid][]byte)
-	updateBR, err := car.NewBlockReader(bytes.NewReader(updateCarData))
+// MergeUpdate puts the blocks from an update CAR into the blockstore,
+// returning the new root CID, the latest commit TID and the CIDs of blocks not already stored.
+// The caller commits the new root.
+func MergeUpdate(bs Blockstore, updateCar io.Reader) (cid.Cid, string, []cid.Cid, error) {
+	var newBlocks []cid.Cid
+	updateBR, err := car.NewBlockReader(updateCar)
 	if err != nil {
 		return cid.Undef, "", nil, fmt.Errorf("failed to parse fetched CAR: %w", err)
 	}
@@ -233,8 +283,16 @@ func MergeUpdate(blockstoreMem map[cid.Cid][]byte, updateCarData []byte) (cid.Ci
 		if err != nil {
 			return cid.Undef, "", nil, fmt.Errorf("failed reading block from fetched CAR: %w", err)
 		}
-		blockstoreMem[blk.Cid()] = blk.RawData()
-		newBlocks[blk.Cid()] = blk.RawData()
+		has, err := bs.Has(blk.Cid())
+		if err != nil {
+			return cid.Undef, "", nil, err
+		}
+		if !has {
+			if err := bs.Put(blk.Cid(), blk.RawData()); err != nil {
+				return cid.Undef, "", nil, fmt.Errorf("failed to store block: %w", err)
+			}
+			newBlocks = append(newBlocks, blk.Cid())
+		}
 		if rev, ok := tryExtractRev(blk.RawData()); ok {
 			newestRev = rev
 		}
@@ -274,9 +332,40 @@ func WriteCar(filePath string, rootCid cid.Cid, blockstoreMem map[cid.Cid][]byte
 	return nil
 }
 
+// CheckCommit does the structure checks of Commit.VerifyStructure, which requires a signature.
+// allowUnsigned skips that requirement, for the unsigned fixtures repo pack writes without a key.
+// Signatures are checked by VerifyRepo.
+func CheckCommit(c *indigoRepo.Commit, allowUnsigned bool) error {
+	if !allowUnsigned {
+		return c.VerifyStructure()
+	}
+	if c.Version != indigoRepo.ATPROTO_REPO_VERSION {
+		return fmt.Errorf("unsupported repo version: %d", c.Version)
+	}
+	if _, err := syntax.ParseDID(c.DID); err != nil {
+		return fmt.Errorf("invalid commit data: %w", err)
+	}
+	if _, err := syntax.ParseTID(c.Rev); err != nil {
+		return fmt.Errorf("invalid commit data: %w", err)
+	}
+	return nil
+}
+
+// ReadRepoFromCar loads a repo from a CAR stream, raw or compressed.
 func ReadRepoFromCar(r io.Reader) (*indigoRepo.Repo, error) {
+	return readRepoFromCar(r, false)
+}
+
+// readRepoFromCar is ReadRepoFromCar, optionally accepting an unsigned commit (see CheckCommit)
+func readRepoFromCar(r io.Reader, allowUnsigned bool) (*indigoRepo.Repo, error) {
 	ctx := context.Background()
 
+	r, done, err := decompressed(r)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	br, err := car.NewBlockReader(r)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create block reader: %w", err)
@@ -310,7 +399,7 @@ func ReadRepoFromCar(r io.Reader) (*indigoRepo.Repo, error) {
 	if err := commit.UnmarshalCBOR(bytes.NewReader(commitBlock.RawData())); err != nil {
 		return nil, fmt.Errorf("parsing commit block from CAR file: %v", err)
 	}
-	if err := commit.VerifyStructure(); err != nil {
+	if err := CheckCommit(&commit, allowUnsigned); err != nil {
 		return nil, fmt.Errorf("verifying commit block from CAR file: %v", err)
 	}
 
@@ -320,7 +409,7 @@ func ReadRepoFromCar(r io.Reader) (*indigoRepo.Repo, error) {
 	}
 	clk := syntax.ClockFromTID(syntax.TID(commit.Rev))
 	repo := &indigoRepo.Repo{
-		DID:         syntax.DID(commit.DID), // NOTE: VerifyStructure() already checked DID syntax
+		DID:         syntax.DID(commit.DID), // NOTE: CheckCommit() already checked DID syntax
 		Clock:       &clk,
 		MST:         *tree,
 		RecordStore: bs,
@@ -0,0 +1,87 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blebbit/atmunge/pkg/rlproxy"
+	"github.com/blebbit/atmunge/pkg/util/cassette"
+)
+
+func TestGetRepo(t *testing.T) {
+	ctx := context.Background()
+
+	tr, err := cassette.New(filepath.Join("testdata", "get-repo.json"), cassette.ModeReplay, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := rlproxy.New(tr.Client())
+
+	var progress int64
+	opts := GetRepoOptions{
+		Dir:      t.TempDir(),
+		Progress: func(read, total int64) { progress = read },
+	}
+	carPath, size, err := GetRepo(ctx, proxy, "https://pds.test", "did:plc:abcdefghijklmnopqrstuvwx", "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size == 0 || progress != size {
+		t.Errorf("got size %d, progress %d", size, progress)
+	}
+	carData, err := os.ReadFile(carPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := OpenMemBlockstore(filepath.Join(t.TempDir(), "repo.car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, rev, newBlocks, err := MergeUpdate(bs, bytes.NewReader(carData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Defined() || rev == "" {
+		t.Fatalf("got root %s rev %q", root, rev)
+	}
+	if len(newBlocks) != len(bs.Blocks) || len(bs.Blocks) == 0 {
+		t.Errorf("got %d new blocks, %d total", len(newBlocks), len(bs.Blocks))
+	}
+
+	r, err := ReadRepoFromCar(bytes.NewReader(carData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.DID.String() != "did:plc:abcdefghijklmnopqrstuvwx" {
+		t.Errorf("got DID %s", r.DID)
+	}
+	rec, _, err := r.GetRecordBytes(ctx, "app.bsky.actor.profile", "self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec) == 0 {
+		t.Error("profile record is empty")
+	}
+
+	// errors from the PDS are surfaced
+	_, _, err = GetRepo(ctx, proxy, "https://pds.test", "did:plc:zyxwvutsrqponmlkjihgfedc", "", opts)
+	if err == nil {
+		t.Error("expected an error for a missing repo")
+	}
+
+	// downloads over the size limit are rejected, leaving nothing behind
+	opts.MaxBytes = size - 1
+	_, _, err = GetRepo(ctx, proxy, "https://pds.test", "did:plc:abcdefghijklmnopqrstuvwx", "", opts)
+	if !errors.Is(err, ErrRepoTooLarge) {
+		t.Errorf("got %v, want ErrRepoTooLarge", err)
+	}
+	entries, _ := os.ReadDir(opts.Dir)
+	if len(entries) != 1 {
+		t.Errorf("got %d files in the download dir, want only the first download", len(entries))
+	}
+}
@@ -0,0 +1,287 @@
+package repo
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"sort"
+	"strings"
+
+	indigoRepo "github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/bluesky-social/indigo/atproto/repo/mst"
+	"github.com/ipfs/go-cid"
+)
+
+// CompactStats reports what a compaction kept and reclaimed.
+type CompactStats struct {
+	Blocks      int   // blocks before
+	Kept        int   // reachable blocks written to the compacted CAR
+	Commits     int   // commits kept, including the root
+	Missing     int   // reachable blocks that were not in the store
+	BytesBefore int64 // file size before
+	BytesAfter  int64 // file size after
+}
+
+// Reclaimed is the number of bytes freed.
+func (s CompactStats) Reclaimed() int64 {
+	return s.BytesBefore - s.BytesAfter
+}
+
+// CompactCar rewrites the CAR at path with only the blocks reachable from its root commit,
+// and from the keep commits before it when they are still in the store.
+// A compressed CAR (path.zst) is inflated, compacted and compressed again at level, sizes are of the raw CAR.
+func CompactCar(path string, keep, level int) (*CompactStats, error) {
+	if strings.HasSuffix(path, CompressedSuffix) || IsCompressedCar(path) {
+		path = strings.TrimSuffix(path, CompressedSuffix)
+		if err := InflateCar(path); err != nil {
+			return nil, err
+		}
+		stats, err := compactCar(path, keep)
+		if _, cerr := CompressCar(path, level); err == nil {
+			err = cerr
+		}
+		return stats, err
+	}
+	return compactCar(path, keep)
+}
+
+func compactCar(path string, keep int) (*CompactStats, error) {
+	before, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := OpenCarStore(path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	root := src.Root()
+	if !root.Defined() {
+		return nil, fmt.Errorf("car file %s has no root", path)
+	}
+	stats := &CompactStats{
+		Blocks:      src.Len(),
+		BytesBefore: before.Size(),
+	}
+
+	seen := make(map[cid.Cid]bool)
+	blocks, missing, err := Reachable(src, root, seen)
+	if err != nil {
+		return nil, err
+	}
+	stats.Commits = 1
+	stats.Missing = missing
+
+	if keep > 0 {
+		prev, err := previousCommits(src, root)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range prev {
+			if stats.Commits > keep {
+				break
+			}
+			// older commits may only be partially stored, those are dropped
+			walked := maps.Clone(seen)
+			found, missing, err := Reachable(src, c, walked)
+			if err != nil {
+				continue
+			}
+			seen = walked
+			blocks = append(blocks, found...)
+			stats.Commits++
+			stats.Missing += missing
+		}
+	}
+	stats.Kept = len(blocks)
+
+	// write the compacted store next to the original, then swap it in
+	tmp := path + ".gc"
+	os.Remove(tmp)
+	dst, err := OpenCarStore(tmp)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range blocks {
+		data, err := src.Get(c)
+		if err == nil {
+			err = dst.Put(c, data)
+		}
+		if err != nil {
+			dst.Close()
+			os.Remove(tmp)
+			return nil, fmt.Errorf("failed to copy block %s: %w", c, err)
+		}
+	}
+	if err := dst.Commit(root); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := src.Close(); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, fmt.Errorf("failed to replace car file: %w", err)
+	}
+
+	after, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	stats.BytesAfter = after.Size()
+	return stats, nil
+}
+
+// Reachable walks a commit, its MST nodes and records, returning the CIDs not already in seen
+// (which is updated) in walk order, and the number of blocks missing from the store.
+// Missing MST nodes under the commit are an error, missing records are only counted.
+func Reachable(bs Blockstore, commitCid cid.Cid, seen map[cid.Cid]bool) ([]cid.Cid, int, error) {
+	commit, err := loadCommit(bs, commitCid, false)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	found := []cid.Cid{}
+	missing := 0
+	if !seen[commitCid] {
+		seen[commitCid] = true
+		found = append(found, commitCid)
+	}
+
+	err = walkMST(bs, commit.Data, func(_ string, c cid.Cid, node, has bool) (bool, error) {
+		if seen[c] {
+			return false, nil
+		}
+		if !has {
+			if node {
+				return false, fmt.Errorf("%w: MST node %s", ErrBlockNotFound, c)
+			}
+			missing++
+			return false, nil
+		}
+		seen[c] = true
+		found = append(found, c)
+		return true, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return found, missing, nil
+}
+
+// walkMST visits the MST nodes and record CIDs under node, depth first in key order.
+// visit is given the record key (empty for nodes), whether the block is an MST node
+// and whether it is in the store, and returns whether to descend into a node.
+func walkMST(bs Blockstore, node cid.Cid, visit func(key string, c cid.Cid, node, has bool) (bool, error)) error {
+	has, err := bs.Has(node)
+	if err != nil {
+		return err
+	}
+	descend, err := visit("", node, true, has)
+	if err != nil || !descend || !has {
+		return err
+	}
+
+	raw, err := bs.Get(node)
+	if err != nil {
+		return fmt.Errorf("failed to read MST node %s: %w", node, err)
+	}
+	var nd mst.NodeData
+	if err := nd.UnmarshalCBOR(bytes.NewReader(raw)); err != nil {
+		return fmt.Errorf("failed to decode MST node %s: %w", node, err)
+	}
+	if nd.Left != nil {
+		if err := walkMST(bs, *nd.Left, visit); err != nil {
+			return err
+		}
+	}
+	// keys are prefix compressed against the previous entry in the node
+	var key []byte
+	for _, e := range nd.Entries {
+		if int(e.PrefixLen) > len(key) {
+			return fmt.Errorf("invalid key prefix length in MST node %s", node)
+		}
+		key = append(key[:e.PrefixLen:e.PrefixLen], e.KeySuffix...)
+		has, err := bs.Has(e.Value)
+		if err != nil {
+			return err
+		}
+		if _, err := visit(string(key), e.Value, false, has); err != nil {
+			return err
+		}
+		if e.Right != nil {
+			if err := walkMST(bs, *e.Right, visit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadCommit reads and checks a commit block, which must be signed unless allowUnsigned (see CheckCommit)
+func loadCommit(bs Blockstore, c cid.Cid, allowUnsigned bool) (*indigoRepo.Commit, error) {
+	commit, err := decodeCommit(bs, c)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckCommit(commit, allowUnsigned); err != nil {
+		return nil, fmt.Errorf("invalid commit %s: %w", c, err)
+	}
+	return commit, nil
+}
+
+// decodeCommit reads a commit block without checking it
+func decodeCommit(bs Blockstore, c cid.Cid) (*indigoRepo.Commit, error) {
+	raw, err := bs.Get(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read commit %s: %w", c, err)
+	}
+	var commit indigoRepo.Commit
+	if err := commit.UnmarshalCBOR(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("failed to decode commit %s: %w", c, err)
+	}
+	return &commit, nil
+}
+
+// previousCommits finds the commits in the store other than root, newest first
+func previousCommits(bs Blockstore, root cid.Cid) ([]cid.Cid, error) {
+	type found struct {
+		cid cid.Cid
+		rev string
+	}
+	var commits []found
+	err := bs.ForEach(func(c cid.Cid, data []byte) error {
+		if c.Equals(root) {
+			return nil
+		}
+		// only commits have a rev, everything else is skipped cheaply
+		if _, ok := tryExtractRev(data); !ok {
+			return nil
+		}
+		commit, err := loadCommit(bs, c, false)
+		if err != nil {
+			return nil
+		}
+		commits = append(commits, found{c, commit.Rev})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(commits, func(i, j int) bool { return commits[i].rev > commits[j].rev })
+	cids := make([]cid.Cid, len(commits))
+	for i, c := range commits {
+		cids[i] = c.cid
+	}
+	return cids, nil
+}
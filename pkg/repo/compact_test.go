@@ -0,0 +1,108 @@
+package repo
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/blebbit/atmunge/pkg/util/fakepds"
+)
+
+func TestCompactCar(t *testing.T) {
+	pds := fakepds.New()
+	defer pds.Close()
+
+	acct, err := pds.CreateRepo("alice.test", fakepds.SampleRecords("alice.test", 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "repo.car")
+
+	sync := func() {
+		t.Helper()
+		bs, err := OpenCarStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		update, err := acct.CAR(bs.Rev())
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, _, _, err := MergeUpdate(bs, bytes.NewReader(update))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bs.Commit(root); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync()
+
+	// rewrite the profile a few times, each leaves an old record and MST nodes behind
+	heads := []cid.Cid{acct.Head()}
+	for i := range 3 {
+		_, err := pds.Commit(acct.DID, fakepds.Records{
+			"app.bsky.actor.profile/self": {
+				"$type":       "app.bsky.actor.profile",
+				"displayName": "alice " + string(rune('a'+i)),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		heads = append(heads, acct.Head())
+		sync()
+	}
+
+	// keeping the previous commit keeps its tree too
+	stats, err := CompactCar(path, 1, DefaultCompressLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Commits != 2 || stats.Reclaimed() <= 0 || stats.Missing != 0 {
+		t.Errorf("got %+v, want 2 commits and bytes reclaimed", stats)
+	}
+
+	cs, err := OpenCarStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, head := range heads {
+		has, err := cs.Has(head)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i >= len(heads)-2; has != want {
+			t.Errorf("commit %d kept = %v, want %v", i, has, want)
+		}
+	}
+	kept := cs.Len()
+	cs.Close()
+
+	// and without it only the latest tree is left
+	stats, err = CompactCar(path, 0, DefaultCompressLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Commits != 1 || stats.Kept >= kept || stats.Blocks != kept {
+		t.Errorf("got %+v, want fewer than %d blocks kept", stats, kept)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := ReadRepoFromCar(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, _, err := r.GetRecordBytes(t.Context(), "app.bsky.actor.profile", "self")
+	if err != nil || !bytes.Contains(rec, []byte("alice c")) {
+		t.Errorf("got profile %q, %v", rec, err)
+	}
+}
@@ -0,0 +1,246 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car/v2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressedSuffix is added to CAR files compressed at rest (repo.car.zst).
+// CARs are written raw, and compressed once a sync is done with them.
+const CompressedSuffix = ".zst"
+
+// DefaultCompressLevel is the zstd level used when none is configured.
+const DefaultCompressLevel = 3
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// CompressStats reports the size of a CAR raw and compressed.
+type CompressStats struct {
+	Raw        int64
+	Compressed int64
+}
+
+// Ratio is the raw size over the compressed size.
+func (s CompressStats) Ratio() float64 {
+	if s.Compressed == 0 {
+		return 0
+	}
+	return float64(s.Raw) / float64(s.Compressed)
+}
+
+// IsCompressedCar reports whether the CAR at path is only kept compressed, at path.zst.
+func IsCompressedCar(path string) bool {
+	if _, err := os.Stat(path); err == nil {
+		return false
+	}
+	_, err := os.Stat(path + CompressedSuffix)
+	return err == nil
+}
+
+// OpenCar opens a CAR for reading, raw or compressed.
+// When path does not exist, path.zst is tried.
+func OpenCar(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && !strings.HasSuffix(path, CompressedSuffix) {
+		if zf, zerr := os.Open(path + CompressedSuffix); zerr == nil {
+			f, err = zf, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r, done, err := decompressed(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &carReader{Reader: r, close: func() error {
+		done()
+		return f.Close()
+	}}, nil
+}
+
+type carReader struct {
+	io.Reader
+	close func() error
+}
+
+func (c *carReader) Close() error {
+	return c.close()
+}
+
+// decompressed wraps r with a zstd decoder when the stream is compressed,
+// done releases the decoder
+func decompressed(r io.Reader) (io.Reader, func(), error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	if !bytes.Equal(magic, zstdMagic) {
+		return br, func() {}, nil
+	}
+	zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create zstd reader: %w", err)
+	}
+	return zr, zr.Close, nil
+}
+
+// ReadCarHead reads the root commit and rev of a CAR, raw or compressed, without loading it.
+func ReadCarHead(path string) (cid.Cid, string, error) {
+	f, err := OpenCar(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cid.Undef, "", nil
+	}
+	if err != nil {
+		return cid.Undef, "", err
+	}
+	defer f.Close()
+
+	br, err := car.NewBlockReader(f)
+	if err != nil {
+		return cid.Undef, "", fmt.Errorf("failed to create block reader: %w", err)
+	}
+	if len(br.Roots) == 0 || br.Roots[0].Equals(placeholderRoot) {
+		return cid.Undef, "", nil
+	}
+	root := br.Roots[0]
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			return cid.Undef, "", fmt.Errorf("%w: root commit %s", ErrBlockNotFound, root)
+		}
+		if err != nil {
+			return cid.Undef, "", fmt.Errorf("failed reading block: %w", err)
+		}
+		if blk.Cid().Equals(root) {
+			rev, _ := tryExtractRev(blk.RawData())
+			return root, rev, nil
+		}
+	}
+}
+
+// CompressCar compresses the raw CAR at path to path.zst at the zstd level, then removes the raw file.
+func CompressCar(path string, level int) (*CompressStats, error) {
+	if strings.HasSuffix(path, CompressedSuffix) {
+		return nil, fmt.Errorf("%s is already compressed", path)
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	dst := path + CompressedSuffix
+	tmp := dst + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	zw, err := zstd.NewWriter(f, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	if err == nil {
+		_, err = io.Copy(zw, src)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("failed to compress %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return nil, err
+	}
+	// both forms hold the same blocks, so a crash here only leaves the raw one preferred
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+	stats, err := compressStats(dst)
+	if err != nil {
+		return nil, err
+	}
+	stats.Raw = fi.Size()
+	return stats, nil
+}
+
+// DecompressCar inflates the CAR at path.zst (or path, when it ends in .zst) back to a raw CAR,
+// then removes the compressed file.
+func DecompressCar(path string) (*CompressStats, error) {
+	path = strings.TrimSuffix(path, CompressedSuffix)
+	src := path + CompressedSuffix
+
+	rc, err := OpenCar(src)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, rc)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("failed to decompress %s: %w", src, err)
+	}
+	stats, err := compressStats(src)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(tmp); err == nil {
+		stats.Raw = fi.Size()
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(src); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// InflateCar decompresses the CAR at path if it is only kept compressed, so it can be opened for writing.
+func InflateCar(path string) error {
+	if !IsCompressedCar(path) {
+		return nil
+	}
+	_, err := DecompressCar(path)
+	return err
+}
+
+func compressStats(compressed string) (*CompressStats, error) {
+	fi, err := os.Stat(compressed)
+	if err != nil {
+		return nil, err
+	}
+	return &CompressStats{Compressed: fi.Size()}, nil
+}
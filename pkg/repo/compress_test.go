@@ -0,0 +1,139 @@
+package repo
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blebbit/atmunge/pkg/util/fakepds"
+)
+
+func TestCompressCar(t *testing.T) {
+	pds := fakepds.New()
+	defer pds.Close()
+
+	acct, err := pds.CreateRepo("alice.test", fakepds.SampleRecords("alice.test", 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "repo.car")
+
+	sync := func() {
+		t.Helper()
+		bs, err := OpenCarStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		update, err := acct.CAR(bs.Rev())
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, _, _, err := MergeUpdate(bs, bytes.NewReader(update))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bs.Commit(root); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync()
+	head := acct.Head()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := CompressCar(path, DefaultCompressLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Raw != int64(len(raw)) || stats.Compressed == 0 || stats.Ratio() <= 1 {
+		t.Errorf("got stats %+v, want a smaller compressed CAR", stats)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("raw CAR not removed after compressing")
+	}
+	if !IsCompressedCar(path) {
+		t.Error("CAR not reported as compressed")
+	}
+
+	// readers decompress, given the raw or compressed path
+	for _, p := range []string{path, path + CompressedSuffix} {
+		rc, err := OpenCar(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(rc); err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+		if !bytes.Equal(buf.Bytes(), raw) {
+			t.Errorf("OpenCar(%s) did not return the raw CAR", p)
+		}
+	}
+	root, rev, err := ReadCarHead(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equals(head) || rev != acct.Rev() {
+		t.Errorf("got head %s@%s, want %s@%s", root, rev, head, acct.Rev())
+	}
+	zf, err := os.Open(path + CompressedSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := ReadRepoFromCar(zf)
+	zf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.DID.String() != acct.DID {
+		t.Errorf("got repo %s, want %s", r.DID, acct.DID)
+	}
+
+	// a sync inflates it to merge, then it can be compressed again
+	if _, err := pds.Commit(acct.DID, fakepds.SampleRecords("alice.test", 1)); err != nil {
+		t.Fatal(err)
+	}
+	sync()
+	if IsCompressedCar(path) {
+		t.Error("CAR still compressed after merging")
+	}
+	if _, err := os.Stat(path + CompressedSuffix); !os.IsNotExist(err) {
+		t.Error("compressed CAR left behind after inflating")
+	}
+	if _, err := CompressCar(path, DefaultCompressLevel); err != nil {
+		t.Fatal(err)
+	}
+
+	// compaction keeps it compressed
+	cstats, err := CompactCar(path+CompressedSuffix, 0, DefaultCompressLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cstats.Commits != 1 || !IsCompressedCar(path) {
+		t.Errorf("got compaction %+v compressed=%v, want one commit kept compressed", cstats, IsCompressedCar(path))
+	}
+	if _, rev, err := ReadCarHead(path); err != nil || rev != acct.Rev() {
+		t.Errorf("got rev %s after compaction, want %s: %v", rev, acct.Rev(), err)
+	}
+
+	stats, err = DecompressCar(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsCompressedCar(path) || stats.Raw == 0 {
+		t.Errorf("got stats %+v, want the raw CAR back", stats)
+	}
+	bs, err := OpenCarStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	if bs.Rev() != acct.Rev() {
+		t.Errorf("got rev %s after decompressing, want %s", bs.Rev(), acct.Rev())
+	}
+}
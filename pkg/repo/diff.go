@@ -0,0 +1,379 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/repo/mst"
+	"github.com/ipfs/go-cid"
+)
+
+// record change ops
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// RecordChange is a record that differs between two commits.
+type RecordChange struct {
+	Op         string
+	Collection string
+	Rkey       string
+	// CID is the record in the new commit, undefined for deletes
+	CID cid.Cid
+	// Prev is the record in the old commit, undefined for creates
+	Prev cid.Cid
+}
+
+func (rc RecordChange) MarshalJSON() ([]byte, error) {
+	out := struct {
+		Op         string `json:"op"`
+		Collection string `json:"collection"`
+		Rkey       string `json:"rkey"`
+		CID        string `json:"cid,omitempty"`
+		Prev       string `json:"prev,omitempty"`
+	}{
+		Op:         rc.Op,
+		Collection: rc.Collection,
+		Rkey:       rc.Rkey,
+	}
+	if rc.CID.Defined() {
+		out.CID = rc.CID.String()
+	}
+	if rc.Prev.Defined() {
+		out.Prev = rc.Prev.String()
+	}
+	return json.Marshal(out)
+}
+
+func (rc *RecordChange) UnmarshalJSON(b []byte) error {
+	var in struct {
+		Op         string `json:"op"`
+		Collection string `json:"collection"`
+		Rkey       string `json:"rkey"`
+		CID        string `json:"cid"`
+		Prev       string `json:"prev"`
+	}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+	*rc = RecordChange{Op: in.Op, Collection: in.Collection, Rkey: in.Rkey}
+
+	var err error
+	if in.CID != "" {
+		if rc.CID, err = cid.Decode(in.CID); err != nil {
+			return fmt.Errorf("invalid record cid: %w", err)
+		}
+	}
+	if in.Prev != "" {
+		if rc.Prev, err = cid.Decode(in.Prev); err != nil {
+			return fmt.Errorf("invalid prev record cid: %w", err)
+		}
+	}
+	return nil
+}
+
+// ChangeCounts tallies record changes per collection.
+type ChangeCounts struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Deleted int `json:"deleted"`
+}
+
+// SummarizeChanges counts changes by collection.
+func SummarizeChanges(changes []RecordChange) map[string]*ChangeCounts {
+	summary := make(map[string]*ChangeCounts)
+	for _, rc := range changes {
+		c, ok := summary[rc.Collection]
+		if !ok {
+			c = &ChangeCounts{}
+			summary[rc.Collection] = c
+		}
+		switch rc.Op {
+		case OpCreate:
+			c.Created++
+		case OpUpdate:
+			c.Updated++
+		case OpDelete:
+			c.Deleted++
+		}
+	}
+	return summary
+}
+
+// recordCids maps the record paths (collection/rkey) under a commit to their CIDs,
+// optionally accepting an unsigned commit (see CheckCommit).
+// Only MST nodes are read, record blocks need not be present.
+func recordCids(bs Blockstore, commitCid cid.Cid, allowUnsigned bool) (map[string]cid.Cid, error) {
+	records := make(map[string]cid.Cid)
+	if !commitCid.Defined() {
+		return records, nil
+	}
+	commit, err := loadCommit(bs, commitCid, allowUnsigned)
+	if err != nil {
+		return nil, err
+	}
+
+	err = walkMST(bs, commit.Data, func(key string, c cid.Cid, node, has bool) (bool, error) {
+		if node {
+			if !has {
+				return false, fmt.Errorf("%w: MST node %s", ErrBlockNotFound, c)
+			}
+			return true, nil
+		}
+		records[key] = c
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// DiffOptions configure a diff.
+type DiffOptions struct {
+	// AllowUnsigned accepts commits without a signature, such as the fixtures repo pack writes
+	AllowUnsigned bool
+}
+
+// Diff lists the records created, updated and deleted going from the old commit to the new one,
+// sorted by collection and rkey. An undefined oldRoot diffs against an empty repo.
+// The commits may come from the same blockstore. The MSTs are compared structurally,
+// subtrees with the same CID in both commits are skipped without being read.
+func Diff(oldBs Blockstore, oldRoot cid.Cid, newBs Blockstore, newRoot cid.Cid, opts DiffOptions) ([]RecordChange, error) {
+	if oldRoot.Equals(newRoot) {
+		return nil, nil
+	}
+	before := &mstCursor{bs: oldBs}
+	if oldRoot.Defined() {
+		commit, err := loadCommit(oldBs, oldRoot, opts.AllowUnsigned)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read old commit: %w", err)
+		}
+		before.items = []mstItem{{cid: commit.Data, node: true}}
+	}
+	after := &mstCursor{bs: newBs}
+	commit, err := loadCommit(newBs, newRoot, opts.AllowUnsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read new commit: %w", err)
+	}
+	after.items = []mstItem{{cid: commit.Data, node: true}}
+
+	var changes []RecordChange
+	for {
+		a, b := before.peek(), after.peek()
+		switch {
+		case a == nil && b == nil:
+			sortChanges(changes)
+			return changes, nil
+
+		case a == nil:
+			if b.node {
+				if err := after.expand(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			changes = append(changes, newRecordChange(OpCreate, b.key, b.cid, cid.Undef))
+			after.pop()
+
+		case b == nil:
+			if a.node {
+				if err := before.expand(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			changes = append(changes, newRecordChange(OpDelete, a.key, cid.Undef, a.cid))
+			before.pop()
+
+		case a.node && b.node:
+			if a.cid.Equals(b.cid) {
+				before.pop()
+				after.pop()
+				continue
+			}
+			// descend the higher subtree until both sides are at the same layer
+			ha, err := before.height()
+			if err != nil {
+				return nil, err
+			}
+			hb, err := after.height()
+			if err != nil {
+				return nil, err
+			}
+			if ha >= hb {
+				if err := before.expand(); err != nil {
+					return nil, err
+				}
+			}
+			if hb >= ha {
+				if err := after.expand(); err != nil {
+					return nil, err
+				}
+			}
+
+		case a.node:
+			if err := before.expand(); err != nil {
+				return nil, err
+			}
+
+		case b.node:
+			if err := after.expand(); err != nil {
+				return nil, err
+			}
+
+		case a.key < b.key:
+			changes = append(changes, newRecordChange(OpDelete, a.key, cid.Undef, a.cid))
+			before.pop()
+
+		case b.key < a.key:
+			changes = append(changes, newRecordChange(OpCreate, b.key, b.cid, cid.Undef))
+			after.pop()
+
+		default:
+			if !a.cid.Equals(b.cid) {
+				changes = append(changes, newRecordChange(OpUpdate, b.key, b.cid, a.cid))
+			}
+			before.pop()
+			after.pop()
+		}
+	}
+}
+
+// mstItem is a record or an unread MST subtree in a key ordered walk
+type mstItem struct {
+	key  string
+	cid  cid.Cid
+	node bool
+	// decoded node, read once its layer is needed
+	data *mst.NodeData
+}
+
+// mstCursor walks an MST in key order, reading subtrees only when they are expanded.
+// items is a stack, the next item last.
+type mstCursor struct {
+	bs    Blockstore
+	items []mstItem
+}
+
+func (mc *mstCursor) peek() *mstItem {
+	if len(mc.items) == 0 {
+		return nil
+	}
+	return &mc.items[len(mc.items)-1]
+}
+
+func (mc *mstCursor) pop() {
+	mc.items = mc.items[:len(mc.items)-1]
+}
+
+// load decodes the subtree at the head of the cursor
+func (mc *mstCursor) load() (*mst.NodeData, error) {
+	it := mc.peek()
+	if it.data != nil {
+		return it.data, nil
+	}
+	raw, err := mc.bs.Get(it.cid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read MST node %s: %w", it.cid, err)
+	}
+	var nd mst.NodeData
+	if err := nd.UnmarshalCBOR(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("failed to decode MST node %s: %w", it.cid, err)
+	}
+	it.data = &nd
+	return &nd, nil
+}
+
+// height is the layer of the subtree at the head of the cursor, -1 for an empty tree
+func (mc *mstCursor) height() (int, error) {
+	nd, err := mc.load()
+	if err != nil {
+		return 0, err
+	}
+	if len(nd.Entries) == 0 {
+		return -1, nil
+	}
+	// the first key is stored whole
+	return mst.HeightForKey(nd.Entries[0].KeySuffix), nil
+}
+
+// expand replaces the subtree at the head of the cursor with its records and child subtrees
+func (mc *mstCursor) expand() error {
+	nd, err := mc.load()
+	if err != nil {
+		return err
+	}
+	node := mc.peek().cid
+	mc.pop()
+
+	var items []mstItem
+	if nd.Left != nil {
+		items = append(items, mstItem{cid: *nd.Left, node: true})
+	}
+	// keys are prefix compressed against the previous entry in the node
+	var key []byte
+	for _, e := range nd.Entries {
+		if int(e.PrefixLen) > len(key) {
+			return fmt.Errorf("invalid key prefix length in MST node %s", node)
+		}
+		key = append(key[:e.PrefixLen:e.PrefixLen], e.KeySuffix...)
+		items = append(items, mstItem{key: string(key), cid: e.Value})
+		if e.Right != nil {
+			items = append(items, mstItem{cid: *e.Right, node: true})
+		}
+	}
+	for i := len(items) - 1; i >= 0; i-- {
+		mc.items = append(mc.items, items[i])
+	}
+	return nil
+}
+
+// diffRecordCids lists the changes going from the before records to the after ones,
+// both keyed by collection/rkey, sorted by collection and rkey
+func diffRecordCids(before, after map[string]cid.Cid) []RecordChange {
+	var changes []RecordChange
+	for path, c := range after {
+		prev, ok := before[path]
+		switch {
+		case !ok:
+			changes = append(changes, newRecordChange(OpCreate, path, c, cid.Undef))
+		case !prev.Equals(c):
+			changes = append(changes, newRecordChange(OpUpdate, path, c, prev))
+		}
+	}
+	for path, prev := range before {
+		if _, ok := after[path]; !ok {
+			changes = append(changes, newRecordChange(OpDelete, path, cid.Undef, prev))
+		}
+	}
+	sortChanges(changes)
+	return changes
+}
+
+// sortChanges orders changes by collection and rkey, MST key order differs
+// where a collection is a prefix of another
+func sortChanges(changes []RecordChange) {
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Collection != changes[j].Collection {
+			return changes[i].Collection < changes[j].Collection
+		}
+		return changes[i].Rkey < changes[j].Rkey
+	})
+}
+
+func newRecordChange(op, path string, c, prev cid.Cid) RecordChange {
+	collection, rkey, _ := strings.Cut(path, "/")
+	return RecordChange{
+		Op:         op,
+		Collection: collection,
+		Rkey:       rkey,
+		CID:        c,
+		Prev:       prev,
+	}
+}
@@ -0,0 +1,218 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ipfs/go-cid"
+
+	"github.com/blebbit/atmunge/pkg/util/fakepds"
+)
+
+func TestDiff(t *testing.T) {
+	pds := fakepds.New()
+	defer pds.Close()
+
+	records := fakepds.SampleRecords("alice.test", 5)
+	acct, err := pds.CreateRepo("alice.test", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := OpenCarStore(filepath.Join(t.TempDir(), "repo.car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	merge := func() {
+		t.Helper()
+		update, err := acct.CAR(bs.Rev())
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, _, _, err := MergeUpdate(bs, bytes.NewReader(update))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bs.Commit(root); err != nil {
+			t.Fatal(err)
+		}
+	}
+	merge()
+	oldRoot := bs.Root()
+
+	// one of each op
+	var deleted string
+	for path := range records {
+		if strings.HasPrefix(path, "app.bsky.feed.post/") {
+			deleted = path
+			break
+		}
+	}
+	created := "app.bsky.feed.post/" + syntax.NewTIDNow(0).String()
+	_, err = pds.Commit(acct.DID, fakepds.Records{
+		created: {
+			"$type":     "app.bsky.feed.post",
+			"text":      "new post",
+			"createdAt": syntax.DatetimeNow().String(),
+		},
+		"app.bsky.actor.profile/self": {
+			"$type":       "app.bsky.actor.profile",
+			"displayName": "Alice",
+		},
+		deleted: nil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	merge()
+
+	changes, err := Diff(bs, oldRoot, bs, bs.Root(), DiffOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, c := range changes {
+		got[c.Collection+"/"+c.Rkey] = c.Op
+	}
+	want := map[string]string{
+		created:                       OpCreate,
+		"app.bsky.actor.profile/self": OpUpdate,
+		deleted:                       OpDelete,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got changes %v, want %v", got, want)
+	}
+	for path, op := range want {
+		if got[path] != op {
+			t.Errorf("%s: got %q, want %q", path, got[path], op)
+		}
+	}
+
+	summary := SummarizeChanges(changes)
+	if s := summary["app.bsky.feed.post"]; s == nil || s.Created != 1 || s.Deleted != 1 {
+		t.Errorf("got post summary %+v", s)
+	}
+
+	b, err := json.Marshal(changes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte(`"op":"update"`)) || !bytes.Contains(b, []byte(`"prev":"bafy`)) {
+		t.Errorf("got %s", b)
+	}
+
+	// against nothing, everything is created
+	changes, err = Diff(bs, cid.Undef, bs, bs.Root(), DiffOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != len(records) {
+		t.Errorf("got %d changes from an empty repo, want %d", len(changes), len(records))
+	}
+}
+
+// countingStore counts block reads
+type countingStore struct {
+	Blockstore
+	gets int
+}
+
+func (cs *countingStore) Get(c cid.Cid) ([]byte, error) {
+	cs.gets++
+	return cs.Blockstore.Get(c)
+}
+
+func TestDiffSkipsSharedSubtrees(t *testing.T) {
+	pds := fakepds.New()
+	defer pds.Close()
+
+	acct, err := pds.CreateRepo("alice.test", fakepds.SampleRecords("alice.test", 500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := OpenCarStore(filepath.Join(t.TempDir(), "repo.car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	merge := func() {
+		t.Helper()
+		update, err := acct.CAR(bs.Rev())
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, _, _, err := MergeUpdate(bs, bytes.NewReader(update))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bs.Commit(root); err != nil {
+			t.Fatal(err)
+		}
+	}
+	merge()
+
+	commit, err := loadCommit(bs, bs.Root(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := 0
+	if err := walkMST(bs, commit.Data, func(_ string, _ cid.Cid, node, _ bool) (bool, error) {
+		if node {
+			nodes++
+		}
+		return node, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 5 {
+		oldRoot := bs.Root()
+		records := fakepds.Records{}
+		for j := range i + 1 {
+			records["app.bsky.feed.post/"+syntax.NewTIDNow(uint(j)).String()] = map[string]any{
+				"$type":     "app.bsky.feed.post",
+				"text":      "another post",
+				"createdAt": syntax.DatetimeNow().String(),
+			}
+		}
+		if _, err := pds.Commit(acct.DID, records); err != nil {
+			t.Fatal(err)
+		}
+		merge()
+
+		counted := &countingStore{Blockstore: bs}
+		changes, err := Diff(counted, oldRoot, counted, bs.Root(), DiffOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the commits and the nodes on the paths to the new records
+		if counted.gets >= nodes/2 {
+			t.Errorf("read %d blocks of %d MST nodes for %d new records", counted.gets, nodes, i+1)
+		}
+
+		// the same changes as comparing every record
+		before, err := recordCids(bs, oldRoot, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := recordCids(bs, bs.Root(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := diffRecordCids(before, after)
+		if len(changes) != len(want) || len(changes) != i+1 {
+			t.Fatalf("got %d changes, want %d", len(changes), len(want))
+		}
+		for j := range want {
+			if changes[j] != want[j] {
+				t.Errorf("got change %+v, want %+v", changes[j], want[j])
+			}
+		}
+	}
+}
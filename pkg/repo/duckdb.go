@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -12,7 +13,6 @@ import (
 	"github.com/blebbit/atmunge/pkg/db"
 	"github.com/bluesky-social/indigo/atproto/data"
 	indigoRepo "github.com/bluesky-social/indigo/atproto/repo"
-	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/ipfs/go-cid"
 	_ "github.com/marcboeker/go-duckdb/v2"
 	"github.com/nrednav/cuid2"
@@ -44,110 +44,234 @@ func InitDuckDB(dbPath string) (*sql.DB, error) {
 	return dbConn, nil
 }
 
-func CarToDuckDB(ctx context.Context, carPath string, dbPath string) error {
-	// Initialize the database first
+// CarToDuckDB brings the DuckDB at dbPath up to the commit of a CAR, raw or compressed, see UpdateDuckDB.
+func CarToDuckDB(ctx context.Context, carPath string, dbPath string, opts UpdateOptions) error {
+	bs, err := OpenMemBlockstore(carPath)
+	if err != nil {
+		return fmt.Errorf("failed to open car file: %w", err)
+	}
+	if !bs.Root().Defined() {
+		return fmt.Errorf("car file %s does not exist or has no root", carPath)
+	}
+	_, err = UpdateDuckDB(ctx, bs, dbPath, opts)
+	return err
+}
+
+func RepoToDuckDB(r *indigoRepo.Repo, dbPath string) error {
 	db, err := InitDuckDB(dbPath)
 	if err != nil {
 		return fmt.Errorf("failed to init duckdb: %w", err)
 	}
 	defer db.Close()
 
-	// Open and read the CAR file
-	f, err := os.Open(carPath)
+	return SaveRecordsToDuckDB(context.Background(), r, db)
+}
+
+// UpdateDuckDB brings the records in the DuckDB at dbPath to the root commit of bs.
+// The changes are the MST diff from the commit the database reflects (repo_state) to the root,
+// or, without a previous commit or its blocks, the records table compared with the tree.
+// New records are inserted, updated ones replaced and deleted ones removed,
+// along with their typed table rows and extracted refs and blobs.
+func UpdateDuckDB(ctx context.Context, bs Blockstore, dbPath string, opts UpdateOptions) (*DBUpdate, error) {
+	commit, err := loadCommit(bs, bs.Root(), opts.AllowUnsigned)
 	if err != nil {
-		return fmt.Errorf("failed to open car file: %w", err)
+		return nil, err
 	}
-	defer f.Close()
+	up := &DBUpdate{DID: commit.DID, Rev: commit.Rev}
 
-	r, err := ReadRepoFromCar(f)
+	db, err := InitDuckDB(dbPath)
 	if err != nil {
-		return fmt.Errorf("failed to read repo from car: %w", err)
+		return nil, fmt.Errorf("failed to init duckdb: %w", err)
 	}
+	defer db.Close()
 
-	// Save the records to the database
-	return SaveRecordsToDuckDB(ctx, r, db)
-}
+	var prevRoot string
+	err = db.QueryRowContext(ctx, "SELECT root FROM repo_state WHERE did = ?", up.DID).Scan(&prevRoot)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to read repo state: %w", err)
+	}
+	if prevRoot == bs.Root().String() {
+		return up, nil
+	}
 
-func RepoToDuckDB(r *indigoRepo.Repo, dbPath string) error {
-	db, err := InitDuckDB(dbPath)
+	changes, ok := changesSince(bs, prevRoot, opts)
+	if !ok {
+		before, err := duckDBRecordCids(ctx, db, up.DID)
+		if err != nil {
+			return nil, err
+		}
+		after, err := recordCids(bs, bs.Root(), opts.AllowUnsigned)
+		if err != nil {
+			return nil, err
+		}
+		changes = diffRecordCids(before, after)
+		up.Full = true
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to init duckdb: %w", err)
+		return nil, err
 	}
-	defer db.Close()
+	defer tx.Rollback()
 
-	return SaveRecordsToDuckDB(context.Background(), r, db)
+	if err := applyDuckDBChanges(ctx, tx, up, changes, blockstoreRecordGetter(bs)); err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT OR REPLACE INTO repo_state (did, rev, root, updated_at) VALUES (?, ?, ?, ?)",
+		up.DID, up.Rev, bs.Root().String(), time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to write repo state: %w", err)
+	}
+	return up, tx.Commit()
 }
 
+// SaveRecordsToDuckDB brings the records in db to those of a loaded repo,
+// comparing the records table with its tree.
 func SaveRecordsToDuckDB(ctx context.Context, r *indigoRepo.Repo, db *sql.DB) error {
-	tx, err := db.Begin()
+	did := r.DID.String()
+	before, err := duckDBRecordCids(ctx, db, did)
+	if err != nil {
+		return err
+	}
+	after, err := repoRecordCids(r)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
 
-	stmt, err := tx.Prepare(`
-		INSERT INTO records (cuid, created_at, indexed_at, updated_at, did, nsid, rkey, cid, record)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT(did, nsid, rkey, cid) DO NOTHING;
-	`)
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
 
-	repoDid := r.DID.String()
+	up := &DBUpdate{DID: did, Full: true}
+	if err := applyDuckDBChanges(ctx, tx, up, diffRecordCids(before, after), repoRecordGetter(ctx, r)); err != nil {
+		return err
+	}
+	// the repo has no commit to diff from on the next update
+	if _, err := tx.ExecContext(ctx, "DELETE FROM repo_state WHERE did = ?", did); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	err = r.MST.Walk(func(k []byte, v cid.Cid) error {
-		col, rkey, err := syntax.ParseRepoPath(string(k))
-		if err != nil {
-			return err
-		}
+// duckDBRecordCids maps the record paths (collection/rkey) of an account in the records table to their CIDs
+func duckDBRecordCids(ctx context.Context, db *sql.DB, did string) (map[string]cid.Cid, error) {
+	rows, err := db.QueryContext(ctx, "SELECT nsid, rkey, cid FROM records WHERE did = ?", did)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list records: %w", err)
+	}
+	defer rows.Close()
 
-		recBytes, _, err := r.GetRecordBytes(ctx, col, rkey)
-		if err != nil {
-			return err
+	records := make(map[string]cid.Cid)
+	for rows.Next() {
+		var nsid, rkey, c string
+		if err := rows.Scan(&nsid, &rkey, &c); err != nil {
+			return nil, err
 		}
-
-		rec, err := data.UnmarshalCBOR(recBytes)
-		if err != nil {
-			return err
+		path := nsid + "/" + rkey
+		if _, ok := records[path]; ok {
+			// several versions, left by inserts before updates replaced records,
+			// an undefined cid differs from the tree's so they are all replaced
+			records[path] = cid.Undef
+			continue
 		}
+		records[path], _ = cid.Decode(c)
+	}
+	return records, rows.Err()
+}
 
-		recJSON, err := json.Marshal(rec)
-		if err != nil {
+// applyDuckDBChanges writes record changes to the records table and the tables derived from it
+func applyDuckDBChanges(ctx context.Context, tx *sql.Tx, up *DBUpdate, changes []RecordChange, get recordGetter) error {
+	del, err := tx.PrepareContext(ctx, "DELETE FROM records WHERE did = ? AND nsid = ? AND rkey = ?")
+	if err != nil {
+		return err
+	}
+	defer del.Close()
+
+	ins, err := tx.PrepareContext(ctx, `
+		INSERT INTO records (cuid, created_at, indexed_at, updated_at, did, nsid, rkey, cid, record, extra)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(did, nsid, rkey, cid) DO NOTHING;
+	`)
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+
+	removed := false
+	for _, rc := range changes {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-
-		var createdAt, updatedAt, indexedAt time.Time
-		if ca, ok := rec["createdAt"].(string); ok {
-			if t, err := time.Parse(time.RFC3339, ca); err == nil {
-				createdAt = t
+		if rc.Op != OpCreate {
+			if _, err := del.ExecContext(ctx, up.DID, rc.Collection, rc.Rkey); err != nil {
+				return fmt.Errorf("failed to delete %s/%s: %w", rc.Collection, rc.Rkey, err)
 			}
+			removed = true
 		}
-		if ua, ok := rec["updatedAt"].(string); ok {
-			if t, err := time.Parse(time.RFC3339, ua); err == nil {
-				updatedAt = t
+		if rc.Op != OpDelete {
+			recBytes, err := get(rc)
+			if err != nil {
+				return fmt.Errorf("failed to read %s/%s: %w", rc.Collection, rc.Rkey, err)
 			}
-		}
-		if ia, ok := rec["indexedAt"].(string); ok {
-			if t, err := time.Parse(time.RFC3339, ia); err == nil {
-				indexedAt = t
+			if err := insertDuckDBRecord(ctx, ins, up.DID, rc, recBytes); err != nil {
+				return fmt.Errorf("failed to insert %s/%s: %w", rc.Collection, rc.Rkey, err)
 			}
-		} else {
-			indexedAt = time.Now()
 		}
+		up.countChange(rc)
+	}
 
-		cuid := cuid2.Generate()
+	if removed {
+		// refs and blobs are extracted by acct index, keyed by the cuid of their record
+		for _, table := range []string{"refs", "blobs"} {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE source NOT IN (SELECT cuid FROM records)"); err != nil {
+				return fmt.Errorf("failed to prune %s: %w", table, err)
+			}
+		}
+	}
+	return UpdateTypedTables(ctx, tx)
+}
 
-		_, err = stmt.Exec(cuid, createdAt, indexedAt, updatedAt, repoDid, col.String(), rkey.String(), v.String(), string(recJSON))
+// insertDuckDBRecord decodes a record block and inserts it with its timestamps and validation result
+func insertDuckDBRecord(ctx context.Context, stmt *sql.Stmt, did string, rc RecordChange, recBytes []byte) error {
+	rec, err := data.UnmarshalCBOR(recBytes)
+	if err != nil {
 		return err
-	})
+	}
 
+	recJSON, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	extra, err := validationExtra(rc.Collection, rec)
 	if err != nil {
 		return err
 	}
 
-	return tx.Commit()
+	var createdAt, updatedAt, indexedAt time.Time
+	if ca, ok := rec["createdAt"].(string); ok {
+		if t, err := time.Parse(time.RFC3339, ca); err == nil {
+			createdAt = t
+		}
+	}
+	if ua, ok := rec["updatedAt"].(string); ok {
+		if t, err := time.Parse(time.RFC3339, ua); err == nil {
+			updatedAt = t
+		}
+	}
+	if ia, ok := rec["indexedAt"].(string); ok {
+		if t, err := time.Parse(time.RFC3339, ia); err == nil {
+			indexedAt = t
+		}
+	} else {
+		indexedAt = time.Now()
+	}
+
+	cuid := cuid2.Generate()
+
+	_, err = stmt.ExecContext(ctx, cuid, createdAt, indexedAt, updatedAt, did, rc.Collection, rc.Rkey, rc.CID.String(), string(recJSON), extra)
+	return err
 }
 
 func GetRecord(dbPath, nsid, rkey string) (json.RawMessage, error) {
@@ -170,6 +294,34 @@ func GetRecord(dbPath, nsid, rkey string) (json.RawMessage, error) {
 	return json.RawMessage(recordJSON), nil
 }
 
+// ReadBlobRefs lists the blob refs extracted into the blobs table by the acct index step.
+func ReadBlobRefs(ctx context.Context, db *sql.DB) ([]BlobRef, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT cid, any_value(mime_type), max(size)
+		FROM blobs
+		WHERE cid IS NOT NULL
+		GROUP BY cid
+		ORDER BY cid
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query blob refs: %w", err)
+	}
+	defer rows.Close()
+
+	refs := []BlobRef{}
+	for rows.Next() {
+		var ref BlobRef
+		var mimeType sql.NullString
+		var size sql.NullInt64
+		if err := rows.Scan(&ref.CID, &mimeType, &size); err != nil {
+			return nil, fmt.Errorf("failed to scan blob ref: %w", err)
+		}
+		ref.MimeType, ref.Size = mimeType.String, size.Int64
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
+
 func ClearDuckDBTables(db *sql.DB, tables []string) error {
 	if len(tables) == 0 {
 		// If no tables are specified, get all tables from the database
@@ -0,0 +1,332 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car/v2"
+)
+
+// export formats
+const (
+	// ExportParquet writes Parquet files, typed columns for known lexicons
+	ExportParquet = "parquet"
+	// ExportJSONL streams one {uri, cid, collection, rkey, record} line per record
+	ExportJSONL = "jsonl"
+)
+
+// ExportOptions configure an export.
+type ExportOptions struct {
+	// Format is the file format of Export, parquet when empty, ExportCar always writes JSONL
+	Format string
+	// Partition writes <nsid>/did=<did>/ hive-style, for exports of many accounts to the same dir,
+	// rather than <nsid>.<format>
+	Partition bool
+	// Collections limits the export to these NSIDs, all when empty
+	Collections []string
+	// DAGJSON encodes CIDs and bytes in JSONL records as DAG-JSON ({"/": ...}),
+	// rather than the atproto $link and $bytes
+	DAGJSON bool
+	// AllowUnsigned accepts commits without a signature, such as the fixtures repo pack writes
+	AllowUnsigned bool
+}
+
+// ExportStats counts what an export wrote.
+type ExportStats struct {
+	Collections int
+	Records     int64
+}
+
+// exportFallback is the query for collections without a typed table,
+// the record is kept as a JSON column
+const exportFallback = `
+SELECT
+  r.did,
+  r.rkey,
+  r.cid,
+  TRY_CAST(json_extract_string(r.record, '$.createdAt') AS TIMESTAMPTZ) AS created_at,
+  r.record
+FROM
+  records AS r
+WHERE
+  r.nsid = '%s'
+`
+
+// ExportQuery is the SELECT over the records table used to export a collection:
+// the columns of the typed table for the lexicons in TypedTables, the JSON record for others.
+// It reads the records table, so databases converted before the typed tables existed export the same.
+func ExportQuery(nsid string) (string, error) {
+	if _, err := syntax.ParseNSID(nsid); err != nil {
+		return "", fmt.Errorf("invalid collection: %w", err)
+	}
+	if _, ok := TypedTables[nsid]; !ok {
+		// a valid NSID has no quotes to escape
+		return fmt.Sprintf(exportFallback, nsid), nil
+	}
+	query, err := typedTableQuery(nsid)
+	if err != nil {
+		return "", err
+	}
+	// the cuid only joins within the account's database
+	return fmt.Sprintf("SELECT * EXCLUDE (cuid) FROM (%s)", query), nil
+}
+
+// Export writes the records in an account's DuckDB to outDir, one file per collection.
+func Export(ctx context.Context, dbPath, outDir string, opts ExportOptions) (*ExportStats, error) {
+	format := opts.Format
+	if format == "" {
+		format = ExportParquet
+	}
+	if format != ExportParquet {
+		return nil, fmt.Errorf("unsupported export format %q for duckdb", format)
+	}
+
+	db, err := InitDuckDB(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init duckdb: %w", err)
+	}
+	defer db.Close()
+
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT nsid, count(*) FROM records GROUP BY nsid ORDER BY nsid")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collections: %w", err)
+	}
+	counts := make(map[string]int64)
+	var nsids []string
+	for rows.Next() {
+		var nsid string
+		var n int64
+		if err := rows.Scan(&nsid, &n); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if len(opts.Collections) == 0 || slices.Contains(opts.Collections, nsid) {
+			nsids = append(nsids, nsid)
+			counts[nsid] = n
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stats := &ExportStats{}
+	for _, nsid := range nsids {
+		query, err := ExportQuery(nsid)
+		if err != nil {
+			return stats, err
+		}
+		var copySQL string
+		if opts.Partition {
+			// existing partitions of other accounts are kept, the account's own is replaced
+			copySQL = fmt.Sprintf("COPY (%s) TO %s (FORMAT parquet, PARTITION_BY (did), OVERWRITE_OR_IGNORE)",
+				query, quoteLiteral(filepath.Join(outDir, nsid)))
+		} else {
+			copySQL = fmt.Sprintf("COPY (%s) TO %s (FORMAT parquet)",
+				query, quoteLiteral(filepath.Join(outDir, nsid+"."+format)))
+		}
+		if _, err := db.ExecContext(ctx, copySQL); err != nil {
+			return stats, fmt.Errorf("failed to export %s: %w", nsid, err)
+		}
+		stats.Collections++
+		stats.Records += counts[nsid]
+	}
+	return stats, nil
+}
+
+// quoteLiteral quotes a string for use as a SQL literal
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// ExportLine is a record in a JSONL export.
+type ExportLine struct {
+	URI        string `json:"uri"`
+	CID        string `json:"cid"`
+	Collection string `json:"collection"`
+	Rkey       string `json:"rkey"`
+	Record     any    `json:"record"`
+}
+
+// ExportCar streams the records of a CAR, raw or compressed, to w as JSON lines in MST order.
+// The MST is walked over an indexed blockstore and each record block read as it is written,
+// so only the index is held in memory.
+func ExportCar(ctx context.Context, carPath string, w io.Writer, opts ExportOptions) (*ExportStats, error) {
+	bs, done, err := openExportStore(carPath)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if !bs.Root().Defined() {
+		return nil, fmt.Errorf("car file %s has no root commit", carPath)
+	}
+	commit, err := loadCommit(bs, bs.Root(), opts.AllowUnsigned)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &ExportStats{}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	var last string
+	err = walkMST(bs, commit.Data, func(k string, v cid.Cid, node, has bool) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		if node {
+			if !has {
+				return false, fmt.Errorf("%w: MST node %s", ErrBlockNotFound, v)
+			}
+			return true, nil
+		}
+		col, rkey, err := syntax.ParseRepoPath(k)
+		if err != nil {
+			return false, err
+		}
+		if len(opts.Collections) > 0 && !slices.Contains(opts.Collections, col.String()) {
+			return false, nil
+		}
+
+		recBytes, err := bs.Get(v)
+		if err != nil {
+			return false, fmt.Errorf("failed to read %s: %w", k, err)
+		}
+		rec, err := data.UnmarshalCBOR(recBytes)
+		if err != nil {
+			return false, fmt.Errorf("failed to decode %s: %w", k, err)
+		}
+
+		line := ExportLine{
+			URI:        "at://" + commit.DID + "/" + k,
+			CID:        v.String(),
+			Collection: col.String(),
+			Rkey:       rkey.String(),
+			Record:     rec,
+		}
+		if opts.DAGJSON {
+			line.Record = dagJSON(rec)
+		}
+		if err := enc.Encode(line); err != nil {
+			return false, err
+		}
+
+		// MST keys are sorted, so collections are contiguous
+		if col.String() != last {
+			stats.Collections++
+			last = col.String()
+		}
+		stats.Records++
+		return false, nil
+	})
+	return stats, err
+}
+
+// openExportStore opens a CAR as an indexed blockstore without changing it.
+// A CARv2 is opened in place, a CARv1 or compressed CAR is copied to a temp CARv2, removed by done.
+func openExportStore(carPath string) (Blockstore, func(), error) {
+	if f, err := os.Open(carPath); err == nil {
+		// the path may name the compressed CAR itself
+		br := bufio.NewReader(f)
+		magic, _ := br.Peek(len(zstdMagic))
+		compressed := bytes.Equal(magic, zstdMagic)
+		var version uint64
+		if !compressed {
+			version, err = car.ReadVersion(br)
+		}
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read car version: %w", err)
+		}
+		if !compressed && version == 2 {
+			bs, err := OpenCarStore(carPath)
+			if err != nil {
+				return nil, nil, err
+			}
+			return bs, func() { bs.Close() }, nil
+		}
+	}
+
+	src, err := OpenCar(carPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open car file: %w", err)
+	}
+	defer src.Close()
+
+	dir, err := os.MkdirTemp("", "export-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	done := func() { os.RemoveAll(dir) }
+	bs, err := OpenCarStore(filepath.Join(dir, "repo.car"))
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	root, _, _, err := MergeUpdate(bs, src)
+	if err == nil && root.Defined() {
+		err = bs.Commit(root)
+	}
+	if err != nil {
+		bs.Close()
+		done()
+		return nil, nil, fmt.Errorf("failed to index car file: %w", err)
+	}
+	return bs, func() {
+		bs.Close()
+		done()
+	}, nil
+}
+
+// dagJSON converts decoded record values to the DAG-JSON forms of links and bytes
+func dagJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[k] = dagJSON(e)
+		}
+		return m
+	case []any:
+		l := make([]any, len(v))
+		for i, e := range v {
+			l[i] = dagJSON(e)
+		}
+		return l
+	case data.CIDLink:
+		return map[string]any{"/": v.String()}
+	case *data.CIDLink:
+		return map[string]any{"/": v.String()}
+	case data.Bytes:
+		return map[string]any{"/": map[string]any{"bytes": base64.RawStdEncoding.EncodeToString(v)}}
+	case data.Blob:
+		if v.Size < 0 {
+			// legacy blobs reference a CID string
+			return v
+		}
+		return map[string]any{
+			"$type":    "blob",
+			"ref":      map[string]any{"/": v.Ref.String()},
+			"mimeType": v.MimeType,
+			"size":     v.Size,
+		}
+	default:
+		return v
+	}
+}
@@ -0,0 +1,255 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+
+	"github.com/blebbit/atmunge/pkg/util/fakepds"
+)
+
+// exportDuckDB builds the DuckDB of a fake account with posts, a like, a follow and an unknown record
+func exportDuckDB(t *testing.T, pds *fakepds.Server, handle string) (string, string) {
+	t.Helper()
+	recs := fakepds.SampleRecords(handle, 3)
+	recs["app.bsky.feed.post/3kquote"] = map[string]any{
+		"$type":     "app.bsky.feed.post",
+		"text":      "look",
+		"langs":     []any{"en", "de"},
+		"createdAt": "2024-02-01T12:00:00.000Z",
+		"embed": map[string]any{
+			"$type":  "app.bsky.embed.record",
+			"record": map[string]any{"uri": "at://did:plc:other/app.bsky.feed.post/3kabc", "cid": "bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"},
+		},
+	}
+	recs["app.bsky.feed.like/3klike"] = map[string]any{
+		"$type":     "app.bsky.feed.like",
+		"subject":   map[string]any{"uri": "at://did:plc:other/app.bsky.feed.post/3kabc", "cid": "bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"},
+		"createdAt": "2024-02-01T12:00:00.000Z",
+	}
+	recs["app.bsky.graph.follow/3kfollow"] = map[string]any{
+		"$type":     "app.bsky.graph.follow",
+		"subject":   "did:plc:other",
+		"createdAt": "2024-02-01T12:00:00.000Z",
+	}
+	recs["com.example.thing/1"] = map[string]any{"$type": "com.example.thing", "n": 1}
+
+	acct, err := pds.CreateRepo(handle, recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	car, err := acct.CAR("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	carPath := filepath.Join(dir, "repo.car")
+	if err := os.WriteFile(carPath, car, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "repo.duckdb")
+	if err := CarToDuckDB(context.Background(), carPath, dbPath, UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return acct.DID, dbPath
+}
+
+func TestExportParquet(t *testing.T) {
+	// duckdb migrations are read relative to the repo root
+	t.Chdir("../..")
+	ctx := context.Background()
+	pds := fakepds.New()
+	defer pds.Close()
+
+	alice, aliceDB := exportDuckDB(t, pds, "alice.test")
+	out := t.TempDir()
+	stats, err := Export(ctx, aliceDB, out, ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// profile, post, like, follow and the unknown collection
+	if stats.Collections != 5 || stats.Records != 8 {
+		t.Errorf("got stats %+v, want 5 collections of 8 records", stats)
+	}
+
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	parquet := func(name string) string {
+		return quoteLiteral(filepath.Join(out, name))
+	}
+
+	var text, quote, langs string
+	var images int
+	err = db.QueryRow(`SELECT text, quote_uri, array_to_string(langs, ','), image_count FROM read_parquet(`+parquet("app.bsky.feed.post.parquet")+`) WHERE rkey = '3kquote'`).
+		Scan(&text, &quote, &langs, &images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "look" || quote != "at://did:plc:other/app.bsky.feed.post/3kabc" || langs != "en,de" || images != 0 {
+		t.Errorf("got post %q %q %q %d", text, quote, langs, images)
+	}
+	var subject, did string
+	if err := db.QueryRow(`SELECT subject_did, did FROM read_parquet(`+parquet("app.bsky.feed.like.parquet")+`)`).Scan(&subject, &did); err != nil {
+		t.Fatal(err)
+	}
+	if subject != "did:plc:other" || did != alice {
+		t.Errorf("got like of %s by %s", subject, did)
+	}
+	var typ string
+	if err := db.QueryRow(`SELECT typeof(created_at) FROM read_parquet(` + parquet("app.bsky.graph.follow.parquet") + `)`).Scan(&typ); err != nil {
+		t.Fatal(err)
+	}
+	if typ != "TIMESTAMP WITH TIME ZONE" {
+		t.Errorf("got created_at of type %s, want a timestamp", typ)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT record->>'$.n' FROM read_parquet(` + parquet("com.example.thing.parquet") + `)`).Scan(&n); err != nil || n != 1 {
+		t.Errorf("got unknown record field %d, want the JSON record: %v", n, err)
+	}
+
+	// accounts exported to one dir are partitioned by did
+	bob, bobDB := exportDuckDB(t, pds, "bob.test")
+	hive := t.TempDir()
+	for _, p := range []string{aliceDB, bobDB, aliceDB} {
+		if _, err := Export(ctx, p, hive, ExportOptions{Partition: true, Collections: []string{"app.bsky.feed.post"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := db.Query(`SELECT did, count(*) FROM read_parquet(` + quoteLiteral(filepath.Join(hive, "app.bsky.feed.post", "*", "*.parquet")) + `, hive_partitioning = true) GROUP BY did`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := map[string]int{}
+	for rows.Next() {
+		var did string
+		var n int
+		if err := rows.Scan(&did, &n); err != nil {
+			t.Fatal(err)
+		}
+		got[did] = n
+	}
+	if len(got) != 2 || got[alice] != 4 || got[bob] != 4 {
+		t.Errorf("got posts by did %v, want 4 each for %s and %s", got, alice, bob)
+	}
+	if _, err := os.Stat(filepath.Join(hive, "app.bsky.graph.follow")); !os.IsNotExist(err) {
+		t.Error("exported a collection that was not asked for")
+	}
+}
+
+func TestExportCar(t *testing.T) {
+	pds := fakepds.New()
+	defer pds.Close()
+
+	recs := fakepds.SampleRecords("alice.test", 2)
+	acct, err := pds.CreateRepo("alice.test", recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := pds.AddBlob(acct.DID, []byte("avatar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pds.Commit(acct.DID, fakepds.Records{
+		"app.bsky.actor.profile/self": {
+			"$type":  "app.bsky.actor.profile",
+			"avatar": data.Blob{Ref: data.CIDLink(c), MimeType: "image/png", Size: 6},
+		},
+		"com.example.thing/1": {"$type": "com.example.thing", "sig": data.Bytes("\x01\x02")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	car, err := acct.CAR("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "repo.car")
+	if err := os.WriteFile(path, car, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// compressed CARs are read the same
+	if _, err := CompressCar(path, DefaultCompressLevel); err != nil {
+		t.Fatal(err)
+	}
+
+	export := func(opts ExportOptions) []map[string]any {
+		t.Helper()
+		var buf bytes.Buffer
+		stats, err := ExportCar(context.Background(), path, &buf, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lines []map[string]any
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var l map[string]any
+			if err := dec.Decode(&l); err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, l)
+		}
+		if int64(len(lines)) != stats.Records {
+			t.Errorf("got %d lines, stats counted %d", len(lines), stats.Records)
+		}
+		return lines
+	}
+
+	lines := export(ExportOptions{})
+	if len(lines) != 4 {
+		t.Fatalf("got %d records, want 4", len(lines))
+	}
+	profile := lines[0]
+	if profile["uri"] != "at://"+acct.DID+"/app.bsky.actor.profile/self" || profile["collection"] != "app.bsky.actor.profile" || profile["rkey"] != "self" {
+		t.Errorf("got profile line %v", profile)
+	}
+	ref := profile["record"].(map[string]any)["avatar"].(map[string]any)["ref"].(map[string]any)
+	if ref["$link"] != c.String() {
+		t.Errorf("got avatar ref %v, want the atproto $link", ref)
+	}
+
+	lines = export(ExportOptions{Collections: []string{"app.bsky.actor.profile", "com.example.thing"}, DAGJSON: true})
+	if len(lines) != 2 {
+		t.Fatalf("got %d records filtered, want 2", len(lines))
+	}
+	ref = lines[0]["record"].(map[string]any)["avatar"].(map[string]any)["ref"].(map[string]any)
+	if ref["/"] != c.String() {
+		t.Errorf("got avatar ref %v, want a DAG-JSON link", ref)
+	}
+	sig := lines[1]["record"].(map[string]any)["sig"].(map[string]any)["/"].(map[string]any)
+	if sig["bytes"] != "AQI" {
+		t.Errorf("got sig %v, want DAG-JSON bytes", sig)
+	}
+
+	// read without inflating the compressed CAR
+	if !IsCompressedCar(path) {
+		t.Error("the compressed CAR was inflated by the export")
+	}
+
+	// the compressed CAR can be named directly
+	raw := path
+	path += CompressedSuffix
+	if lines := export(ExportOptions{}); len(lines) != 4 {
+		t.Fatalf("got %d records from %s, want 4", len(lines), path)
+	}
+	path = raw
+
+	// an indexed CARv2 is read in place
+	bs, err := OpenCarStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.Close()
+	if lines := export(ExportOptions{}); len(lines) != 4 {
+		t.Fatalf("got %d records from the CARv2, want 4", len(lines))
+	}
+}
@@ -0,0 +1,120 @@
+package repo
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// HistoryFile is the per-account sync history, kept next to repo.car
+const HistoryFile = "history.jsonl"
+
+// HistoryEntry is one sync that moved the repo to a new commit.
+type HistoryEntry struct {
+	Rev     string         `json:"rev"`
+	Commit  string         `json:"commit"`
+	PrevRev string         `json:"prevRev,omitempty"`
+	Time    time.Time      `json:"time"`
+	Ops     []RecordChange `json:"ops"`
+}
+
+// HistoryOp is a record change and the sync it was seen in.
+type HistoryOp struct {
+	RecordChange
+	Rev  string
+	Time time.Time
+}
+
+// AppendHistory adds an entry to the history file at path, creating it if needed.
+func AppendHistory(path string, entry HistoryEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode history entry: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open history file: %w", err)
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to append history entry: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadHistory reads the history file at path, oldest first.
+// A missing file is an empty history, and a torn last line from a crash is skipped.
+func ReadHistory(path string) ([]HistoryEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer f.Close()
+
+	var entries []HistoryEntry
+	var pending error
+	sc := bufio.NewScanner(f)
+	// the first sync lists every record in the repo
+	sc.Buffer(nil, 1<<30)
+	for line := 1; sc.Scan(); line++ {
+		if pending != nil {
+			return nil, pending
+		}
+		var e HistoryEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			pending = fmt.Errorf("invalid history entry on line %d: %w", line, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history file: %w", err)
+	}
+	return entries, nil
+}
+
+// RecordHistory lists the changes to one record, oldest first.
+func RecordHistory(entries []HistoryEntry, collection, rkey string) []HistoryOp {
+	var ops []HistoryOp
+	for _, e := range entries {
+		for _, op := range e.Ops {
+			if op.Collection == collection && op.Rkey == rkey {
+				ops = append(ops, HistoryOp{RecordChange: op, Rev: e.Rev, Time: e.Time})
+			}
+		}
+	}
+	return ops
+}
+
+// RecordsAt replays the history up to and including rev,
+// returning the record paths (collection/rkey) and CIDs the repo had at that point.
+func RecordsAt(entries []HistoryEntry, rev string) map[string]cid.Cid {
+	records := make(map[string]cid.Cid)
+	for _, e := range entries {
+		if e.Rev > rev {
+			break
+		}
+		for _, op := range e.Ops {
+			path := op.Collection + "/" + op.Rkey
+			if op.Op == OpDelete {
+				delete(records, path)
+			} else {
+				records[path] = op.CID
+			}
+		}
+	}
+	return records
+}
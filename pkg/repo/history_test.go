@@ -0,0 +1,81 @@
+package repo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), HistoryFile)
+	recordCid := func(s string) cid.Cid {
+		c, err := cid.V1Builder{Codec: cid.DagCBOR, MhType: multihash.SHA2_256}.Sum([]byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	post1, post2, profile := recordCid("post1"), recordCid("post2"), recordCid("profile")
+	profile2 := recordCid("profile2")
+
+	entries := []HistoryEntry{
+		{Rev: "3kaaaaaaaaaa2", Time: time.Now(), Ops: []RecordChange{
+			{Op: OpCreate, Collection: "app.bsky.actor.profile", Rkey: "self", CID: profile},
+			{Op: OpCreate, Collection: "app.bsky.feed.post", Rkey: "1", CID: post1},
+		}},
+		{Rev: "3kaaaaaaaaab2", PrevRev: "3kaaaaaaaaaa2", Time: time.Now(), Ops: []RecordChange{
+			{Op: OpUpdate, Collection: "app.bsky.actor.profile", Rkey: "self", CID: profile2, Prev: profile},
+			{Op: OpCreate, Collection: "app.bsky.feed.post", Rkey: "2", CID: post2},
+		}},
+		{Rev: "3kaaaaaaaaac2", PrevRev: "3kaaaaaaaaab2", Time: time.Now(), Ops: []RecordChange{
+			{Op: OpDelete, Collection: "app.bsky.feed.post", Rkey: "1", Prev: post1},
+		}},
+	}
+	for _, e := range entries {
+		if err := AppendHistory(path, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a crash mid-append leaves a torn line, which is skipped
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"rev":"3kaaa`)
+	f.Close()
+
+	got, err := ReadHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("got %d entries, want 3", len(got))
+	}
+	if !got[1].Ops[0].Prev.Equals(profile) {
+		t.Errorf("prev cid did not round trip: %s", got[1].Ops[0].Prev)
+	}
+
+	ops := RecordHistory(got, "app.bsky.feed.post", "1")
+	if len(ops) != 2 || ops[1].Op != OpDelete || ops[1].Rev != "3kaaaaaaaaac2" {
+		t.Errorf("got post 1 history %+v, want created then deleted at the third rev", ops)
+	}
+
+	at := RecordsAt(got, "3kaaaaaaaaab2")
+	if len(at) != 3 || !at["app.bsky.actor.profile/self"].Equals(profile2) {
+		t.Errorf("got records %v at the second rev", at)
+	}
+	at = RecordsAt(got, "3kaaaaaaaaac2")
+	if _, ok := at["app.bsky.feed.post/1"]; ok || len(at) != 2 {
+		t.Errorf("got records %v at the third rev, want post 1 deleted", at)
+	}
+
+	// a missing file is an empty history
+	none, err := ReadHistory(filepath.Join(t.TempDir(), HistoryFile))
+	if err != nil || len(none) != 0 {
+		t.Errorf("got %v, %v for a missing history", none, err)
+	}
+}
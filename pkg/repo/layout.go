@@ -0,0 +1,227 @@
+package repo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/blebbit/atmunge/pkg/storage"
+)
+
+// repo directory layouts
+const (
+	// LayoutFlat keeps every account in <root>/<did>/
+	LayoutFlat = "flat"
+	// LayoutSharded spreads accounts over <root>/<ab>/<cd>/<did>/,
+	// where abcd are the first hex digits of the sha256 of the DID
+	LayoutSharded = "sharded"
+)
+
+// Layout resolves where an account's files are kept under the repo data dir,
+// and the matching keys in repo storage.
+type Layout struct {
+	Kind string
+	Root string
+}
+
+// NewLayout checks the layout kind, empty is flat.
+func NewLayout(kind, root string) (Layout, error) {
+	switch kind {
+	case "":
+		kind = LayoutFlat
+	case LayoutFlat, LayoutSharded:
+	default:
+		return Layout{}, fmt.Errorf("unknown repo layout %q, use %s or %s", kind, LayoutFlat, LayoutSharded)
+	}
+	return Layout{Kind: kind, Root: root}, nil
+}
+
+// Key is the slash separated path of an account file relative to the root,
+// or of the account directory when name is empty.
+func (l Layout) Key(did, name string) string {
+	key := did
+	if l.Kind == LayoutSharded {
+		sum := sha256.Sum256([]byte(did))
+		h := hex.EncodeToString(sum[:2])
+		key = h[:2] + "/" + h[2:] + "/" + did
+	}
+	if name != "" {
+		key += "/" + name
+	}
+	return key
+}
+
+// Dir is the account directory.
+func (l Layout) Dir(did string) string {
+	return filepath.Join(l.Root, filepath.FromSlash(l.Key(did, "")))
+}
+
+// Path is a file in the account directory, name may have slashes (blobs/<cid>.blob).
+func (l Layout) Path(did, name string) string {
+	return filepath.Join(l.Root, filepath.FromSlash(l.Key(did, name)))
+}
+
+// ParseKey splits a key of this layout into the DID and the file name within the account,
+// ok is false for keys that do not belong to the layout.
+func (l Layout) ParseKey(key string) (did, name string, ok bool) {
+	parts := strings.SplitN(key, "/", 4)
+	if l.Kind == LayoutSharded {
+		if len(parts) < 3 {
+			return "", "", false
+		}
+		did = parts[2]
+		if l.Key(did, "") != path.Join(parts[:3]...) {
+			return "", "", false
+		}
+		if len(parts) == 4 {
+			name = parts[3]
+		}
+	} else {
+		did, name, _ = strings.Cut(key, "/")
+	}
+	if !strings.HasPrefix(did, "did:") {
+		return "", "", false
+	}
+	return did, name, true
+}
+
+// Walk calls fn with every account directory under the root.
+func (l Layout) Walk(fn func(did, dir string) error) error {
+	dirs := []string{l.Root}
+	if l.Kind == LayoutSharded {
+		// two levels of shard directories
+		for range 2 {
+			var next []string
+			for _, d := range dirs {
+				entries, err := os.ReadDir(d)
+				if err != nil {
+					return err
+				}
+				for _, e := range entries {
+					if e.IsDir() && isShard(e.Name()) {
+						next = append(next, filepath.Join(d, e.Name()))
+					}
+				}
+			}
+			dirs = next
+		}
+	}
+
+	for _, d := range dirs {
+		entries, err := os.ReadDir(d)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !e.IsDir() || !strings.HasPrefix(e.Name(), "did:") {
+				continue
+			}
+			if err := fn(e.Name(), filepath.Join(d, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isShard(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// RelayoutStats counts what a relayout moved.
+type RelayoutStats struct {
+	Moved   int
+	Skipped int
+}
+
+// Relayout moves the account directories under from.Root to where the to layout expects them.
+// Each account is moved with a single rename, so an interrupted relayout can be rerun,
+// accounts already moved are no longer found in the old layout.
+// An account present in both layouts is left alone and reported through skip.
+func Relayout(from, to Layout, skip func(did string, err error)) (*RelayoutStats, error) {
+	if from.Kind == to.Kind && filepath.Clean(from.Root) == filepath.Clean(to.Root) {
+		return &RelayoutStats{}, nil
+	}
+
+	stats := &RelayoutStats{}
+	err := from.Walk(func(did, dir string) error {
+		dst := to.Dir(did)
+		if _, err := os.Stat(dst); err == nil {
+			// an empty destination is left over from an earlier run
+			if os.Remove(dst) != nil {
+				stats.Skipped++
+				skip(did, fmt.Errorf("%s already exists", dst))
+				return nil
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		if err := os.Rename(dir, dst); err != nil {
+			return fmt.Errorf("failed to move %s: %w", did, err)
+		}
+		stats.Moved++
+		removeEmptyParents(filepath.Dir(dir), from.Root)
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// RelayoutStore moves the objects of accounts in the from layout to their keys in the to layout.
+// Objects are copied before the old key is deleted, so an interrupted run can be repeated.
+func RelayoutStore(ctx context.Context, store storage.Storage, from, to Layout) (*RelayoutStats, error) {
+	stats := &RelayoutStats{}
+	if from.Kind == to.Kind {
+		return stats, nil
+	}
+	err := store.List(ctx, "", func(oi storage.ObjectInfo) error {
+		did, name, ok := from.ParseKey(oi.Key)
+		if !ok || name == "" {
+			return nil
+		}
+		key := to.Key(did, name)
+		// the copy may have finished before an interruption
+		if info, err := store.Stat(ctx, key); err == nil && info.Size == oi.Size {
+			stats.Skipped++
+			return store.Delete(ctx, oi.Key)
+		} else if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+
+		rc, err := store.Get(ctx, oi.Key)
+		if err != nil {
+			return err
+		}
+		err = store.Put(ctx, key, rc, oi.Size)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy %s: %w", oi.Key, err)
+		}
+		stats.Moved++
+		return store.Delete(ctx, oi.Key)
+	})
+	return stats, err
+}
+
+// removeEmptyParents removes dir and its parents up to root while they are empty
+func removeEmptyParents(dir, root string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/blebbit/atmunge/pkg/storage"
+)
+
+func TestLayoutKeys(t *testing.T) {
+	did := "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	flat, _ := NewLayout("", "/data")
+	sharded, _ := NewLayout(LayoutSharded, "/data")
+
+	if got := flat.Path(did, "repo.car"); got != "/data/"+did+"/repo.car" {
+		t.Errorf("flat path = %s", got)
+	}
+	key := sharded.Key(did, "blobs/bafkrei.blob")
+	if got, want := sharded.Path(did, "blobs/bafkrei.blob"), filepath.Join("/data", key); got != want {
+		t.Errorf("sharded path = %s, want %s", got, want)
+	}
+
+	for _, l := range []Layout{flat, sharded} {
+		gotDid, name, ok := l.ParseKey(key)
+		if l.Kind == LayoutFlat {
+			// sharded keys are not flat keys
+			if ok {
+				t.Errorf("flat parsed sharded key %s", key)
+			}
+			continue
+		}
+		if !ok || gotDid != did || name != "blobs/bafkrei.blob" {
+			t.Errorf("ParseKey(%s) = %s, %s, %v", key, gotDid, name, ok)
+		}
+	}
+	if _, _, ok := sharded.ParseKey("00/00/" + did + "/repo.car"); ok {
+		t.Error("sharded parsed a key in the wrong shard")
+	}
+	if _, _, ok := sharded.ParseKey(did + "/repo.car"); ok {
+		t.Error("sharded parsed a flat key")
+	}
+	if _, err := NewLayout("nested", "/data"); err == nil {
+		t.Error("expected an error for an unknown layout")
+	}
+}
+
+func TestRelayout(t *testing.T) {
+	root := t.TempDir()
+	flat, _ := NewLayout(LayoutFlat, root)
+	sharded, _ := NewLayout(LayoutSharded, root)
+
+	dids := []string{"did:plc:aaa", "did:plc:bbb", "did:web:example.com"}
+	for _, did := range dids {
+		if err := os.MkdirAll(flat.Path(did, "blobs"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(flat.Path(did, "repo.car"), []byte(did), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an earlier run was interrupted after creating the destination directory
+	if err := os.MkdirAll(sharded.Dir(dids[0]), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := Relayout(flat, sharded, func(did string, err error) { t.Errorf("skipped %s: %v", did, err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Moved != 3 {
+		t.Errorf("moved %d accounts, want 3", stats.Moved)
+	}
+	walked := func(l Layout) []string {
+		t.Helper()
+		var got []string
+		err := l.Walk(func(did, dir string) error {
+			if dir != l.Dir(did) {
+				t.Errorf("walked %s at %s, want %s", did, dir, l.Dir(did))
+			}
+			got = append(got, did)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		return got
+	}
+	if got := walked(flat); len(got) != 0 {
+		t.Errorf("accounts left in the flat layout: %v", got)
+	}
+	if got := walked(sharded); len(got) != 3 {
+		t.Errorf("got sharded accounts %v, want all 3", got)
+	}
+	for _, did := range dids {
+		if b, err := os.ReadFile(sharded.Path(did, "repo.car")); err != nil || string(b) != did {
+			t.Errorf("%s repo.car not moved: %v", did, err)
+		}
+	}
+
+	// and back, removing the emptied shard directories
+	if _, err := Relayout(sharded, flat, func(did string, err error) { t.Errorf("skipped %s: %v", did, err) }); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("got %d entries in the flat root, want only the 3 accounts", len(entries))
+	}
+
+	// an account in both layouts is left for the operator
+	if err := os.MkdirAll(sharded.Dir(dids[1]), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sharded.Path(dids[1], "repo.car"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var skipped []string
+	stats, err = Relayout(flat, sharded, func(did string, err error) { skipped = append(skipped, did) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Moved != 2 || len(skipped) != 1 || skipped[0] != dids[1] {
+		t.Errorf("got moved=%d skipped=%v, want 2 moved and %s skipped", stats.Moved, skipped, dids[1])
+	}
+}
+
+func TestRelayoutStore(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewLocal(t.TempDir())
+	flat, _ := NewLayout(LayoutFlat, "")
+	sharded, _ := NewLayout(LayoutSharded, "")
+
+	did := "did:plc:aaa"
+	for _, name := range []string{"repo.car", "history.jsonl", "blobs/bafkrei.blob"} {
+		if err := store.Put(ctx, flat.Key(did, name), bytes.NewReader([]byte(name)), int64(len(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := RelayoutStore(ctx, store, flat, sharded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Moved != 3 {
+		t.Errorf("moved %d objects, want 3", stats.Moved)
+	}
+	for _, name := range []string{"repo.car", "history.jsonl", "blobs/bafkrei.blob"} {
+		if ok, _ := storage.Exists(ctx, store, sharded.Key(did, name)); !ok {
+			t.Errorf("%s not at its sharded key", name)
+		}
+		if ok, _ := storage.Exists(ctx, store, flat.Key(did, name)); ok {
+			t.Errorf("%s still at its flat key", name)
+		}
+	}
+}
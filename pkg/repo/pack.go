@@ -0,0 +1,215 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/data"
+	indigoRepo "github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/bluesky-social/indigo/atproto/repo/mst"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+	"github.com/multiformats/go-multihash"
+)
+
+// PackOptions describe the commit PackDir writes.
+type PackOptions struct {
+	// DID of the repo
+	DID string
+	// Rev of the commit, a TID, the current time when empty
+	Rev string
+	// Key signs the commit, it is left unsigned when nil (for fixtures, other readers reject it)
+	Key crypto.PrivateKey
+}
+
+// PackStats describe the CAR PackDir wrote.
+type PackStats struct {
+	Records int
+	Blocks  int
+	Root    cid.Cid
+	Rev     string
+}
+
+// PackDir builds a repo CAR from a directory of records in the layout repo unpack writes,
+// <collection>/<rkey>.json, the inverse of unpack. Records are atproto JSON ($link, $bytes, blobs).
+// The CARv1 is written to w with the commit block first, then the MST and records,
+// so the same records, rev and key always pack to the same bytes.
+func PackDir(ctx context.Context, dir string, w io.Writer, opts PackOptions) (*PackStats, error) {
+	if _, err := syntax.ParseDID(opts.DID); err != nil {
+		return nil, fmt.Errorf("invalid repo did: %w", err)
+	}
+	rev := opts.Rev
+	if rev == "" {
+		rev = syntax.NewTIDNow(0).String()
+	} else if _, err := syntax.ParseTID(rev); err != nil {
+		return nil, fmt.Errorf("invalid rev: %w", err)
+	}
+
+	stats := &PackStats{Rev: rev}
+	bs := &packBlocks{index: make(map[cid.Cid]int)}
+	tree := mst.NewEmptyTree()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := strings.TrimSuffix(filepath.ToSlash(rel), ".json")
+		if _, _, err := syntax.ParseRepoPath(key); err != nil {
+			return fmt.Errorf("%s is not a <collection>/<rkey>.json record: %w", rel, err)
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rec, err := data.UnmarshalJSON(b)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", rel, err)
+		}
+		c, err := bs.putData(ctx, rec)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", rel, err)
+		}
+		if _, err := tree.Insert([]byte(key), c); err != nil {
+			return fmt.Errorf("failed to insert %s: %w", key, err)
+		}
+		stats.Records++
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	root, err := tree.WriteDiffBlocks(ctx, bs)
+	if err != nil {
+		return stats, fmt.Errorf("failed to write MST blocks: %w", err)
+	}
+	commit := indigoRepo.Commit{
+		DID:     opts.DID,
+		Version: indigoRepo.ATPROTO_REPO_VERSION,
+		Data:    *root,
+		Rev:     rev,
+	}
+	if opts.Key != nil {
+		if err := commit.Sign(opts.Key); err != nil {
+			return stats, fmt.Errorf("failed to sign commit: %w", err)
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := commit.MarshalCBOR(buf); err != nil {
+		return stats, fmt.Errorf("failed to marshal commit: %w", err)
+	}
+	commitBlock, err := newDagCborBlock(buf.Bytes())
+	if err != nil {
+		return stats, err
+	}
+	stats.Root = commitBlock.Cid()
+
+	cw, err := storage.NewWritable(w, []cid.Cid{stats.Root}, car.WriteAsCarV1(true))
+	if err != nil {
+		return stats, fmt.Errorf("failed to create CAR writer: %w", err)
+	}
+	for _, blk := range append([]blocks.Block{commitBlock}, bs.blocks...) {
+		if err := cw.Put(ctx, blk.Cid().KeyString(), blk.RawData()); err != nil {
+			return stats, fmt.Errorf("failed to write block: %w", err)
+		}
+		stats.Blocks++
+	}
+	return stats, nil
+}
+
+func newDagCborBlock(b []byte) (blocks.Block, error) {
+	c, err := cid.V1Builder{Codec: cid.DagCBOR, MhType: multihash.SHA2_256}.Sum(b)
+	if err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithCid(b, c)
+}
+
+// packBlocks is an append only blockstore keeping the order blocks were put in, for the MST writes
+type packBlocks struct {
+	blocks []blocks.Block
+	index  map[cid.Cid]int
+}
+
+// putData encodes a record, records with the same contents share a block
+func (bs *packBlocks) putData(ctx context.Context, rec map[string]any) (cid.Cid, error) {
+	b, err := data.MarshalCBOR(rec)
+	if err != nil {
+		return cid.Undef, err
+	}
+	blk, err := newDagCborBlock(b)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return blk.Cid(), bs.Put(ctx, blk)
+}
+
+func (bs *packBlocks) Put(_ context.Context, blk blocks.Block) error {
+	if _, ok := bs.index[blk.Cid()]; !ok {
+		bs.index[blk.Cid()] = len(bs.blocks)
+		bs.blocks = append(bs.blocks, blk)
+	}
+	return nil
+}
+
+func (bs *packBlocks) PutMany(ctx context.Context, blks []blocks.Block) error {
+	for _, blk := range blks {
+		if err := bs.Put(ctx, blk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bs *packBlocks) Get(_ context.Context, c cid.Cid) (blocks.Block, error) {
+	i, ok := bs.index[c]
+	if !ok {
+		return nil, fmt.Errorf("block not found: %s", c)
+	}
+	return bs.blocks[i], nil
+}
+
+func (bs *packBlocks) Has(_ context.Context, c cid.Cid) (bool, error) {
+	_, ok := bs.index[c]
+	return ok, nil
+}
+
+func (bs *packBlocks) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	blk, err := bs.Get(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	return len(blk.RawData()), nil
+}
+
+func (bs *packBlocks) DeleteBlock(context.Context, cid.Cid) error {
+	return fmt.Errorf("pack blockstore is append only")
+}
+
+func (bs *packBlocks) AllKeysChan(context.Context) (<-chan cid.Cid, error) {
+	ch := make(chan cid.Cid, len(bs.blocks))
+	for _, blk := range bs.blocks {
+		ch <- blk.Cid()
+	}
+	close(ch)
+	return ch, nil
+}
+
+func (bs *packBlocks) HashOnRead(bool) {}
@@ -0,0 +1,183 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ipfs/go-cid"
+
+	"github.com/blebbit/atmunge/pkg/util/fakepds"
+)
+
+func TestPackDir(t *testing.T) {
+	// duckdb migrations are read relative to the repo root
+	t.Chdir("../..")
+	ctx := context.Background()
+	pds := fakepds.New()
+	defer pds.Close()
+
+	recs := fakepds.SampleRecords("alice.test", 20)
+	recs["app.bsky.actor.profile/self"]["avatar"] = data.Blob{
+		Ref:      data.CIDLink(cid.MustParse("bafkreiabgxv3rxk6r2n5fmnz4wsfcvpvvvo5aukzphgvsmvrrg3hqbutcu")),
+		MimeType: "image/png",
+		Size:     1234,
+	}
+	recs["com.example.thing/1"] = map[string]any{"$type": "com.example.thing", "sig": data.Bytes("\x01\x02")}
+	acct, err := pds.CreateRepo("alice.test", recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	car, err := acct.CAR("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, err := ReadRepoFromCar(bytes.NewReader(car))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unpack the records as repo unpack does
+	dir := filepath.Join(t.TempDir(), acct.DID, "unpacked")
+	err = orig.MST.Walk(func(k []byte, v cid.Cid) error {
+		col, rkey, err := syntax.ParseRepoPath(string(k))
+		if err != nil {
+			return err
+		}
+		b, _, err := orig.GetRecordBytes(ctx, col, rkey)
+		if err != nil {
+			return err
+		}
+		rec, err := data.UnmarshalCBOR(b)
+		if err != nil {
+			return err
+		}
+		js, err := json.MarshalIndent(rec, "", "  ")
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, string(k)+".json")
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		return os.WriteFile(path, js, 0o644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pack := func(opts PackOptions) ([]byte, *PackStats) {
+		t.Helper()
+		var buf bytes.Buffer
+		stats, err := PackDir(ctx, dir, &buf, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes(), stats
+	}
+	packed, stats := pack(PackOptions{DID: acct.DID, Rev: acct.Rev()})
+	if stats.Records != 22 || stats.Rev != acct.Rev() {
+		t.Errorf("got stats %+v, want 22 records at %s", stats, acct.Rev())
+	}
+	if again, _ := pack(PackOptions{DID: acct.DID, Rev: acct.Rev()}); !bytes.Equal(again, packed) {
+		t.Error("packing the same records twice differs")
+	}
+
+	// the same records give the same tree, unsigned commits are only read when allowed
+	if _, err := ReadRepoFromCar(bytes.NewReader(packed)); err == nil {
+		t.Error("read an unsigned commit by default")
+	}
+	r, err := readRepoFromCar(bytes.NewReader(packed), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origRoot, err := orig.MST.RootCID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := r.MST.RootCID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equals(*origRoot) || r.DID.String() != acct.DID {
+		t.Errorf("got tree %s for %s, want %s for %s", root, r.DID, origRoot, acct.DID)
+	}
+
+	// unsigned commits fail verification, signed ones verify
+	path := filepath.Join(t.TempDir(), "repo.car")
+	if err := os.WriteFile(path, packed, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := OpenCarStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := acct.Key.PublicKey()
+	if _, err := VerifyCommit(bs, bs.Root(), pub); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("got %v verifying an unsigned commit, want ErrBadSignature", err)
+	}
+	bs.Close()
+
+	signed, _ := pack(PackOptions{DID: acct.DID, Key: acct.Key})
+	signedPath := filepath.Join(t.TempDir(), "repo.car")
+	if err := os.WriteFile(signedPath, signed, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bs, err = OpenCarStore(signedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	if _, err := VerifyCommit(bs, bs.Root(), pub); err != nil {
+		t.Errorf("signed commit rejected: %v", err)
+	}
+
+	// the converters read packed repos
+	dbPath := filepath.Join(t.TempDir(), "repo.duckdb")
+	if err := CarToDuckDB(ctx, signedPath, dbPath, UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := InitDuckDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM records").Scan(&n); err != nil || n != 22 {
+		t.Errorf("got %d records in duckdb, want 22: %v", n, err)
+	}
+
+	// unsigned fixtures are converted when allowed
+	unsigned, err := OpenCarStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsigned.Close()
+	fixtureDir := t.TempDir()
+	for name, fn := range map[string]func(context.Context, Blockstore, string, UpdateOptions) (*DBUpdate, error){
+		"repo.duckdb": UpdateDuckDB,
+		"repo.sqlite": UpdateSQLite,
+	} {
+		dbPath := filepath.Join(fixtureDir, name)
+		if _, err := fn(ctx, unsigned, dbPath, UpdateOptions{}); err == nil {
+			t.Errorf("%s: converted an unsigned commit by default", name)
+		}
+		up, err := fn(ctx, unsigned, dbPath, UpdateOptions{AllowUnsigned: true})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if up.Created != 22 || up.Rev != acct.Rev() {
+			t.Errorf("%s: got %+v, want 22 records created at %s", name, up, acct.Rev())
+		}
+	}
+
+	if _, err := PackDir(ctx, dir, &bytes.Buffer{}, PackOptions{DID: "alice"}); err == nil {
+		t.Error("packed with an invalid did")
+	}
+}
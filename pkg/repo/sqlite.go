@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/bluesky-social/indigo/atproto/data"
-	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/ipfs/go-cid"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -26,12 +25,26 @@ type Record struct {
 	RKey      string    `gorm:"column:rkey;primaryKey"`
 	CID       string    `gorm:"column:cid;primaryKey"`
 	Record    string    `gorm:"record"`
+	// Extra holds the lexicon validation result, {"validation": {"status": ..., "error": ...}}
+	Extra string `gorm:"column:extra"`
 }
 
 func (Record) TableName() string {
 	return "records"
 }
 
+// RepoState is the commit the records of a SQLite database reflect, updates diff from it.
+type RepoState struct {
+	DID       string `gorm:"column:did;primaryKey"`
+	Rev       string `gorm:"column:rev"`
+	Root      string `gorm:"column:root"`
+	UpdatedAt time.Time
+}
+
+func (RepoState) TableName() string {
+	return "repo_state"
+}
+
 func InitSQLite(dbPath string) (*gorm.DB, error) {
 	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
 		return nil, fmt.Errorf("failed to create sqlite directory: %w", err)
@@ -44,26 +57,24 @@ func InitSQLite(dbPath string) (*gorm.DB, error) {
 		return nil, fmt.Errorf("failed to open sqlite db: %w", err)
 	}
 
-	if err := db.AutoMigrate(&Record{}); err != nil {
+	if err := db.AutoMigrate(&Record{}, &RepoState{}); err != nil {
 		return nil, fmt.Errorf("failed to migrate sqlite db: %w", err)
 	}
 
 	return db, nil
 }
 
-func CarToSQLite(carPath string, dbPath string) error {
-	f, err := os.Open(carPath)
+// CarToSQLite brings the SQLite database at dbPath up to the commit of a CAR, raw or compressed, see UpdateSQLite.
+func CarToSQLite(carPath string, dbPath string, opts UpdateOptions) error {
+	bs, err := OpenMemBlockstore(carPath)
 	if err != nil {
 		return fmt.Errorf("failed to open car file: %w", err)
 	}
-	defer f.Close()
-
-	r, err := ReadRepoFromCar(f)
-	if err != nil {
-		return fmt.Errorf("failed to read repo from car: %w", err)
+	if !bs.Root().Defined() {
+		return fmt.Errorf("car file %s does not exist or has no root", carPath)
 	}
-
-	return RepoToSQLite(r, dbPath)
+	_, err = UpdateSQLite(context.Background(), bs, dbPath, opts)
+	return err
 }
 
 func RepoToSQLite(r *indigoRepo.Repo, dbPath string) error {
@@ -83,110 +94,162 @@ func BlockstoreToSQLite(ctx context.Context, bsMap map[cid.Cid][]byte, root cid.
 	return RepoToSQLite(r, dbPath)
 }
 
-func SaveNewRecordsToSQLite(ctx context.Context, bsMap map[cid.Cid][]byte, newBlocks map[cid.Cid][]byte, root cid.Cid, dbPath string) error {
-	r, err := BlockstoreToRepo(ctx, bsMap, root)
+// UpdateSQLite brings the records in the SQLite database at dbPath to the root commit of bs,
+// diffing from the commit it reflects as UpdateDuckDB does. The database holds a single account.
+func UpdateSQLite(ctx context.Context, bs Blockstore, dbPath string, opts UpdateOptions) (*DBUpdate, error) {
+	commit, err := loadCommit(bs, bs.Root(), opts.AllowUnsigned)
 	if err != nil {
-		return fmt.Errorf("failed to convert blockstore to repo: %w", err)
+		return nil, err
 	}
+	up := &DBUpdate{DID: commit.DID, Rev: commit.Rev}
 
 	db, err := InitSQLite(dbPath)
 	if err != nil {
-		return fmt.Errorf("failed to init sqlite: %w", err)
+		return nil, fmt.Errorf("failed to init sqlite: %w", err)
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		defer sqlDB.Close()
 	}
 
-	return r.MST.Walk(func(k []byte, v cid.Cid) error {
-		if _, isNew := newBlocks[v]; !isNew {
-			return nil
-		}
+	var state RepoState
+	if err := db.WithContext(ctx).Where("did = ?", up.DID).Limit(1).Find(&state).Error; err != nil {
+		return nil, fmt.Errorf("failed to read repo state: %w", err)
+	}
+	if state.Root == bs.Root().String() {
+		return up, nil
+	}
 
-		col, rkey, err := syntax.ParseRepoPath(string(k))
+	changes, ok := changesSince(bs, state.Root, opts)
+	if !ok {
+		before, err := sqliteRecordCids(ctx, db)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		recBytes, _, err := r.GetRecordBytes(ctx, col, rkey)
+		after, err := recordCids(bs, bs.Root(), opts.AllowUnsigned)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		changes = diffRecordCids(before, after)
+		up.Full = true
+	}
 
-		rec, err := data.UnmarshalCBOR(recBytes)
-		if err != nil {
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := applySQLiteChanges(tx, up, changes, blockstoreRecordGetter(bs)); err != nil {
 			return err
 		}
+		return tx.Save(&RepoState{DID: up.DID, Rev: up.Rev, Root: bs.Root().String()}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return up, nil
+}
 
-		recJSON, err := json.Marshal(rec)
-		if err != nil {
+// SaveRecordsToSQLite brings the records in db to those of a loaded repo,
+// comparing the records table with its tree.
+func SaveRecordsToSQLite(ctx context.Context, r *indigoRepo.Repo, db *gorm.DB) error {
+	before, err := sqliteRecordCids(ctx, db)
+	if err != nil {
+		return err
+	}
+	after, err := repoRecordCids(r)
+	if err != nil {
+		return err
+	}
+
+	up := &DBUpdate{DID: r.DID.String(), Full: true}
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := applySQLiteChanges(tx, up, diffRecordCids(before, after), repoRecordGetter(ctx, r)); err != nil {
 			return err
 		}
+		// the repo has no commit to diff from on the next update
+		return tx.Where("did = ?", up.DID).Delete(&RepoState{}).Error
+	})
+}
 
-		dbRec := Record{
-			IndexedAt: time.Now(),
-			NSID:      col.String(),
-			RKey:      rkey.String(),
-			CID:       v.String(),
-			Record:    string(recJSON),
+// sqliteRecordCids maps the record paths (collection/rkey) in the records table to their CIDs
+func sqliteRecordCids(ctx context.Context, db *gorm.DB) (map[string]cid.Cid, error) {
+	var rows []Record
+	if err := db.WithContext(ctx).Select("nsid", "rkey", "cid").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to list records: %w", err)
+	}
+	records := make(map[string]cid.Cid, len(rows))
+	for _, row := range rows {
+		path := row.NSID + "/" + row.RKey
+		if _, ok := records[path]; ok {
+			// several versions, left by saves before updates replaced records
+			records[path] = cid.Undef
+			continue
 		}
+		records[path], _ = cid.Decode(row.CID)
+	}
+	return records, nil
+}
 
-		// Attempt to extract createdAt from the record
-		if ca, ok := rec["createdAt"].(string); ok {
-			if t, err := time.Parse(time.RFC3339, ca); err == nil {
-				dbRec.CreatedAt = t
+// applySQLiteChanges writes record changes to the records table
+func applySQLiteChanges(tx *gorm.DB, up *DBUpdate, changes []RecordChange, get recordGetter) error {
+	for _, rc := range changes {
+		if rc.Op != OpCreate {
+			if err := tx.Where("nsid = ? AND rkey = ?", rc.Collection, rc.Rkey).Delete(&Record{}).Error; err != nil {
+				return fmt.Errorf("failed to delete %s/%s: %w", rc.Collection, rc.Rkey, err)
 			}
 		}
-
-		// Attempt to extract indexedAt from the record
-		if ca, ok := rec["indexedAt"].(string); ok {
-			if t, err := time.Parse(time.RFC3339, ca); err == nil {
-				dbRec.IndexedAt = t
+		if rc.Op != OpDelete {
+			recBytes, err := get(rc)
+			if err != nil {
+				return fmt.Errorf("failed to read %s/%s: %w", rc.Collection, rc.Rkey, err)
+			}
+			dbRec, err := newSQLiteRecord(rc, recBytes)
+			if err != nil {
+				return fmt.Errorf("failed to decode %s/%s: %w", rc.Collection, rc.Rkey, err)
+			}
+			if err := tx.Save(dbRec).Error; err != nil {
+				return err
 			}
 		}
-
-		return db.Save(&dbRec).Error
-	})
+		up.countChange(rc)
+	}
+	return nil
 }
 
-func SaveRecordsToSQLite(ctx context.Context, r *indigoRepo.Repo, db *gorm.DB) error {
-	return r.MST.Walk(func(k []byte, v cid.Cid) error {
-		col, rkey, err := syntax.ParseRepoPath(string(k))
-		if err != nil {
-			return err
-		}
-		recBytes, _, err := r.GetRecordBytes(ctx, col, rkey)
-		if err != nil {
-			return err
-		}
-
-		rec, err := data.UnmarshalCBOR(recBytes)
-		if err != nil {
-			return err
-		}
+// newSQLiteRecord decodes a record block into a row with its timestamps and validation result
+func newSQLiteRecord(rc RecordChange, recBytes []byte) (*Record, error) {
+	rec, err := data.UnmarshalCBOR(recBytes)
+	if err != nil {
+		return nil, err
+	}
 
-		recJSON, err := json.Marshal(rec)
-		if err != nil {
-			return err
-		}
+	recJSON, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	extra, err := validationExtra(rc.Collection, rec)
+	if err != nil {
+		return nil, err
+	}
 
-		dbRec := Record{
-			IndexedAt: time.Now(),
-			NSID:      col.String(),
-			RKey:      rkey.String(),
-			CID:       v.String(),
-			Record:    string(recJSON),
-		}
+	dbRec := &Record{
+		IndexedAt: time.Now(),
+		NSID:      rc.Collection,
+		RKey:      rc.Rkey,
+		CID:       rc.CID.String(),
+		Record:    string(recJSON),
+		Extra:     extra,
+	}
 
-		// Attempt to extract createdAt from the record
-		if ca, ok := rec["createdAt"].(string); ok {
-			if t, err := time.Parse(time.RFC3339, ca); err == nil {
-				dbRec.CreatedAt = t
-			}
+	// Attempt to extract createdAt from the record
+	if ca, ok := rec["createdAt"].(string); ok {
+		if t, err := time.Parse(time.RFC3339, ca); err == nil {
+			dbRec.CreatedAt = t
 		}
+	}
 
-		// Attempt to extract indexedAt from the record
-		if ca, ok := rec["indexedAt"].(string); ok {
-			if t, err := time.Parse(time.RFC3339, ca); err == nil {
-				dbRec.IndexedAt = t
-			}
+	// Attempt to extract indexedAt from the record
+	if ca, ok := rec["indexedAt"].(string); ok {
+		if t, err := time.Parse(time.RFC3339, ca); err == nil {
+			dbRec.IndexedAt = t
 		}
+	}
 
-		return db.Save(&dbRec).Error
-	})
+	return dbRec, nil
 }
@@ -0,0 +1,63 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"slices"
+
+	appsql "github.com/blebbit/atmunge/pkg/sql"
+)
+
+// TypedTables names the DuckDB table of each lexicon with typed columns,
+// filled from the records table by the query in sql/acct/tables/<nsid>.sql.
+// Rows keep the cuid of their record, to join records (extra) and refs (source).
+var TypedTables = map[string]string{
+	"app.bsky.actor.profile":  "profiles",
+	"app.bsky.feed.like":      "likes",
+	"app.bsky.feed.post":      "posts",
+	"app.bsky.feed.repost":    "reposts",
+	"app.bsky.graph.block":    "blocks",
+	"app.bsky.graph.follow":   "follows",
+	"app.bsky.graph.list":     "lists",
+	"app.bsky.graph.listitem": "listitems",
+}
+
+// execer runs statements on a *sql.DB or in a *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// typedTableQuery is the SELECT over the records table filling the typed table of a lexicon
+func typedTableQuery(nsid string) (string, error) {
+	b, err := appsql.SQLFiles.ReadFile("acct/tables/" + nsid + ".sql")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// UpdateTypedTables brings the typed tables in line with the records table, creating missing ones,
+// run by the converters after the records changed. Rows of removed records are deleted and
+// records without a row added, so only the changes are extracted from the JSON.
+func UpdateTypedTables(ctx context.Context, db execer) error {
+	for _, nsid := range slices.Sorted(maps.Keys(TypedTables)) {
+		query, err := typedTableQuery(nsid)
+		if err != nil {
+			return err
+		}
+		table := TypedTables[nsid]
+		stmts := []string{
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s AS %s", table, query),
+			fmt.Sprintf("DELETE FROM %s WHERE cuid NOT IN (SELECT cuid FROM records)", table),
+			fmt.Sprintf("INSERT INTO %[1]s BY NAME SELECT * FROM (%[2]s) WHERE cuid NOT IN (SELECT cuid FROM %[1]s)", table, query),
+		}
+		for _, stmt := range stmts {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("failed to update %s: %w", table, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package repo
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+
+	appsql "github.com/blebbit/atmunge/pkg/sql"
+	"github.com/blebbit/atmunge/pkg/util/fakepds"
+)
+
+func TestTypedTables(t *testing.T) {
+	// duckdb migrations are read relative to the repo root
+	t.Chdir("../..")
+	pds := fakepds.New()
+	defer pds.Close()
+
+	// every query has a table name and every table a query
+	files, err := fs.Glob(appsql.SQLFiles, "acct/tables/*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(TypedTables) {
+		t.Errorf("got %d table queries for %d typed tables", len(files), len(TypedTables))
+	}
+	for _, f := range files {
+		nsid := strings.TrimSuffix(strings.TrimPrefix(f, "acct/tables/"), ".sql")
+		if _, ok := TypedTables[nsid]; !ok {
+			t.Errorf("no typed table named for %s", f)
+		}
+	}
+
+	did, dbPath := exportDuckDB(t, pds, "alice.test")
+	db, err := InitDuckDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	counts := map[string]int{"posts": 4, "likes": 1, "follows": 1, "profiles": 1, "blocks": 0}
+	for table, want := range counts {
+		var n int
+		if err := db.QueryRow("SELECT count(*) FROM " + table).Scan(&n); err != nil || n != want {
+			t.Errorf("got %d rows in %s, want %d: %v", n, table, want, err)
+		}
+	}
+
+	// columns are typed, and rows join their record by cuid
+	var langs []any
+	var quote, status string
+	err = db.QueryRow(`
+		SELECT p.langs, p.quote_uri, r.extra->>'$.validation.status'
+		FROM posts AS p JOIN records AS r USING (cuid)
+		WHERE p.rkey = '3kquote'
+	`).Scan(&langs, &quote, &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(langs) != 2 || langs[1] != "de" || quote != "at://did:plc:other/app.bsky.feed.post/3kabc" || status != "valid" {
+		t.Errorf("got langs %v, quote %s, status %s", langs, quote, status)
+	}
+	var subject, owner string
+	if err := db.QueryRow("SELECT subject_did, did FROM likes").Scan(&subject, &owner); err != nil || subject != "did:plc:other" || owner != did {
+		t.Errorf("got like of %s by %s: %v", subject, owner, err)
+	}
+
+	// the adhoc queries read the typed tables
+	for _, name := range []string{"count_likes_by_did", "count_posts_by_lang"} {
+		q, err := appsql.SQLFiles.ReadFile("acct/query/" + name + ".sql")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := db.Query(string(q))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		n := 0
+		for rows.Next() {
+			n++
+		}
+		rows.Close()
+		if n == 0 {
+			t.Errorf("%s returned no rows", name)
+		}
+	}
+
+	// reconverting replaces the rows
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := CarToDuckDB(t.Context(), strings.TrimSuffix(dbPath, ".duckdb")+".car", dbPath, UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	db, err = InitDuckDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM posts").Scan(&n); err != nil || n != 4 {
+		t.Errorf("got %d posts after converting again, want 4: %v", n, err)
+	}
+}
@@ -0,0 +1,85 @@
+package repo
+
+import (
+	"context"
+
+	indigoRepo "github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ipfs/go-cid"
+)
+
+// UpdateOptions configure an account database update.
+type UpdateOptions struct {
+	// AllowUnsigned accepts commits without a signature, such as the fixtures repo pack writes
+	AllowUnsigned bool
+}
+
+// DBUpdate describes what bringing an account database up to a commit changed.
+type DBUpdate struct {
+	DID string
+	// Rev of the commit the database now reflects
+	Rev     string
+	Created int
+	Updated int
+	Deleted int
+	// Full is set when the records were compared with the tree rather than diffed
+	// from the previous commit, which was unknown or whose blocks are gone
+	Full bool
+}
+
+// recordGetter reads the block of a created or updated record
+type recordGetter func(rc RecordChange) ([]byte, error)
+
+// changesSince diffs the root of bs against the commit a database reflects,
+// ok is false when there is no previous commit or its MST can not be read (compacted CARs)
+func changesSince(bs Blockstore, prevRoot string, opts UpdateOptions) ([]RecordChange, bool) {
+	if prevRoot == "" {
+		return nil, false
+	}
+	prev, err := cid.Decode(prevRoot)
+	if err != nil {
+		return nil, false
+	}
+	changes, err := Diff(bs, prev, bs, bs.Root(), DiffOptions{AllowUnsigned: opts.AllowUnsigned})
+	if err != nil {
+		return nil, false
+	}
+	return changes, true
+}
+
+// countChange tallies a change applied to a database
+func (up *DBUpdate) countChange(rc RecordChange) {
+	switch rc.Op {
+	case OpCreate:
+		up.Created++
+	case OpUpdate:
+		up.Updated++
+	case OpDelete:
+		up.Deleted++
+	}
+}
+
+// repoRecordCids maps the record paths of a loaded repo to their CIDs, as recordCids does for a blockstore
+func repoRecordCids(r *indigoRepo.Repo) (map[string]cid.Cid, error) {
+	records := make(map[string]cid.Cid)
+	err := r.MST.Walk(func(k []byte, v cid.Cid) error {
+		records[string(k)] = v
+		return nil
+	})
+	return records, err
+}
+
+// repoRecordGetter reads records from a loaded repo
+func repoRecordGetter(ctx context.Context, r *indigoRepo.Repo) recordGetter {
+	return func(rc RecordChange) ([]byte, error) {
+		b, _, err := r.GetRecordBytes(ctx, syntax.NSID(rc.Collection), syntax.RecordKey(rc.Rkey))
+		return b, err
+	}
+}
+
+// blockstoreRecordGetter reads records from a blockstore
+func blockstoreRecordGetter(bs Blockstore) recordGetter {
+	return func(rc RecordChange) ([]byte, error) {
+		return bs.Get(rc.CID)
+	}
+}
@@ -0,0 +1,176 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blebbit/atmunge/pkg/util/fakepds"
+)
+
+func TestUpdateDatabases(t *testing.T) {
+	// duckdb migrations are read relative to the repo root
+	t.Chdir("../..")
+	ctx := context.Background()
+	pds := fakepds.New()
+	defer pds.Close()
+
+	recs := fakepds.SampleRecords("alice.test", 3)
+	recs["app.bsky.feed.like/3klike"] = map[string]any{
+		"$type":     "app.bsky.feed.like",
+		"subject":   map[string]any{"uri": "at://did:plc:other/app.bsky.feed.post/3kabc", "cid": "bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"},
+		"createdAt": "2024-02-01T12:00:00.000Z",
+	}
+	acct, err := pds.CreateRepo("alice.test", recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	carPath := filepath.Join(dir, "repo.car")
+	dbPath := filepath.Join(dir, "repo.duckdb")
+	sqlitePath := filepath.Join(dir, "repo.sqlite")
+
+	// sync merges the account's new commits into the CAR, as repo-sync does
+	sync := func() {
+		t.Helper()
+		bs, err := OpenCarStore(carPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		update, err := acct.CAR(bs.Rev())
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, _, _, err := MergeUpdate(bs, bytes.NewReader(update))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bs.Commit(root); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update := func(fn func(context.Context, Blockstore, string, UpdateOptions) (*DBUpdate, error), path string) *DBUpdate {
+		t.Helper()
+		bs, err := OpenCarStore(carPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		up, err := fn(ctx, bs, path, UpdateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if up.Rev != acct.Rev() {
+			t.Errorf("updated %s to rev %s, want %s", path, up.Rev, acct.Rev())
+		}
+		return up
+	}
+	count := func(query string, args ...any) int {
+		t.Helper()
+		db, err := InitDuckDB(dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		var n int
+		if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return n
+	}
+
+	sync()
+	if up := update(UpdateDuckDB, dbPath); !up.Full || up.Created != 5 {
+		t.Errorf("got %+v converting a new database, want 5 created from the whole tree", up)
+	}
+	if up := update(UpdateSQLite, sqlitePath); !up.Full || up.Created != 5 {
+		t.Errorf("got %+v converting a new sqlite database", up)
+	}
+
+	// delete a post, update the profile and follow someone
+	var deleted string
+	for path := range recs {
+		if c, rkey, _ := strings.Cut(path, "/"); c == "app.bsky.feed.post" {
+			deleted = rkey
+			break
+		}
+	}
+	_, err = pds.Commit(acct.DID, fakepds.Records{
+		"app.bsky.feed.post/" + deleted: nil,
+		"app.bsky.actor.profile/self":   {"$type": "app.bsky.actor.profile", "displayName": "alice 2"},
+		"app.bsky.graph.follow/3kfollow": {
+			"$type":     "app.bsky.graph.follow",
+			"subject":   "did:plc:other",
+			"createdAt": "2024-02-01T12:00:00.000Z",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync()
+
+	up := update(UpdateDuckDB, dbPath)
+	if up.Full || up.Created != 1 || up.Updated != 1 || up.Deleted != 1 {
+		t.Errorf("got %+v, want 1 created, updated and deleted from the MST diff", up)
+	}
+	if n := count("SELECT count(*) FROM records"); n != 5 {
+		t.Errorf("got %d records, want 5", n)
+	}
+	if n := count("SELECT count(*) FROM posts WHERE rkey = ?", deleted); n != 0 {
+		t.Error("deleted post still in posts")
+	}
+	if n := count("SELECT count(*) FROM profiles WHERE display_name = 'alice 2'"); n != 1 {
+		t.Error("profile not updated in profiles")
+	}
+	if n := count("SELECT count(*) FROM follows"); n != 1 {
+		t.Error("follow not added to follows")
+	}
+	if n := count("SELECT count(*) FROM repo_state WHERE rev = ?", acct.Rev()); n != 1 {
+		t.Error("repo_state does not hold the synced rev")
+	}
+	if up := update(UpdateDuckDB, dbPath); up.Created+up.Updated+up.Deleted != 0 {
+		t.Errorf("got %+v updating to the same commit", up)
+	}
+
+	// a ref extracted by acct index from the like
+	db, err := InitDuckDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO refs (source, did, nsid, rkey) SELECT cuid, 'did:plc:other', 'app.bsky.feed.post', '3kabc' FROM records WHERE rkey = '3klike'`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unlike, then compact, the commit the databases reflect is gone so the tree is compared
+	if _, err := pds.Commit(acct.DID, fakepds.Records{"app.bsky.feed.like/3klike": nil}); err != nil {
+		t.Fatal(err)
+	}
+	sync()
+	if _, err := CompactCar(carPath, 0, DefaultCompressLevel); err != nil {
+		t.Fatal(err)
+	}
+	if up := update(UpdateDuckDB, dbPath); !up.Full || up.Deleted != 1 || up.Created+up.Updated != 0 {
+		t.Errorf("got %+v after compaction, want 1 deleted from the whole tree", up)
+	}
+	if n := count("SELECT count(*) FROM likes") + count("SELECT count(*) FROM refs"); n != 0 {
+		t.Error("the like's typed row or refs survived its deletion")
+	}
+
+	up = update(UpdateSQLite, sqlitePath)
+	if !up.Full || up.Created != 1 || up.Updated != 1 || up.Deleted != 2 {
+		t.Errorf("got %+v updating sqlite, want 1 created, 1 updated and 2 deleted", up)
+	}
+	sdb, err := InitSQLite(sqlitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	if err := sdb.Model(&Record{}).Count(&n).Error; err != nil || n != 4 {
+		t.Errorf("got %d sqlite records, want 4: %v", n, err)
+	}
+}
@@ -0,0 +1,156 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/blebbit/atmunge/pkg/lexicon"
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ipfs/go-cid"
+)
+
+// ValidationCounts count the validation statuses of a collection's records.
+type ValidationCounts struct {
+	Valid   int64 `json:"valid"`
+	Invalid int64 `json:"invalid"`
+	Unknown int64 `json:"unknown"`
+}
+
+// InvalidRecord is a record that failed validation.
+type InvalidRecord struct {
+	URI   string `json:"uri"`
+	Error string `json:"error"`
+}
+
+// ValidationReport is the result of validating the records of one or more repos.
+type ValidationReport struct {
+	Records int64
+	// Collections holds the counts by NSID
+	Collections map[string]*ValidationCounts
+	// Invalid lists the invalid records, up to the limit given to ValidateCar
+	Invalid []InvalidRecord
+}
+
+// NewValidationReport returns an empty report.
+func NewValidationReport() *ValidationReport {
+	return &ValidationReport{Collections: make(map[string]*ValidationCounts)}
+}
+
+// Add counts a record's validation result.
+func (rep *ValidationReport) Add(nsid string, res lexicon.Result) {
+	c, ok := rep.Collections[nsid]
+	if !ok {
+		c = &ValidationCounts{}
+		rep.Collections[nsid] = c
+	}
+	switch res.Status {
+	case lexicon.StatusValid:
+		c.Valid++
+	case lexicon.StatusInvalid:
+		c.Invalid++
+	default:
+		c.Unknown++
+	}
+	rep.Records++
+}
+
+// Merge adds the counts of another report, for aggregating across accounts.
+// Invalid records are not merged.
+func (rep *ValidationReport) Merge(other *ValidationReport) {
+	for nsid, o := range other.Collections {
+		c, ok := rep.Collections[nsid]
+		if !ok {
+			c = &ValidationCounts{}
+			rep.Collections[nsid] = c
+		}
+		c.Valid += o.Valid
+		c.Invalid += o.Invalid
+		c.Unknown += o.Unknown
+	}
+	rep.Records += other.Records
+}
+
+// Totals sums the counts of all collections.
+func (rep *ValidationReport) Totals() ValidationCounts {
+	var t ValidationCounts
+	for _, c := range rep.Collections {
+		t.Valid += c.Valid
+		t.Invalid += c.Invalid
+		t.Unknown += c.Unknown
+	}
+	return t
+}
+
+// NSIDs lists the collections in the report, most invalid records first.
+func (rep *ValidationReport) NSIDs() []string {
+	nsids := slices.Sorted(maps.Keys(rep.Collections))
+	slices.SortStableFunc(nsids, func(a, b string) int {
+		return int(rep.Collections[b].Invalid - rep.Collections[a].Invalid)
+	})
+	return nsids
+}
+
+// ValidateCar checks the records of a CAR, raw or compressed, against the lexicons of v,
+// keeping up to maxInvalid invalid records in the report (all when negative).
+func ValidateCar(ctx context.Context, carPath string, v *lexicon.Validator, maxInvalid int) (*ValidationReport, error) {
+	f, err := OpenCar(carPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open car file: %w", err)
+	}
+	defer f.Close()
+
+	r, err := ReadRepoFromCar(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repo from car: %w", err)
+	}
+
+	rep := NewValidationReport()
+	err = r.MST.Walk(func(k []byte, _ cid.Cid) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		col, rkey, err := syntax.ParseRepoPath(string(k))
+		if err != nil {
+			return err
+		}
+		recBytes, _, err := r.GetRecordBytes(ctx, col, rkey)
+		if err != nil {
+			return err
+		}
+
+		var res lexicon.Result
+		rec, err := data.UnmarshalCBOR(recBytes)
+		if err != nil {
+			// not atproto data, so it can not match a schema either
+			res = lexicon.Result{Status: lexicon.StatusInvalid, Error: err.Error()}
+		} else {
+			res = v.Validate(col.String(), rec)
+		}
+		rep.Add(col.String(), res)
+		if res.Status == lexicon.StatusInvalid && (maxInvalid < 0 || len(rep.Invalid) < maxInvalid) {
+			rep.Invalid = append(rep.Invalid, InvalidRecord{
+				URI:   "at://" + r.DID.String() + "/" + string(k),
+				Error: res.Error,
+			})
+		}
+		return nil
+	})
+	return rep, err
+}
+
+// validationExtra is the extra column of a converted record, holding its validation result
+func validationExtra(nsid string, rec map[string]any) (string, error) {
+	v, err := lexicon.Default()
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(map[string]any{"validation": v.Validate(nsid, rec)})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
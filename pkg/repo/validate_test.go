@@ -0,0 +1,110 @@
+package repo
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blebbit/atmunge/pkg/lexicon"
+	"github.com/blebbit/atmunge/pkg/util/fakepds"
+)
+
+func TestValidateRecords(t *testing.T) {
+	// duckdb migrations are read relative to the repo root
+	t.Chdir("../..")
+	ctx := context.Background()
+	pds := fakepds.New()
+	defer pds.Close()
+
+	recs := fakepds.SampleRecords("alice.test", 3)
+	recs["app.bsky.feed.post/3knodate"] = map[string]any{"$type": "app.bsky.feed.post", "text": "when?"}
+	recs["app.bsky.feed.like/3kbadlike"] = map[string]any{
+		"$type":     "app.bsky.feed.like",
+		"subject":   map[string]any{"uri": "https://example.com", "cid": "bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"},
+		"createdAt": "2024-02-01T12:00:00.000Z",
+	}
+	recs["com.example.thing/1"] = map[string]any{"$type": "com.example.thing", "n": 1}
+	acct, err := pds.CreateRepo("alice.test", recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	car, err := acct.CAR("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	carPath := filepath.Join(t.TempDir(), "repo.car")
+	if err := os.WriteFile(carPath, car, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := lexicon.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := ValidateCar(ctx, carPath, v, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	posts := rep.Collections["app.bsky.feed.post"]
+	if posts == nil || posts.Valid != 3 || posts.Invalid != 1 {
+		t.Errorf("got post counts %+v, want 3 valid and 1 invalid", posts)
+	}
+	if c := rep.Collections["com.example.thing"]; c == nil || c.Unknown != 1 {
+		t.Errorf("got unknown collection counts %+v", c)
+	}
+	if tot := rep.Totals(); tot != (ValidationCounts{Valid: 4, Invalid: 2, Unknown: 1}) || rep.Records != 7 {
+		t.Errorf("got totals %+v over %d records", tot, rep.Records)
+	}
+	if len(rep.Invalid) != 1 || !strings.HasPrefix(rep.Invalid[0].URI, "at://"+acct.DID+"/") {
+		t.Errorf("got invalid records %+v, want 1 (the limit)", rep.Invalid)
+	}
+
+	// network wide counts sum the accounts
+	total := NewValidationReport()
+	total.Merge(rep)
+	total.Merge(rep)
+	if c := total.Collections["app.bsky.feed.like"]; c.Invalid != 2 || total.Records != 14 {
+		t.Errorf("got merged like counts %+v over %d records", c, total.Records)
+	}
+	if nsids := total.NSIDs(); nsids[len(nsids)-1] != "com.example.thing" {
+		t.Errorf("got order %v, want collections without invalid records last", nsids)
+	}
+
+	// the converters store the result in extra
+	dbPath := filepath.Join(t.TempDir(), "repo.duckdb")
+	if err := CarToDuckDB(ctx, carPath, dbPath, UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := InitDuckDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var status, msg string
+	err = db.QueryRow(`SELECT extra->>'$.validation.status', extra->>'$.validation.error' FROM records WHERE rkey = '3knodate'`).Scan(&status, &msg)
+	if err != nil || status != lexicon.StatusInvalid || !strings.Contains(msg, "createdAt") {
+		t.Errorf("got %s (%s) in duckdb, want invalid: %v", status, msg, err)
+	}
+	var invalid int
+	if err := db.QueryRow(`SELECT count(*) FROM records WHERE extra->>'$.validation.status' = 'invalid'`).Scan(&invalid); err != nil || invalid != 2 {
+		t.Errorf("got %d invalid records in duckdb, want 2: %v", invalid, err)
+	}
+
+	sqlitePath := filepath.Join(t.TempDir(), "repo.sqlite")
+	if err := CarToSQLite(carPath, sqlitePath, UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	sdb, err := InitSQLite(sqlitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec Record
+	if err := sdb.Where("nsid = ? AND rkey = ?", "com.example.thing", "1").First(&rec).Error; err != nil {
+		t.Fatal(err)
+	}
+	if rec.Extra != `{"validation":{"status":"unknown"}}` {
+		t.Errorf("got extra %s in sqlite", rec.Extra)
+	}
+}
@@ -0,0 +1,64 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	indigoRepo "github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/ipfs/go-cid"
+)
+
+// ErrBadSignature is returned when a commit is not signed by the account's signing key.
+var ErrBadSignature = errors.New("commit signature does not match the signing key")
+
+// VerifyCommit checks the structure of the commit at root and its signature against key.
+func VerifyCommit(bs Blockstore, root cid.Cid, key crypto.PublicKey) (*indigoRepo.Commit, error) {
+	// a missing signature is reported as ErrBadSignature below, rather than as a malformed commit
+	commit, err := decodeCommit(bs, root)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckCommit(commit, true); err != nil {
+		return nil, fmt.Errorf("invalid commit %s: %w", root, err)
+	}
+	if err := commit.VerifySignature(key); err != nil {
+		return commit, fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	return commit, nil
+}
+
+// TreeReport describes the blocks under a commit.
+type TreeReport struct {
+	DID     string
+	Rev     string
+	Nodes   int
+	Records int
+	// Missing lists the MST nodes and records referenced but not in the store
+	Missing []cid.Cid
+}
+
+// VerifyTree walks the MST of the commit at root, checking every node and record is present.
+func VerifyTree(bs Blockstore, root cid.Cid) (*TreeReport, error) {
+	commit, err := loadCommit(bs, root, false)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &TreeReport{DID: commit.DID, Rev: commit.Rev}
+	err = walkMST(bs, commit.Data, func(_ string, c cid.Cid, node, has bool) (bool, error) {
+		switch {
+		case !has:
+			report.Missing = append(report.Missing, c)
+		case node:
+			report.Nodes++
+		default:
+			report.Records++
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,76 @@
+package repo
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+
+	"github.com/blebbit/atmunge/pkg/util/fakepds"
+)
+
+func TestVerify(t *testing.T) {
+	pds := fakepds.New()
+	defer pds.Close()
+
+	acct, err := pds.CreateRepo("alice.test", fakepds.SampleRecords("alice.test", 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	update, err := acct.CAR("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := OpenMemBlockstore(filepath.Join(t.TempDir(), "repo.car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _, _, err := MergeUpdate(bs, bytes.NewReader(update))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := acct.Key.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyCommit(bs, root, pub); err != nil {
+		t.Errorf("valid signature rejected: %v", err)
+	}
+	other, err := crypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _ := other.PublicKey()
+	if _, err := VerifyCommit(bs, root, otherPub); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("got %v, want ErrBadSignature", err)
+	}
+
+	report, err := VerifyTree(bs, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records != 11 || report.Nodes == 0 || len(report.Missing) != 0 {
+		t.Errorf("got %+v, want 11 records and nothing missing", report)
+	}
+
+	// drop a record block
+	r, err := BlockstoreToRepo(t.Context(), bs.Blocks, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rc, err := r.GetRecordBytes(t.Context(), "app.bsky.actor.profile", "self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(bs.Blocks, *rc)
+	report, err = VerifyTree(bs, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Missing) != 1 || !report.Missing[0].Equals(*rc) {
+		t.Errorf("got missing %v, want %s", report.Missing, rc)
+	}
+}
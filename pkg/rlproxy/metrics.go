@@ -0,0 +1,43 @@
+package rlproxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	breakerClosed   = 0
+	breakerOpen     = 1
+	breakerHalfOpen = 2
+)
+
+var requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "rlproxy_requests_total",
+	Help: "Counter of requests sent per host, by status code.",
+}, []string{"host", "code"})
+
+var retriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "rlproxy_retries_total",
+	Help: "Counter of retried requests per host.",
+}, []string{"host"})
+
+var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "rlproxy_request_duration_seconds",
+	Help:    "Time to response headers per host.",
+	Buckets: prometheus.ExponentialBucketsRange(0.01, 120, 16),
+}, []string{"host"})
+
+var inflight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "rlproxy_inflight_requests",
+	Help: "Number of in-flight requests per host.",
+}, []string{"host"})
+
+var breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "rlproxy_breaker_state",
+	Help: "Circuit breaker state per host (0 closed, 1 open, 2 half-open).",
+}, []string{"host"})
+
+var rateLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "rlproxy_rate_limit",
+	Help: "Current rate limit per host in requests per second.",
+}, []string{"host"})
@@ -0,0 +1,117 @@
+package rlproxy
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how the proxy retries transient failures.
+// Callers opt in per request with WithRetry.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of tries, including the first
+	MaxAttempts int
+	// BaseDelay is the initial backoff, doubled for each attempt
+	BaseDelay time.Duration
+	// MaxDelay caps both the backoff and any server requested wait
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is a reasonable policy for PDS and relay requests.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   time.Second,
+	MaxDelay:    time.Minute,
+}
+
+type retryKey struct{}
+
+// WithRetry returns a context which enables retries for requests made with it.
+func WithRetry(ctx context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryKey{}, policy)
+}
+
+func retryFromContext(ctx context.Context) (RetryPolicy, bool) {
+	policy, ok := ctx.Value(retryKey{}).(RetryPolicy)
+	return policy, ok && policy.MaxAttempts > 1
+}
+
+// shouldRetry reports whether a response status is transient
+func shouldRetry(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns the exponential backoff with full jitter for the given attempt (starting at 1)
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	if d <= 0 {
+		d = time.Second
+	}
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if p.MaxDelay > 0 && d >= p.MaxDelay {
+			d = p.MaxDelay
+			break
+		}
+	}
+	return time.Duration(rand.Int64N(int64(d)) + 1)
+}
+
+// delay determines how long to wait before the next attempt,
+// preferring what the server told us over our own backoff
+func (p RetryPolicy) delay(attempt int, resp *http.Response) time.Duration {
+	d := p.backoff(attempt)
+	if resp != nil {
+		if wait, ok := serverDelay(resp.Header); ok {
+			d = wait
+		}
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// serverDelay reads Retry-After (seconds or HTTP date) and falls back to ratelimit-reset (unix seconds)
+func serverDelay(h http.Header) (time.Duration, bool) {
+	if ra := h.Get("Retry-After"); ra != "" {
+		if secs, err := strconv.Atoi(ra); err == nil {
+			return time.Duration(secs) * time.Second, true
+		}
+		if t, err := http.ParseTime(ra); err == nil {
+			return max(time.Until(t), 0), true
+		}
+	}
+
+	if h.Get("ratelimit-remaining") == "0" {
+		if reset, err := strconv.ParseInt(h.Get("ratelimit-reset"), 10, 64); err == nil {
+			return max(time.Until(time.Unix(reset, 0)), 0), true
+		}
+	}
+
+	return 0, false
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
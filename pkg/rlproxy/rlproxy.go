@@ -2,6 +2,8 @@ package rlproxy
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -11,63 +13,228 @@ import (
 	"golang.org/x/time/rate"
 )
 
-// limiter manages rate limiting for a single domain.
+// ErrCircuitOpen is returned without sending the request while a host's circuit breaker is open.
+var ErrCircuitOpen = errors.New("rlproxy: circuit breaker open")
+
+// Options configures the per-host behavior of a Proxy.
+type Options struct {
+	// MaxConcurrency bounds in-flight requests per host (group), 0 is unbounded
+	MaxConcurrency int
+	// BreakerThreshold is the number of consecutive failures that opens a host's circuit, 0 disables it
+	BreakerThreshold int
+	// BreakerCooldown is how long a circuit stays open before letting a probe request through
+	BreakerCooldown time.Duration
+	// HostGroups are hostname patterns (e.g. "*.host.bsky.network")
+	// whose matching hosts share one limiter, concurrency cap, and breaker
+	HostGroups []string
+	// Overrides pin the rate for a host (or group) with a policy like "3000;w=300",
+	// ignoring what the host reports in its ratelimit-policy header
+	Overrides map[string]string
+}
+
+// DefaultOptions has no concurrency cap, and a breaker that opens after 5 failures for a minute.
+var DefaultOptions = Options{
+	BreakerThreshold: 5,
+	BreakerCooldown:  time.Minute,
+}
+
+// limiter manages rate limiting, concurrency, and circuit breaking for a single domain (or group).
 type limiter struct {
+	key string
+
 	mu    sync.Mutex
 	rl    *rate.Limiter
 	reset time.Time
+	// set by an override, not changed by headers
+	pinned bool
+
+	// concurrency cap, nil when unbounded
+	sem chan struct{}
+
+	// circuit breaker
+	failures  int
+	openUntil time.Time
+	probing   bool
 }
 
 // Proxy is a concurrency-safe, per-domain, rate-limited HTTP client.
 type Proxy struct {
 	client   *http.Client
+	opts     Options
 	limiters sync.Map // map[string]*limiter
 }
 
-// New creates a new Proxy.
+// New creates a new Proxy with the DefaultOptions.
 // It can be customized with a different http.Client.
 func New(client *http.Client) *Proxy {
+	return NewWithOptions(client, DefaultOptions)
+}
+
+// NewWithOptions creates a new Proxy with the given per-host options.
+func NewWithOptions(client *http.Client, opts Options) *Proxy {
 	if client == nil {
 		client = &http.Client{}
 	}
 	return &Proxy{
 		client: client,
+		opts:   opts,
 	}
 }
 
 // Do sends an HTTP request, waiting for the rate limiter for the request's host.
+// If the request context carries a RetryPolicy (see WithRetry),
+// transient failures (connection errors, 429, 5xx) are retried with backoff,
+// and an open circuit is waited out when its cool-down ends within MaxDelay.
 func (p *Proxy) Do(req *http.Request) (*http.Response, error) {
-	host := req.URL.Hostname()
-	l := p.getLimiter(host)
+	l := p.getLimiter(p.hostKey(req.URL.Hostname()))
 
-	err := l.Wait(req.Context())
+	ctx := req.Context()
+	policy, retry := retryFromContext(ctx)
+	// we can only resend a body we can get again
+	if req.Body != nil && req.GetBody == nil {
+		retry = false
+	}
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			retriesTotal.WithLabelValues(l.key).Inc()
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+		}
+
+		resp, err := p.do(ctx, l, req)
+		if errors.Is(err, ErrCircuitOpen) {
+			// the request was not sent, so waiting for the probe costs an attempt but no request
+			wait := l.cooldown()
+			if !retry || attempt >= policy.MaxAttempts || (policy.MaxDelay > 0 && wait > policy.MaxDelay) {
+				return nil, err
+			}
+			if wait == 0 {
+				// another request is probing the host
+				wait = policy.backoff(attempt)
+			}
+			if err := sleepCtx(ctx, wait); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// return when successful, not retrying, or out of attempts
+		last := !retry || attempt >= policy.MaxAttempts
+		if err != nil {
+			if last || ctx.Err() != nil {
+				return nil, err
+			}
+		} else if last || !shouldRetry(resp.StatusCode) {
+			return resp, nil
+		}
+
+		// drain so the connection can be reused
+		wait := policy.delay(attempt, resp)
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		if err := sleepCtx(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// do sends a single request through the host's breaker, rate limiter, and concurrency cap
+func (p *Proxy) do(ctx context.Context, l *limiter, req *http.Request) (*http.Response, error) {
+	if !l.allow(p.opts) {
+		requestsTotal.WithLabelValues(l.key, "circuit_open").Inc()
+		return nil, ErrCircuitOpen
+	}
+
+	err := l.Wait(ctx)
+	if err != nil {
+		l.cancelProbe()
+		return nil, err
+	}
+
+	release, err := l.acquire(ctx)
 	if err != nil {
+		l.cancelProbe()
 		return nil, err
 	}
 
+	start := time.Now()
 	resp, err := p.client.Do(req)
+	requestDuration.WithLabelValues(l.key).Observe(time.Since(start).Seconds())
+
 	if err != nil {
+		release()
+		// our own cancellation is not the host's fault
+		if ctx.Err() != nil {
+			l.cancelProbe()
+		} else {
+			l.record(p.opts, false)
+		}
+		requestsTotal.WithLabelValues(l.key, "error").Inc()
 		return nil, err
 	}
 
+	requestsTotal.WithLabelValues(l.key, strconv.Itoa(resp.StatusCode)).Inc()
+	// a 429 shows the host is up, throttling is paced by the limiter (ratelimit-reset) and retries (Retry-After),
+	// counting it would let a few 429s from one host of a group stall the whole group
+	l.record(p.opts, resp.StatusCode < 500)
 	p.updateLimiterFromHeaders(l, resp.Header)
 
+	// hold the concurrency slot until the body is done
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+
 	return resp, nil
 }
 
-func (p *Proxy) getLimiter(host string) *limiter {
-	// Default limiter: 10 req/s, burst of 30.
-	// This is a reasonable default based on bsky's PDS rate limits (3000/300s).
-	newLimiter := &limiter{
-		rl: rate.NewLimiter(rate.Limit(10), 30),
+// hostKey maps a hostname to its group pattern, or itself when not grouped
+func (p *Proxy) hostKey(host string) string {
+	for _, g := range p.opts.HostGroups {
+		if suffix, ok := strings.CutPrefix(g, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return g
+			}
+		} else if host == g {
+			return g
+		}
 	}
+	return host
+}
 
+func (p *Proxy) getLimiter(host string) *limiter {
 	val, ok := p.limiters.Load(host)
 	if ok {
 		return val.(*limiter)
 	}
 
-	val, _ = p.limiters.LoadOrStore(host, newLimiter)
+	// Default limiter: 10 req/s, burst of 30.
+	// This is a reasonable default based on bsky's PDS rate limits (3000/300s).
+	newLimiter := &limiter{
+		key: host,
+		rl:  rate.NewLimiter(rate.Limit(10), 30),
+	}
+	if policy, ok := p.opts.Overrides[host]; ok {
+		if limit, ok := ParsePolicy(policy); ok {
+			newLimiter.rl.SetLimit(limit)
+			newLimiter.pinned = true
+		}
+	}
+	if p.opts.MaxConcurrency > 0 {
+		newLimiter.sem = make(chan struct{}, p.opts.MaxConcurrency)
+	}
+
+	val, loaded := p.limiters.LoadOrStore(host, newLimiter)
+	if !loaded {
+		rateLimit.WithLabelValues(host).Set(float64(newLimiter.rl.Limit()))
+		breakerState.WithLabelValues(host).Set(breakerClosed)
+	}
 	return val.(*limiter)
 }
 
@@ -88,6 +255,87 @@ func (l *limiter) Wait(ctx context.Context) error {
 	return l.rl.Wait(ctx)
 }
 
+// acquire takes a concurrency slot, returning the func to give it back
+func (l *limiter) acquire(ctx context.Context) (func(), error) {
+	if l.sem == nil {
+		inflight.WithLabelValues(l.key).Inc()
+		return sync.OnceFunc(func() { inflight.WithLabelValues(l.key).Dec() }), nil
+	}
+
+	select {
+	case l.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	inflight.WithLabelValues(l.key).Inc()
+
+	return sync.OnceFunc(func() {
+		<-l.sem
+		inflight.WithLabelValues(l.key).Dec()
+	}), nil
+}
+
+// allow reports whether the breaker lets a request through.
+// Once the cool-down passes, a single probe request is let through (half-open).
+func (l *limiter) allow(opts Options) bool {
+	if opts.BreakerThreshold <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.failures < opts.BreakerThreshold {
+		return true
+	}
+	if time.Now().Before(l.openUntil) || l.probing {
+		return false
+	}
+
+	l.probing = true
+	breakerState.WithLabelValues(l.key).Set(breakerHalfOpen)
+	return true
+}
+
+// record updates the breaker with the outcome of a request
+func (l *limiter) record(opts Options, ok bool) {
+	if opts.BreakerThreshold <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.probing = false
+	if ok {
+		if l.failures > 0 {
+			breakerState.WithLabelValues(l.key).Set(breakerClosed)
+		}
+		l.failures = 0
+		return
+	}
+
+	l.failures++
+	if l.failures >= opts.BreakerThreshold {
+		l.openUntil = time.Now().Add(opts.BreakerCooldown)
+		breakerState.WithLabelValues(l.key).Set(breakerOpen)
+	}
+}
+
+// cooldown returns how long the circuit stays open, 0 once a probe may be let through
+func (l *limiter) cooldown() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return max(time.Until(l.openUntil), 0)
+}
+
+// cancelProbe lets another request probe when ours did not reach the host
+func (l *limiter) cancelProbe() {
+	l.mu.Lock()
+	l.probing = false
+	l.mu.Unlock()
+}
+
 func (p *Proxy) updateLimiterFromHeaders(l *limiter, h http.Header) {
 	policyStr := h.Get("ratelimit-policy")
 	remainingStr := h.Get("ratelimit-remaining")
@@ -96,21 +344,12 @@ func (p *Proxy) updateLimiterFromHeaders(l *limiter, h http.Header) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if policyStr != "" {
+	if policyStr != "" && !l.pinned {
 		// Example: 3000;w=300
-		parts := strings.Split(policyStr, ";")
-		if len(parts) == 2 {
-			reqsStr := parts[0]
-			winStr := strings.TrimPrefix(parts[1], "w=")
-
-			reqs, err1 := strconv.Atoi(reqsStr)
-			winSecs, err2 := strconv.Atoi(winStr)
-
-			if err1 == nil && err2 == nil && winSecs > 0 {
-				newRate := rate.Limit(float64(reqs) / float64(winSecs))
-				if l.rl.Limit() != newRate {
-					l.rl.SetLimit(newRate)
-				}
+		if newRate, ok := ParsePolicy(policyStr); ok {
+			if l.rl.Limit() != newRate {
+				l.rl.SetLimit(newRate)
+				rateLimit.WithLabelValues(l.key).Set(float64(newRate))
 			}
 		}
 	}
@@ -125,3 +364,15 @@ func (p *Proxy) updateLimiterFromHeaders(l *limiter, h http.Header) {
 		}
 	}
 }
+
+// releaseBody gives back the concurrency slot when the response body is closed
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,318 @@
+package rlproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fastRetry retries quickly so tests do not wait on backoff
+var fastRetry = RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+// get sends a GET through the proxy and reads the body, closing it to release the host's slot
+func get(t *testing.T, ctx context.Context, p *Proxy, url string) (int, error) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := p.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestRetry(t *testing.T) {
+	var requests atomic.Int64
+	var badRequest atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		if badRequest.Load() {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if n <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	// without a policy the failure is returned as is
+	p := NewWithOptions(srv.Client(), Options{})
+	if code, err := get(t, context.Background(), p, srv.URL); err != nil || code != http.StatusServiceUnavailable || requests.Load() != 1 {
+		t.Fatalf("got %d after %d requests without retry: %v", code, requests.Load(), err)
+	}
+
+	requests.Store(0)
+	if code, err := get(t, WithRetry(context.Background(), fastRetry), p, srv.URL); err != nil || code != http.StatusOK {
+		t.Fatalf("got %d with retry: %v", code, err)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("got %d requests, want 3 (2 failures and a success)", n)
+	}
+
+	// out of attempts, the last response is returned
+	requests.Store(-10)
+	if code, err := get(t, WithRetry(context.Background(), fastRetry), p, srv.URL); err != nil || code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d after using up the attempts: %v", code, err)
+	}
+	if n := requests.Load(); n != -10+int64(fastRetry.MaxAttempts) {
+		t.Errorf("made %d attempts, want %d", n+10, fastRetry.MaxAttempts)
+	}
+
+	// client errors are not transient
+	requests.Store(0)
+	badRequest.Store(true)
+	if code, _ := get(t, WithRetry(context.Background(), fastRetry), p, srv.URL); code != http.StatusBadRequest || requests.Load() != 1 {
+		t.Errorf("got %d after %d requests, want a single 400", code, requests.Load())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Minute}
+	resp := &http.Response{Header: http.Header{"Retry-After": {"7"}}}
+	if d := policy.delay(1, resp); d != 7*time.Second {
+		t.Errorf("got delay %s, want the 7s the server asked for", d)
+	}
+	resp.Header = http.Header{"Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {"0"}}
+	if d := policy.delay(1, resp); d != 0 {
+		t.Errorf("got delay %s for a reset in the past", d)
+	}
+	for attempt := 1; attempt < 10; attempt++ {
+		if d := policy.delay(attempt, nil); d <= 0 || d > time.Millisecond<<(attempt-1) {
+			t.Errorf("got backoff %s for attempt %d", d, attempt)
+		}
+	}
+
+	// the server's wait is followed, capped by MaxDelay
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	p := NewWithOptions(srv.Client(), Options{})
+	policy.MaxDelay = 100 * time.Millisecond
+	start := time.Now()
+	if code, err := get(t, WithRetry(context.Background(), policy), p, srv.URL); err != nil || code != http.StatusOK {
+		t.Fatalf("got %d: %v", code, err)
+	}
+	if took := time.Since(start); took < 100*time.Millisecond || took > 5*time.Second {
+		t.Errorf("retried after %s, want the 100ms cap", took)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing atomic.Bool
+	var requests atomic.Int64
+	failing.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	p := NewWithOptions(srv.Client(), Options{BreakerThreshold: 2, BreakerCooldown: 100 * time.Millisecond})
+	ctx := context.Background()
+	for range 2 {
+		if code, err := get(t, ctx, p, srv.URL); err != nil || code != http.StatusBadGateway {
+			t.Fatalf("got %d: %v", code, err)
+		}
+	}
+
+	// open, requests fail without reaching the host, retries included when the cool-down exceeds their MaxDelay
+	if _, err := get(t, WithRetry(ctx, fastRetry), p, srv.URL); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v, want the circuit open", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("got %d requests to the host, want 2", n)
+	}
+
+	// after the cool-down a failing probe opens it again
+	time.Sleep(120 * time.Millisecond)
+	if code, err := get(t, ctx, p, srv.URL); err != nil || code != http.StatusBadGateway {
+		t.Fatalf("got %d for the probe: %v", code, err)
+	}
+	if _, err := get(t, ctx, p, srv.URL); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v after a failed probe, want the circuit open", err)
+	}
+
+	// and a successful one closes it
+	failing.Store(false)
+	time.Sleep(120 * time.Millisecond)
+	for range 3 {
+		if code, err := get(t, ctx, p, srv.URL); err != nil || code != http.StatusOK {
+			t.Fatalf("got %d after recovering: %v", code, err)
+		}
+	}
+}
+
+// TestCircuitBreakerRetry checks 429s leave the circuit closed, they are paced by the limiter,
+// and a retry policy waits out the cool-down of a failing host
+func TestCircuitBreakerRetry(t *testing.T) {
+	var status atomic.Int64
+	var requests atomic.Int64
+	status.Store(http.StatusTooManyRequests)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer srv.Close()
+
+	p := NewWithOptions(srv.Client(), Options{BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond})
+	ctx := context.Background()
+	for range 3 {
+		if code, err := get(t, ctx, p, srv.URL); err != nil || code != http.StatusTooManyRequests {
+			t.Fatalf("got %d: %v, want 429s sent to the host", code, err)
+		}
+	}
+
+	status.Store(http.StatusServiceUnavailable)
+	for range 2 {
+		if code, err := get(t, ctx, p, srv.URL); err != nil || code != http.StatusServiceUnavailable {
+			t.Fatalf("got %d: %v", code, err)
+		}
+	}
+	if _, err := get(t, ctx, p, srv.URL); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v after two 503s, want the circuit open", err)
+	}
+
+	// the host recovers, a retry within the cool-down waits for it rather than failing
+	status.Store(http.StatusOK)
+	start := time.Now()
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Second}
+	if code, err := get(t, WithRetry(ctx, policy), p, srv.URL); err != nil || code != http.StatusOK {
+		t.Fatalf("got %d: %v, want the request sent after the cool-down", code, err)
+	}
+	if time.Since(start) < 40*time.Millisecond {
+		t.Error("sent before the cool-down ended")
+	}
+	if n := requests.Load(); n != 6 {
+		t.Errorf("got %d requests to the host, want 6", n)
+	}
+
+	// a throttled probe closes the circuit, the host is up
+	status.Store(http.StatusServiceUnavailable)
+	for range 2 {
+		get(t, ctx, p, srv.URL)
+	}
+	time.Sleep(60 * time.Millisecond)
+	status.Store(http.StatusTooManyRequests)
+	for range 2 {
+		if code, err := get(t, ctx, p, srv.URL); err != nil || code != http.StatusTooManyRequests {
+			t.Fatalf("got %d: %v, want the circuit closed by the throttled probe", code, err)
+		}
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	var running, most atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		time.Sleep(30 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	p := NewWithOptions(srv.Client(), Options{MaxConcurrency: 2})
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code, err := get(t, context.Background(), p, srv.URL); err != nil || code != http.StatusOK {
+				t.Errorf("got %d: %v", code, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := most.Load(); n != 2 {
+		t.Errorf("got %d requests in flight at once, want the cap of 2", n)
+	}
+
+	// a waiting request gives up with its context
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	held := make([]*http.Response, 0, 2)
+	for range 2 {
+		resp, err := p.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, resp)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := get(t, ctx, p, srv.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v waiting for a slot, want the deadline", err)
+	}
+	for _, resp := range held {
+		resp.Body.Close()
+	}
+}
+
+func TestHostGroups(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ratelimit-policy", "1200;w=60")
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	// every hostname resolves to the test server
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+	}}
+	p := NewWithOptions(client, Options{
+		HostGroups: []string{"*.host.test", "other.test"},
+		Overrides:  map[string]string{"pinned.test": "30;w=60"},
+	})
+
+	for _, host := range []string{"a.host.test", "b.host.test", "other.test", "solo.test", "pinned.test"} {
+		if code, err := get(t, context.Background(), p, "http://"+host+"/"); err != nil || code != http.StatusOK {
+			t.Fatalf("got %d from %s: %v", code, host, err)
+		}
+	}
+	if p.getLimiter(p.hostKey("a.host.test")) != p.getLimiter(p.hostKey("b.host.test")) {
+		t.Error("hosts in a group have separate limiters")
+	}
+
+	limits := map[string]float64{}
+	for _, s := range p.Snapshot() {
+		limits[s.Host] = s.Limit
+	}
+	// learned from the header, except where pinned
+	want := map[string]float64{"*.host.test": 20, "other.test": 20, "solo.test": 20, "pinned.test": 0.5}
+	if len(limits) != len(want) {
+		t.Errorf("got limiters %v, want %v", limits, want)
+	}
+	for host, limit := range want {
+		if limits[host] != limit {
+			t.Errorf("got limit %v for %s, want %v", limits[host], host, limit)
+		}
+	}
+}
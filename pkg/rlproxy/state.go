@@ -0,0 +1,115 @@
+package rlproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// HostState is the learned rate limit state for a host (or group), as persisted across restarts.
+type HostState struct {
+	Host  string    `json:"host"`
+	Limit float64   `json:"limit"` // requests per second
+	Burst int       `json:"burst"`
+	Reset time.Time `json:"reset,omitzero"`
+}
+
+// ParsePolicy parses a ratelimit-policy value (e.g. "3000;w=300") into a rate.
+func ParsePolicy(policy string) (rate.Limit, bool) {
+	parts := strings.Split(policy, ";")
+	if len(parts) != 2 {
+		return 0, false
+	}
+	reqs, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	winSecs, err2 := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(parts[1]), "w="))
+	if err1 != nil || err2 != nil || winSecs <= 0 {
+		return 0, false
+	}
+	return rate.Limit(float64(reqs) / float64(winSecs)), true
+}
+
+// Snapshot returns the current state of every known host.
+func (p *Proxy) Snapshot() []HostState {
+	var states []HostState
+	p.limiters.Range(func(key, val any) bool {
+		l := val.(*limiter)
+		l.mu.Lock()
+		s := HostState{
+			Host:  key.(string),
+			Limit: float64(l.rl.Limit()),
+			Burst: l.rl.Burst(),
+		}
+		if time.Now().Before(l.reset) {
+			s.Reset = l.reset
+		}
+		l.mu.Unlock()
+		states = append(states, s)
+		return true
+	})
+	return states
+}
+
+// Restore seeds hosts with previously learned state.
+// Hosts with a configured override keep their override limit.
+func (p *Proxy) Restore(states []HostState) {
+	for _, s := range states {
+		l := p.getLimiter(s.Host)
+		l.mu.Lock()
+		if !l.pinned && s.Limit > 0 {
+			l.rl.SetLimit(rate.Limit(s.Limit))
+			if s.Burst > 0 {
+				l.rl.SetBurst(s.Burst)
+			}
+			rateLimit.WithLabelValues(l.key).Set(s.Limit)
+		}
+		if s.Reset.After(l.reset) {
+			l.reset = s.Reset
+		}
+		l.mu.Unlock()
+	}
+}
+
+// LoadState restores host state from a JSON file, a missing file is not an error.
+func (p *Proxy) LoadState(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read rlproxy state: %w", err)
+	}
+
+	var states []HostState
+	if err := json.Unmarshal(b, &states); err != nil {
+		return fmt.Errorf("failed to unmarshal rlproxy state: %w", err)
+	}
+	p.Restore(states)
+	return nil
+}
+
+// SaveState writes host state to a JSON file, atomically replacing it.
+func (p *Proxy) SaveState(path string) error {
+	b, err := json.MarshalIndent(p.Snapshot(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal rlproxy state: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create rlproxy state directory: %w", err)
+	}
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, b, 0o644); err != nil {
+		return fmt.Errorf("failed to write rlproxy state: %w", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed replacing rlproxy state: %w", err)
+	}
+	return nil
+}
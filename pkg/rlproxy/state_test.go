@@ -0,0 +1,65 @@
+package rlproxy
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestParsePolicy(t *testing.T) {
+	for policy, want := range map[string]rate.Limit{
+		"3000;w=300":   10,
+		" 500 ; w=300": rate.Limit(500.0 / 300.0),
+		"3000":         0,
+		"3000;w=0":     0,
+		"x;w=300":      0,
+	} {
+		if got, ok := ParsePolicy(policy); got != want || ok != (want != 0) {
+			t.Errorf("got %v, %v for %q, want %v", got, ok, policy, want)
+		}
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "rlproxy.json")
+	reset := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	p := New(nil)
+	// a missing file is a fresh start
+	if err := p.LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+	p.Restore([]HostState{
+		{Host: "pds.test", Limit: 20, Burst: 40},
+		{Host: "busy.test", Limit: 1, Burst: 5, Reset: reset},
+		{Host: "pinned.test", Limit: 20, Burst: 40},
+	})
+	if err := p.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart learns the same state, except for hosts pinned by an override
+	q := NewWithOptions(nil, Options{Overrides: map[string]string{"pinned.test": "60;w=60"}})
+	if err := q.LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]HostState{}
+	for _, s := range q.Snapshot() {
+		got[s.Host] = s
+	}
+	want := map[string]HostState{
+		"pds.test":    {Host: "pds.test", Limit: 20, Burst: 40},
+		"busy.test":   {Host: "busy.test", Limit: 1, Burst: 5, Reset: reset},
+		"pinned.test": {Host: "pinned.test", Limit: 1, Burst: 30},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d hosts after loading, want %d", len(got), len(want))
+	}
+	for host, w := range want {
+		if g := got[host]; g.Limit != w.Limit || g.Burst != w.Burst || !g.Reset.Equal(w.Reset) {
+			t.Errorf("got %+v for %s, want %+v", g, host, w)
+		}
+	}
+}
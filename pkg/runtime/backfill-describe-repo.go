@@ -6,63 +6,29 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"sync/atomic"
 
 	atdb "github.com/blebbit/atmunge/pkg/db"
+	"github.com/blebbit/atmunge/pkg/rlproxy"
 	"github.com/rs/zerolog"
-	"github.com/wandb/parallel"
-
-	// "https://github.com/vgarvardt/gue" // alternative to parallel that is more like pg-boss
-
 	"gorm.io/gorm/clause"
 )
 
+const phaseDescribeRepo = "describe-repo"
+
 func (r *Runtime) BackfillDescribeRepo(par int, start string) error {
 	log := zerolog.Ctx(r.Ctx).With().Str("module", "repo-describe").Logger()
 
-	// create a group of workers
-	group := parallel.Limited(r.Ctx, par)
-
-	// get total count of PdsRepo entries to process for progress reporting
-	count, err := r.countRemainingToProcess("account_infos", start, "updated_at")
+	// queue up the DIDs to process
+	queued, err := r.enqueueJobs(phaseDescribeRepo, "account_infos", start, "updated_at")
 	if err != nil {
-		return fmt.Errorf("failed to count repo describes: %w", err)
-	}
-
-	for {
-
-		dids, err := r.getRandomSetToProcess("account_infos", start, "updated_at", 1000)
-		if err != nil {
-			return fmt.Errorf("failed to get random repo describes: %w", err)
-		}
-
-		// if no more entries, we are done
-		if len(dids) == 0 {
-			log.Info().Msgf("No PdsRepo entries found to fetch, exiting")
-			break
-		}
-
-		var total atomic.Int64
-
-		for index := 0; index < len(dids); index++ {
-			group.Go(func(ctx context.Context) {
-				err := r.processRepoDescribe(dids[index])
-				if err != nil {
-					log.Error().Err(err).Msgf("Failed to process repo %s", dids[index])
-					return
-				}
-
-				total.Add(1)
-			})
-		}
-
-		log.Info().Msgf("Processing %d/%d repos", total.Load(), count)
+		return fmt.Errorf("failed to enqueue repo describes: %w", err)
 	}
+	log.Info().Msgf("Queued %d repo describes", queued)
 
-	return nil
+	return r.runJobs(phaseDescribeRepo, par, log, r.processRepoDescribe)
 }
 
-func (r *Runtime) processRepoDescribe(did string) error {
+func (r *Runtime) processRepoDescribe(ctx context.Context, did string) error {
 	log := zerolog.Ctx(r.Ctx).With().Str("module", "repo-describe").Logger()
 
 	// get the next PdsRepo entry to process
@@ -76,7 +42,7 @@ func (r *Runtime) processRepoDescribe(did string) error {
 
 	// per PDS rate limiters, blocks until some rate limit is available
 	url := fmt.Sprintf("%s/xrpc/com.atproto.repo.describeRepo?repo=%s", row.PDS, row.DID)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(rlproxy.WithRetry(ctx, r.Retry), "GET", url, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request for %s: %w", url, err)
 	}
@@ -100,6 +66,7 @@ func (r *Runtime) processRepoDescribe(did string) error {
 		if resp.StatusCode == http.StatusNotFound {
 			err = r.DB.Model(&atdb.PdsRepo{}).
 				Where("id = ?", row.ID).
+				Select("active", "status").
 				Updates(atdb.PdsRepo{
 					Active: false,
 					Status: "notfound",
@@ -121,6 +88,7 @@ func (r *Runtime) processRepoDescribe(did string) error {
 				case "RepoTakendown":
 					err = r.DB.Model(&atdb.PdsRepo{}).
 						Where("id = ?", row.ID).
+						Select("active", "status").
 						Updates(atdb.PdsRepo{
 							Active: false,
 							Status: "takendown",
@@ -132,6 +100,7 @@ func (r *Runtime) processRepoDescribe(did string) error {
 				case "RepoDeactivated":
 					err = r.DB.Model(&atdb.PdsRepo{}).
 						Where("id = ?", row.ID).
+						Select("active", "status").
 						Updates(atdb.PdsRepo{
 							Active: false,
 							Status: "deactivated",
@@ -143,6 +112,7 @@ func (r *Runtime) processRepoDescribe(did string) error {
 				case "NotFound", "RepoNotFound":
 					err = r.DB.Model(&atdb.PdsRepo{}).
 						Where("id = ?", row.ID).
+						Select("active", "status").
 						Updates(atdb.PdsRepo{
 							Active: false,
 							Status: "notfound",
@@ -162,21 +132,13 @@ func (r *Runtime) processRepoDescribe(did string) error {
 		}
 
 		if resp.StatusCode == 429 {
-			// TODO, wait some time and retry
+			// the proxy has already retried, leave it for the job queue to try again later
 			return fmt.Errorf("Rate limit exceeded for %s, skipping...", url)
 		}
 
 		if resp.StatusCode >= 500 {
-			err = r.DB.Model(&atdb.PdsRepo{}).
-				Where("id = ?", row.ID).
-				Updates(atdb.PdsRepo{
-					Active: false,
-					Status: fmt.Sprintf("server_error_%d", resp.StatusCode),
-				}).Error
-			if err != nil {
-				return fmt.Errorf("Failed to update PdsRepo entry %d: %s", row.ID, err)
-			}
-			return nil
+			// a PDS outage is temporary, the account stays active and the job queue retries it with backoff
+			return fmt.Errorf("Server error %d from %s, skipping...", resp.StatusCode, url)
 		}
 
 		// You might want to read the body here to get more error details
@@ -205,6 +167,7 @@ func (r *Runtime) processRepoDescribe(did string) error {
 	// ensure record is active
 	err = r.DB.Model(&atdb.PdsRepo{}).
 		Where("id = ?", row.ID).
+		Select("active", "status").
 		Updates(atdb.PdsRepo{
 			Active: true,
 			Status: "",
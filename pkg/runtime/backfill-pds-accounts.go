@@ -40,9 +40,9 @@ func (r *Runtime) BackfillPdsAccounts(pdses []string, startPDS string) error {
 
 		durl := pds + "/xrpc/com.atproto.server.describeServer"
 
-		r1, err := http.Get(durl)
+		r1, err := r.Client.Get(durl)
 		if err != nil {
-			fmt.Printf("failed to get repos from %s: %w\n", durl, err)
+			fmt.Printf("failed to get repos from %s: %v\n", durl, err)
 			continue
 		}
 		if r1 != nil && r1.Body != nil {
@@ -58,7 +58,7 @@ func (r *Runtime) BackfillPdsAccounts(pdses []string, startPDS string) error {
 
 		b1, err := io.ReadAll(r1.Body)
 		if err != nil {
-			fmt.Printf("failed to read response body from %s: %w\n", durl, err)
+			fmt.Printf("failed to read response body from %s: %v\n", durl, err)
 			// return fmt.Errorf("failed to read response body from %s: %w", durl, err)
 			continue
 		}
@@ -87,9 +87,9 @@ func (r *Runtime) backfillPdsAccounts(pds string) error {
 			url += "&cursor=" + cursor
 		}
 
-		r2, err := http.Get(url)
+		r2, err := r.Client.Get(url)
 		if err != nil {
-			fmt.Printf("failed to get repos from %s: %w\n", url, err)
+			fmt.Printf("failed to get repos from %s: %v\n", url, err)
 			break
 		}
 		if r2 != nil && r2.Body != nil {
@@ -104,14 +104,14 @@ func (r *Runtime) backfillPdsAccounts(pds string) error {
 
 		b2, err := io.ReadAll(r2.Body)
 		if err != nil {
-			fmt.Printf("failed to read response body from %s: %w\n", url, err)
+			fmt.Printf("failed to read response body from %s: %v\n", url, err)
 			break
 		}
 
 		d2 := RepoListResp{}
 		err = json.Unmarshal(b2, &d2)
 		if err != nil {
-			fmt.Printf("failed to unmarshal response from %s: %w\n", url, err)
+			fmt.Printf("failed to unmarshal response from %s: %v\n", url, err)
 			break
 		}
 		fmt.Printf("Got %d repos from %s @ %s\n", len(d2.Repos), url, d2.Cursor)
@@ -153,7 +153,7 @@ func (r *Runtime) backfillPdsAccounts(pds string) error {
 			},
 		).Create(entries).Error
 		if err != nil {
-			fmt.Printf("failed to save repos from %s: %w\n", url, err)
+			fmt.Printf("failed to save repos from %s: %v\n", url, err)
 			continue
 		}
 
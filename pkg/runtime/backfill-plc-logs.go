@@ -56,7 +56,7 @@ func (r *Runtime) BackfillPlcLogs() error {
 		_ = r.limiter.Wait(r.Ctx)
 		log.Debug().Msgf("Listing PLC log entries with cursor %q...", cursor)
 		log.Debug().Msgf("Request URL: %s", u.String())
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := r.Client.Do(req)
 		if err != nil {
 			if strings.Contains(err.Error(), "context canceled") {
 				log.Info().Msgf("PLC backfill stopped by context cancellation")
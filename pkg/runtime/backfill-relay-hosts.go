@@ -0,0 +1,204 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gorm.io/gorm/clause"
+
+	atdb "github.com/blebbit/atmunge/pkg/db"
+	"github.com/blebbit/atmunge/pkg/rlproxy"
+)
+
+type RelayHost struct {
+	Hostname     string `json:"hostname"`
+	AccountCount *int64 `json:"accountCount,omitempty"`
+	Seq          *int64 `json:"seq,omitempty"`
+	Status       string `json:"status,omitempty"`
+}
+
+type RelayHostListResp struct {
+	Cursor string      `json:"cursor"`
+	Hosts  []RelayHost `json:"hosts"`
+}
+
+// RelayHostsReport summarizes the diff between our view of the network and the relay's
+type RelayHostsReport struct {
+	RelayHosts   int // hosts reported by the relay
+	KnownHosts   int // relay hosts we also have in pds_repos
+	UnknownHosts int // relay hosts we have no accounts for
+	MissingHosts int // hosts in pds_repos the relay did not report
+	Mismatched   int // hosts where the account counts differ
+}
+
+// BackfillRelayHosts pages through a relay's listHosts and merges them into the pds_hosts table
+func (r *Runtime) BackfillRelayHosts(relay string) (*RelayHostsReport, error) {
+	log := zerolog.Ctx(r.Ctx).With().Str("module", "relay-hosts").Logger()
+
+	relay = strings.TrimSuffix(relay, "/")
+	if !strings.HasPrefix(relay, "http") {
+		relay = "https://" + relay
+	}
+
+	// our view of the network, accounts per PDS
+	type pdsCount struct {
+		PDS   string
+		Count int64
+	}
+	var counts []pdsCount
+	err := r.DB.WithContext(r.Ctx).Model(&atdb.PdsRepo{}).
+		Select("pds, count(*) as count").
+		Where("active = true").
+		Group("pds").
+		Scan(&counts).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to count pds_repos by PDS: %w", err)
+	}
+	local := make(map[string]int64, len(counts))
+	for _, c := range counts {
+		local[c.PDS] = c.Count
+	}
+
+	report := &RelayHostsReport{}
+	seen := make(map[string]bool)
+
+	cursor := ""
+	for {
+		resp, err := r.listRelayHosts(relay, cursor)
+		if err != nil {
+			return report, err
+		}
+		log.Info().Msgf("Got %d hosts from %s @ %s", len(resp.Hosts), relay, resp.Cursor)
+
+		entries := make([]atdb.PdsHost, 0, len(resp.Hosts))
+		for _, host := range resp.Hosts {
+			// some relays only report the hostname, ask for the rest
+			if host.Status == "" || host.AccountCount == nil {
+				status, err := r.getRelayHostStatus(relay, host.Hostname)
+				if err != nil {
+					log.Warn().Err(err).Msgf("failed to get host status for %s", host.Hostname)
+				} else {
+					host = *status
+				}
+			}
+
+			pds := "https://" + host.Hostname
+			seen[pds] = true
+
+			entry := atdb.PdsHost{
+				PDS:          pds,
+				Hostname:     host.Hostname,
+				Relay:        relay,
+				RelayStatus:  host.Status,
+				RelaySeenAt:  time.Now(),
+				AccountCount: local[pds],
+			}
+			if host.AccountCount != nil {
+				entry.RelayAccountCount = *host.AccountCount
+			}
+			if host.Seq != nil {
+				entry.RelaySeq = *host.Seq
+			}
+			entries = append(entries, entry)
+
+			report.RelayHosts++
+			if _, ok := local[pds]; ok {
+				report.KnownHosts++
+				if entry.RelayAccountCount != entry.AccountCount {
+					report.Mismatched++
+					log.Debug().Msgf("account count mismatch for %s: relay %d, local %d", pds, entry.RelayAccountCount, entry.AccountCount)
+				}
+			} else {
+				report.UnknownHosts++
+				log.Debug().Msgf("relay reports unknown host %s (%s, %d accounts)", pds, entry.RelayStatus, entry.RelayAccountCount)
+			}
+		}
+
+		if len(entries) > 0 {
+			err = r.DB.WithContext(r.Ctx).Model(&atdb.PdsHost{}).Clauses(
+				clause.OnConflict{
+					Columns: []clause.Column{{Name: "pds"}},
+					DoUpdates: clause.AssignmentColumns([]string{
+						"hostname", "relay", "relay_account_count", "relay_seq",
+						"relay_status", "relay_seen_at", "account_count", "updated_at",
+					}),
+				},
+			).Create(&entries).Error
+			if err != nil {
+				return report, fmt.Errorf("failed to save hosts from %s: %w", relay, err)
+			}
+		}
+
+		if resp.Cursor == "" || len(resp.Hosts) == 0 {
+			break
+		}
+		cursor = resp.Cursor
+	}
+
+	for pds := range local {
+		if !seen[pds] {
+			report.MissingHosts++
+			log.Debug().Msgf("relay does not report known host %s (%d accounts)", pds, local[pds])
+		}
+	}
+
+	return report, nil
+}
+
+func (r *Runtime) listRelayHosts(relay, cursor string) (*RelayHostListResp, error) {
+	params := url.Values{}
+	params.Set("limit", "1000")
+	if cursor != "" {
+		params.Set("cursor", cursor)
+	}
+	u := relay + "/xrpc/com.atproto.sync.listHosts?" + params.Encode()
+
+	var resp RelayHostListResp
+	if err := r.getRelayJSON(u, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *Runtime) getRelayHostStatus(relay, hostname string) (*RelayHost, error) {
+	params := url.Values{}
+	params.Set("hostname", hostname)
+	u := relay + "/xrpc/com.atproto.sync.getHostStatus?" + params.Encode()
+
+	var resp RelayHost
+	if err := r.getRelayJSON(u, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *Runtime) getRelayJSON(u string, v any) error {
+	req, err := http.NewRequestWithContext(rlproxy.WithRetry(r.Ctx, r.Retry), http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request for %s: %w", u, err)
+	}
+	resp, err := r.Proxy.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body from %s: %w", u, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status code from %s: %d %s", u, resp.StatusCode, string(b))
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("failed to unmarshal response from %s: %w", u, err)
+	}
+	return nil
+}
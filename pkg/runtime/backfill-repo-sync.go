@@ -2,38 +2,29 @@ package runtime
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"sync/atomic"
 	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/rs/zerolog"
-	"github.com/wandb/parallel"
 	"gorm.io/gorm/clause"
 
 	atdb "github.com/blebbit/atmunge/pkg/db"
 	"github.com/blebbit/atmunge/pkg/repo"
+	"github.com/blebbit/atmunge/pkg/rlproxy"
 )
 
-// we should build a channel into this
-// some downloads take longer for various reasons
-// we should keep the belt full (like factorio)
-
-// XXX the counts are off too, by 20% it seems like, not sure what's up with that...
-//     I suspect the parallel module, let's try writing our own goroutines instead
-
 // XXX we also need to handle account status responses here
 //     between the time we filter and then download CARs
 //     the account may have been deleted or taken down
 
+const phaseRepoSync = "repo-sync"
+
 func (r *Runtime) BackfillRepoSync(par int, start string) error {
 	log := zerolog.Ctx(r.Ctx).With().Str("module", "repo-sync").Logger()
 
-	// create a group of workers
-	group := parallel.Limited(r.Ctx, par)
-
 	// Can we get the latest revision from the PDS?
 	// If so, we can skip accounts without fetching CAR to see if there are updates
 	// Since we cascade the backfill process, one of the prior processes or tables may have the latest revision
@@ -44,57 +35,19 @@ func (r *Runtime) BackfillRepoSync(par int, start string) error {
 	// we really want to have it be seamless
 	// for now we could run it twice, once in each mode, this should be equivalent
 
-	// get total count of AccountRepo entries to process for progress reporting
-	count, err := r.countRemainingToProcess("account_repos", start, "updated_at")
+	// queue up the DIDs to process
+	queued, err := r.enqueueJobs(phaseRepoSync, "account_repos", start, "updated_at")
 	if err != nil {
-		return fmt.Errorf("failed to count repo syncs: %w", err)
+		return fmt.Errorf("failed to enqueue repo syncs: %w", err)
 	}
+	log.Info().Msgf("Queued %d repo syncs", queued)
 
-	// TODO, have both per batch and run stats
-	var total atomic.Int64
-	var totalErr atomic.Int64
-
-	for {
-		var batch atomic.Int64
-		var batchErr atomic.Int64
-
-		dids, err := r.getRandomSetToProcess("account_repos", start, "updated_at", 50)
-		if err != nil {
-			return fmt.Errorf("failed to get random repo syncs: %w", err)
-		}
-
-		// if no more entries, we are done
-		if len(dids) == 0 {
-			log.Info().Msgf("No AccountRepo entries found to sync, exiting")
-			break
-		}
-
-		for index := 0; index < len(dids); index++ {
-			group.Go(func(ctx context.Context) {
-				err := r.processRepoSync(dids[index])
-				total.Add(1)
-				batch.Add(1)
-
-				if err != nil {
-					totalErr.Add(1)
-					batchErr.Add(1)
-					log.Error().Err(err).Msgf("Failed to process repo sync for %s: %v", dids[index], err)
-					return
-				}
-			})
-		}
-
-		log.Info().Msgf("Processing %d/%d repos. Batch: %d/%d Error: %d/%d",
-			total.Load(), count,
-			batch.Load(), len(dids),
-			batchErr.Load(), totalErr.Load(),
-		)
-	}
-
-	return nil
+	return r.runJobs(phaseRepoSync, par, log, r.processRepoSync)
 }
 
-func (r *Runtime) processRepoSync(did string) error {
+// processRepoSync fetches and merges an account's repo updates,
+// ctx is cancelled when the job's lease is lost, nothing is written after that
+func (r *Runtime) processRepoSync(ctx context.Context, did string) error {
 	log := zerolog.Ctx(r.Ctx).With().Str("module", "repo-sync").Logger()
 
 	var account atdb.AccountInfo
@@ -111,25 +64,52 @@ func (r *Runtime) processRepoSync(did string) error {
 	}
 
 	// prepare to write
-	repoDir := filepath.Join(r.Cfg.RepoDataDir, did)
+	repoDir := r.Layout().Dir(did)
 	if err := os.MkdirAll(repoDir, 0o755); err != nil {
 		return fmt.Errorf("failed to create data directory %s: %w", repoDir, err)
 	}
 	localCarFile := filepath.Join(repoDir, "repo.car")
-	// load local CAR from disk
-	blockstoreMem, sinceTID, err := repo.LoadLocalCar(localCarFile)
-	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
+	// refresh the local cache from remote storage
+	if err := r.PullRepoFiles(did); err != nil {
+		return fmt.Errorf("failed to pull repo files for %s: %w", did, err)
+	}
+
+	// open the local CAR, a new repo when the file doesn't exist,
+	// a compressed CAR is only inflated when there is an update to merge
+	var bs repo.Blockstore
+	defer func() {
+		if bs != nil {
+			bs.Close()
+		}
+	}()
+	openCar := func() error {
+		opened, err := repo.OpenBlockstore(r.Cfg.RepoBlockstore, localCarFile)
+		if err != nil {
 			return fmt.Errorf("failed to load local CAR for %s: %w", did, err)
 		}
-		// if the file doesn't exist, we can continue, it's a new repo
+		bs = opened
+		return nil
+	}
+	var sinceTID string
+	var oldRootCid cid.Cid
+	if repo.IsCompressedCar(localCarFile) {
+		if oldRootCid, sinceTID, err = repo.ReadCarHead(localCarFile); err != nil {
+			return fmt.Errorf("failed to read local CAR for %s: %w", did, err)
+		}
+	} else {
+		if err := openCar(); err != nil {
+			return err
+		}
+		sinceTID = bs.Rev()
+		oldRootCid = bs.Root()
 	}
 
-	// get updated CAR data from PDS
-	updateCarData, err := repo.GetRepo(r.Ctx, r.Proxy, pdsHost, did, sinceTID)
+	// get updated CAR data from PDS, streamed to a temp file next to the repo
+	updatePath, updateSize, err := repo.GetRepo(rlproxy.WithRetry(ctx, r.Retry), r.Proxy, pdsHost, did, sinceTID, r.RepoFetchOptions(repoDir, did))
 	if err != nil {
 		return fmt.Errorf("failed to fetch repo data for %s: %w", did, err)
 	}
+	defer os.Remove(updatePath)
 
 	val := atdb.AccountRepo{
 		DID: did,
@@ -137,7 +117,7 @@ func (r *Runtime) processRepoSync(did string) error {
 
 	onConflict := clause.OnConflict{
 		Columns:   []clause.Column{{Name: "did"}},
-		DoUpdates: clause.AssignmentColumns([]string{"rev", "last_changed", "updated_at"}),
+		DoUpdates: clause.AssignmentColumns([]string{"rev", "last_changed", "verified", "verify_error", "changes", "updated_at"}),
 	}
 
 	// within the following code until we write to the database
@@ -146,34 +126,61 @@ func (r *Runtime) processRepoSync(did string) error {
 	// - updated_at (last time we tried this backfill session)
 
 	// if we have updates, merge them
-	if len(updateCarData) > 0 {
+	if updateSize > 0 {
+		updateFile, err := os.Open(updatePath)
+		if err != nil {
+			return fmt.Errorf("failed to open update for %s: %w", did, err)
+		}
+		defer updateFile.Close()
 
-		newRootCid, newestRev, _ /*newBlocks*/, err := repo.MergeUpdate(blockstoreMem, updateCarData)
+		if bs == nil {
+			if err := openCar(); err != nil {
+				return err
+			}
+		}
+		newRootCid, newestRev, _ /*newBlocks*/, err := repo.MergeUpdate(bs, updateFile)
 		if err != nil {
 			return fmt.Errorf("failed to merge update for %s: %w", did, err)
 		}
 
+		if err := context.Cause(ctx); err != nil {
+			return fmt.Errorf("stopped before writing the CAR for %s: %w", did, err)
+		}
+
 		// this second check is a possible edge case or shouldn't happen logically, let's be defensively programming anyhow
 		if newestRev != "" {
 			val.LastChanged = time.Now()
 			val.Rev = newestRev
-			if err := repo.WriteCar(localCarFile, newRootCid, blockstoreMem); err != nil {
+			if err := bs.Commit(newRootCid); err != nil {
 				return fmt.Errorf("failed to write CAR file for %s: %w", did, err)
 			}
-
-			// TODO, these should be controlled by flags
-			//   right now, it significantly increase the disk footprint
-			// also write to sqlite & duckdb
-			// duckdbPath := filepath.Join(repoDir, "repo.duckdb")
-			// if err := repo.SaveNewRecordsToDuckDB(r.Ctx, blockstoreMem, newBlocks, newRootCid, duckdbPath); err != nil {
-			// 	log.Error().Err(err).Msgf("failed to save new records to DuckDB for %s", did)
-			// 	// deciding not to return error here, as the primary sync succeeded
-			// }
-			// sqlitePath := filepath.Join(repoDir, "repo.sqlite")
-			// if err := repo.SaveNewRecordsToSQLite(r.Ctx, blockstoreMem, newBlocks, newRootCid, sqlitePath); err != nil {
-			// 	log.Error().Err(err).Msgf("failed to save new records to SQLite for %s", did)
-			// 	// deciding not to return error here, as the primary sync succeeded
-			// }
+			// a bad signature is recorded rather than failing the sync, we keep what the PDS serves
+			if err := r.VerifyRepo(bs, did); err != nil {
+				log.Warn().Err(err).Msgf("failed to verify repo for %s", did)
+				val.VerifyError = err.Error()
+			} else {
+				val.Verified = true
+			}
+			if changes, err := r.RecordRepoChanges(bs, repoDir, oldRootCid, sinceTID); err != nil {
+				log.Warn().Err(err).Msgf("failed to record repo changes for %s", did)
+			} else {
+				val.Changes = changes
+			}
+			// before compaction drops the blocks of the commit the databases diff from
+			r.updateRepoDBs(did, bs, repoDir)
+			bs.Close()
+			if r.Cfg.RepoCompact {
+				r.compactRepo(did, localCarFile)
+			}
+			if r.Cfg.RepoCompress {
+				r.compressRepo(did, localCarFile)
+			}
+			if err := context.Cause(ctx); err != nil {
+				return fmt.Errorf("stopped before pushing repo files for %s: %w", did, err)
+			}
+			if err := r.PushRepoFiles(did); err != nil {
+				return err
+			}
 		}
 	} else {
 		// we want to note that we have checked this record, but there are no other changes
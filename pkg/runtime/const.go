@@ -28,4 +28,16 @@ const (
 	// PDS settings (assume consistent, can store exceptions in the PDS info table)
 	// default is 3000;300w ... aim slightly below that
 	pdsRateLimit = rate.Limit(2900.0 / 300.0)
+
+	// how often learned proxy rate limits are saved
+	proxyStateInterval = 30 * time.Second
+
+	// backfill job queue settings
+	jobMaxAttempts = 5
+	jobBaseBackoff = time.Minute
+	jobMaxBackoff  = 6 * time.Hour
+	// when Cfg.BackfillJobLease is unset
+	jobLease = 15 * time.Minute
+	// how many jobs between progress logs
+	jobProgressEvery = 100
 )
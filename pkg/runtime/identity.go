@@ -2,11 +2,17 @@ package runtime
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 
+	"github.com/bluesky-social/indigo/atproto/crypto"
 	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/atproto/syntax"
+	"gorm.io/gorm"
+
+	atdb "github.com/blebbit/atmunge/pkg/db"
+	"github.com/blebbit/atmunge/pkg/plc"
 )
 
 // ResolveDid resolves a handle or DID to a DID and a PDS endpoint.
@@ -59,3 +65,40 @@ func (r *Runtime) lookupPDS(ctx context.Context, did syntax.DID) (string, error)
 	}
 	return ident.PDSEndpoint(), nil
 }
+
+// SigningKey returns the atproto signing key for a DID, from our PLC mirror for did:plc
+// and from the identity directory for anything else, or when the mirror has no entry.
+func (r *Runtime) SigningKey(ctx context.Context, did string) (crypto.PublicKey, error) {
+	if strings.HasPrefix(did, "did:plc:") && r.DB != nil {
+		var entry atdb.PLCLogEntry
+		err := r.DB.WithContext(ctx).Model(&entry).Where("did = ? AND (NOT nullified)", did).Order("plc_timestamp desc").Limit(1).Take(&entry).Error
+		if err == nil {
+			var key string
+			switch v := entry.Operation.Value.(type) {
+			case plc.Op:
+				key = v.VerificationMethods["atproto"]
+			case plc.LegacyCreateOp:
+				key = v.SigningKey
+			case plc.Tombstone:
+				return nil, fmt.Errorf("%s is tombstoned", did)
+			}
+			if key == "" {
+				return nil, fmt.Errorf("%s has no atproto verification method", did)
+			}
+			return crypto.ParsePublicDIDKey(key)
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to get the last log entry for %s: %w", did, err)
+		}
+	}
+
+	d, err := syntax.ParseDID(did)
+	if err != nil {
+		return nil, fmt.Errorf("invalid did: %w", err)
+	}
+	ident, err := identity.DefaultDirectory().LookupDID(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	return ident.PublicKey()
+}
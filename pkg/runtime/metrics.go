@@ -1,11 +1,43 @@
 package runtime
 
 import (
+	"errors"
+	"net/http"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
 )
 
 var lastEventTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
 	Name: "plcmirror_last_op_timestamp",
 	Help: "Timestamp of the last operation received from upstream.",
 })
+
+// ServeMetrics exposes /metrics on Cfg.MetricsPort, when set, until the runtime's context is done.
+// Long running commands without the server (backfills) call it, run serves /metrics on its HTTP port.
+func (r *Runtime) ServeMetrics() {
+	if r.Cfg.MetricsPort == "" {
+		return
+	}
+	go r.serveMetrics()
+}
+
+func (r *Runtime) serveMetrics() {
+	log := zerolog.Ctx(r.Ctx).With().Str("module", "metrics").Logger()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: ":" + r.Cfg.MetricsPort, Handler: mux}
+
+	go func() {
+		<-r.Ctx.Done()
+		srv.Close()
+	}()
+
+	log.Info().Msgf("Serving metrics on %q", srv.Addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error().Err(err).Msgf("metrics server failed")
+	}
+}
@@ -1,57 +1,389 @@
 package runtime
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nrednav/cuid2"
+	"github.com/rs/zerolog"
 
 	"github.com/blebbit/atmunge/pkg/db"
+	"gorm.io/gorm"
+)
+
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobFailed  = "failed"
+	JobDone    = "done"
 )
 
 // WARNING: args should not come from user input, this is for internal use only
 // likely susceptible to SQL injection
-func (r *Runtime) countRemainingToProcess(table string, start, startWhen string) (int, error) {
-	q := r.DB.WithContext(r.Ctx).Model(&db.PdsRepo{}).Where("active = true")
+//
+// enqueueJobs adds a job for every active DID in pds_repos that still needs processing for the phase.
+// When start is empty, DIDs without a row in the phase's table are queued.
+// Otherwise, DIDs whose startWhen column is older than start are (re)queued.
+func (r *Runtime) enqueueJobs(phase, table string, start, startWhen string) (int64, error) {
+	// now is passed in rather than using now(), so the queries also run on sqlite in tests
+	now := time.Now()
+
+	var where, onConflict string
+	args := []any{phase, JobQueued, now, now, now}
 
 	if start == "" {
-		q = q.Where(fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s WHERE %s.did = pds_repos.did)", table, table))
+		where = fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s WHERE %s.did = pds_repos.did)", table, table)
+		onConflict = "DO NOTHING"
 	} else {
-		q = q.Where(startWhen+" < ?", start)
+		where = "pds_repos." + startWhen + " < ?"
+		args = append(args, start)
+		// finished jobs are requeued, in-flight and retrying ones are left alone
+		onConflict = fmt.Sprintf(
+			"DO UPDATE SET status = '%s', attempts = 0, next_run_at = excluded.next_run_at, last_error = '', updated_at = excluded.updated_at WHERE backfill_jobs.status IN ('%s', '%s')",
+			JobQueued, JobDone, JobFailed,
+		)
 	}
 
+	q := fmt.Sprintf(`
+		INSERT INTO backfill_jobs (phase, did, status, attempts, next_run_at, created_at, updated_at)
+		SELECT DISTINCT ?, did, ?, 0, ?, ?, ?
+		FROM pds_repos
+		WHERE active = true AND %s
+		ON CONFLICT (phase, did) %s
+	`, where, onConflict)
+
+	res := r.DB.WithContext(r.Ctx).Exec(q, args...)
+	if res.Error != nil {
+		return -1, fmt.Errorf("failed to enqueue %s jobs: %w", phase, res.Error)
+	}
+
+	return res.RowsAffected, nil
+}
+
+// countRemainingJobs returns the number of jobs for a phase that are not yet done or failed
+func (r *Runtime) countRemainingJobs(phase string) (int, error) {
 	var count int64
-	err := q.Count(&count).Error
+	err := r.DB.WithContext(r.Ctx).Model(&db.BackfillJob{}).
+		Where("phase = ? AND status IN ?", phase, []string{JobQueued, JobRunning}).
+		Count(&count).Error
 	if err != nil {
-		return -1, fmt.Errorf("failed to count PdsRepo entries: %w", err)
+		return -1, fmt.Errorf("failed to count %s jobs: %w", phase, err)
 	}
 
 	return int(count), nil
 }
 
-// WARNING: args should not come from user input, this is for internal use only
-// likely susceptible to SQL injection
-func (r *Runtime) getRandomSetToProcess(table string, start, startWhen string, limit int) ([]string, error) {
-	// fetch all PdsRepo entries that have no corresponding AccountInfo entry
-	var ids []string
+// errLeaseLost is returned when a job's lease expired and it was leased again by another worker
+var errLeaseLost = errors.New("job lease lost")
 
-	q := r.DB.WithContext(r.Ctx).Model(&db.PdsRepo{}).Where("active = true")
+// leasedJob is a job claimed by leaseJobs, the token identifies the lease
+// so a worker whose lease expired can not overwrite the state of the next holder
+type leasedJob struct {
+	DID        string `gorm:"column:did"`
+	LeaseToken string `gorm:"column:lease_token"`
+}
 
-	if start == "" {
-		q = q.Where(fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s WHERE %s.did = pds_repos.did)", table, table))
-	} else {
-		// HMMM this is probably not on the right table eh...
-		// but probably works if we always cascade the backfill (?)
-		// need to check on the phase that updates pds_repo
-		// such that on conflict, we update the updated_at field to show we processed it
-		// or maybe we make working tables & rows at the start of each phase once, and then delete / status update them
-		// we could then have a report across the whole process and stats on when accounts are filtered out
-		q = q.Where(startWhen+" < ?", start)
+// leaseJobs claims up to limit runnable jobs for a phase.
+// Runnable jobs are queued and due, or running with an expired lease (a crashed worker).
+// Rows locked by other workers are skipped, so multiple processes can share a phase.
+func (r *Runtime) leaseJobs(phase string, limit int, lease time.Duration) ([]leasedJob, error) {
+	var jobs []leasedJob
+	now := time.Now()
+	token := cuid2.Generate()
+
+	// sqlite (tests) has no row locks, writers are serialized anyway,
+	// the locking query only runs in TestLeaseJobsPostgres when given a postgres
+	lock := "FOR UPDATE SKIP LOCKED"
+	if r.DB.Dialector.Name() == "sqlite" {
+		lock = ""
+	}
+
+	q := fmt.Sprintf(`
+		UPDATE backfill_jobs
+		SET status = ?, attempts = attempts + 1, lease_until = ?, lease_token = ?, updated_at = ?
+		WHERE id IN (
+			SELECT id FROM backfill_jobs
+			WHERE phase = ?
+			  AND ((status = ? AND next_run_at <= ?) OR (status = ? AND lease_until < ?))
+			ORDER BY next_run_at
+			LIMIT ?
+			%s
+		)
+		RETURNING did, lease_token
+	`, lock)
+	err := r.DB.WithContext(r.Ctx).
+		Raw(q, JobRunning, now.Add(lease), token, now, phase, JobQueued, now, JobRunning, now, limit).
+		Scan(&jobs).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to lease %s jobs: %w", phase, err)
 	}
 
-	q = q.Order("RANDOM()").Limit(limit)
+	return jobs, nil
+}
 
-	err := q.Pluck("did", &ids).Error
+// nextJobRun returns when the earliest queued job of a phase comes due, zero when none are queued
+func (r *Runtime) nextJobRun(phase string) (time.Time, error) {
+	var jobs []db.BackfillJob
+	err := r.DB.WithContext(r.Ctx).Model(&db.BackfillJob{}).
+		Where("phase = ? AND status = ?", phase, JobQueued).
+		Order("next_run_at").
+		Limit(1).
+		Find(&jobs).Error
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch PdsRepo entries: %w", err)
+		return time.Time{}, fmt.Errorf("failed to get next %s job: %w", phase, err)
+	}
+	if len(jobs) == 0 {
+		return time.Time{}, nil
 	}
+	return jobs[0].NextRunAt, nil
+}
+
+// renewLease extends a running job's lease, errLeaseLost when it was taken over
+func (r *Runtime) renewLease(phase string, leased leasedJob, lease time.Duration) error {
+	res := r.DB.WithContext(r.Ctx).Model(&db.BackfillJob{}).
+		Where("phase = ? AND did = ? AND status = ? AND lease_token = ?", phase, leased.DID, JobRunning, leased.LeaseToken).
+		Update("lease_until", time.Now().Add(lease))
+	if res.Error != nil {
+		return fmt.Errorf("failed to renew %s job lease for %s: %w", phase, leased.DID, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("failed to renew %s job lease for %s: %w", phase, leased.DID, errLeaseLost)
+	}
+	return nil
+}
+
+// heartbeat renews a job's lease every third of it until ctx is done,
+// and cancels the job when the lease was lost, so two workers never run the same account
+func (r *Runtime) heartbeat(ctx context.Context, cancel context.CancelCauseFunc, phase string, leased leasedJob, lease time.Duration, log zerolog.Logger) {
+	tick := time.NewTicker(lease / 3)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		err := r.renewLease(phase, leased, lease)
+		if errors.Is(err, errLeaseLost) {
+			log.Warn().Msgf("Lost the %s job lease for %s, stopping", phase, leased.DID)
+			cancel(errLeaseLost)
+			return
+		}
+		if err != nil {
+			// the lease is still ours until it expires, try again on the next tick
+			log.Warn().Err(err).Msgf("Failed to renew the %s job lease for %s", phase, leased.DID)
+		}
+	}
+}
+
+// runJobs works through the jobs of a phase with par workers, leasing a job whenever a worker frees up,
+// so no worker waits on a slow one and leases do not expire while queued in memory.
+// Leases are renewed while a job runs, process is cancelled through its ctx when one is lost.
+// Jobs rescheduled by failJob are retried in the same run when they come due within Cfg.BackfillRetryWait,
+// later retries are left for the next run.
+func (r *Runtime) runJobs(phase string, par int, log zerolog.Logger, process func(ctx context.Context, did string) error) error {
+	par = max(par, 1)
+	retryWait := time.Duration(r.Cfg.BackfillRetryWait) * time.Second
+	lease := time.Duration(r.Cfg.BackfillJobLease) * time.Second
+	if lease <= 0 {
+		lease = jobLease
+	}
+
+	// get total count of jobs to process for progress reporting
+	count, err := r.countRemainingJobs(phase)
+	if err != nil {
+		return err
+	}
+
+	var total atomic.Int64
+	var totalErr atomic.Int64
+	var wg sync.WaitGroup
+	defer wg.Wait()
 
-	return ids, nil
+	// a token per free worker, finished wakes the leasing loop when a job ends
+	idle := make(chan struct{}, par)
+	for range par {
+		idle <- struct{}{}
+	}
+	finished := make(chan struct{}, 1)
+
+	work := func(job leasedJob) {
+		defer wg.Done()
+		did := job.DID
+		ctx, cancel := context.WithCancelCause(r.Ctx)
+		go r.heartbeat(ctx, cancel, phase, job, lease, log)
+		err := process(ctx, did)
+		cancel(nil)
+		n := total.Add(1)
+		if err != nil {
+			totalErr.Add(1)
+			log.Error().Err(err).Msgf("Failed to process %s job for %s", phase, did)
+			if err := r.failJob(phase, job, err); err != nil {
+				log.Error().Err(err).Msgf("Failed to record job failure for %s", did)
+			}
+		} else if err := r.completeJob(phase, job); err != nil {
+			log.Error().Err(err).Msgf("Failed to record job completion for %s", did)
+		}
+		if n%jobProgressEvery == 0 {
+			log.Info().Msgf("Processing %d/%d jobs. Error: %d", n, count, totalErr.Load())
+		}
+		idle <- struct{}{}
+		select {
+		case finished <- struct{}{}:
+		default:
+		}
+	}
+
+	for {
+		// lease a job for every free worker
+		select {
+		case <-idle:
+		case <-r.Ctx.Done():
+			return r.Ctx.Err()
+		}
+		free := 1
+	drain:
+		for {
+			select {
+			case <-idle:
+				free++
+			default:
+				break drain
+			}
+		}
+
+		jobs, err := r.leaseJobs(phase, free, lease)
+		if err != nil {
+			return err
+		}
+		for range free - len(jobs) {
+			idle <- struct{}{}
+		}
+		for _, job := range jobs {
+			wg.Add(1)
+			go work(job)
+		}
+		if len(jobs) > 0 {
+			continue
+		}
+
+		// nothing is due, wait for a running job to end or the next retry
+		busy := len(idle) < par
+		next, err := r.nextJobRun(phase)
+		if err != nil {
+			return err
+		}
+		var retry <-chan time.Time
+		if !next.IsZero() && time.Until(next) <= retryWait {
+			if !busy {
+				log.Info().Msgf("Waiting until %s to retry failed jobs", next.Format(time.RFC3339))
+			}
+			retry = time.After(time.Until(next))
+		} else if !busy {
+			if !next.IsZero() {
+				log.Info().Msgf("Leaving retries due from %s for the next run", next.Format(time.RFC3339))
+			}
+			break
+		}
+		select {
+		case <-retry:
+		case <-finished:
+		case <-r.Ctx.Done():
+			return r.Ctx.Err()
+		}
+	}
+
+	log.Info().Msgf("Processed %d/%d jobs. Error: %d", total.Load(), count, totalErr.Load())
+	return nil
+}
+
+// completeJob marks a leased job as done, unless its lease was taken over.
+// The write is not cancelled with the runtime, so a job finished on shutdown is recorded.
+func (r *Runtime) completeJob(phase string, leased leasedJob) error {
+	res := r.DB.WithContext(context.WithoutCancel(r.Ctx)).Model(&db.BackfillJob{}).
+		Where("phase = ? AND did = ? AND lease_token = ?", phase, leased.DID, leased.LeaseToken).
+		Updates(map[string]any{
+			"status":     JobDone,
+			"last_error": "",
+		})
+	if res.Error != nil {
+		return fmt.Errorf("failed to complete %s job for %s: %w", phase, leased.DID, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("failed to complete %s job for %s: %w", phase, leased.DID, errLeaseLost)
+	}
+	return nil
+}
+
+// failJob records the error on a leased job and schedules a retry with backoff,
+// or marks it as failed once it has used up its attempts. Like completeJob it leaves
+// a job whose lease was taken over alone, and is not cancelled with the runtime,
+// so a job interrupted on shutdown is requeued rather than left running until its lease expires.
+func (r *Runtime) failJob(phase string, leased leasedJob, jobErr error) error {
+	ctx := context.WithoutCancel(r.Ctx)
+	did := leased.DID
+	var job db.BackfillJob
+	err := r.DB.WithContext(ctx).Model(&db.BackfillJob{}).
+		Where("phase = ? AND did = ? AND lease_token = ?", phase, did, leased.LeaseToken).
+		Take(&job).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("failed to fail %s job for %s: %w", phase, did, errLeaseLost)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get %s job for %s: %w", phase, did, err)
+	}
+
+	updates := map[string]any{
+		"last_error": jobErr.Error(),
+	}
+	if job.Attempts >= jobMaxAttempts {
+		updates["status"] = JobFailed
+	} else {
+		updates["status"] = JobQueued
+		updates["next_run_at"] = time.Now().Add(jobBackoff(job.Attempts))
+	}
+
+	res := r.DB.WithContext(ctx).Model(&db.BackfillJob{}).
+		Where("id = ? AND lease_token = ?", job.ID, leased.LeaseToken).
+		Updates(updates)
+	if res.Error != nil {
+		return fmt.Errorf("failed to fail %s job for %s: %w", phase, did, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("failed to fail %s job for %s: %w", phase, did, errLeaseLost)
+	}
+	return nil
+}
+
+// jobBackoff doubles the wait for each attempt, up to jobMaxBackoff
+func jobBackoff(attempts int) time.Duration {
+	d := jobBaseBackoff
+	for i := 1; i < attempts && d < jobMaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, jobMaxBackoff)
+}
+
+type JobStatusCount struct {
+	Phase  string
+	Status string
+	Count  int64
+}
+
+// JobStatusCounts reports the number of jobs per phase and status
+func (r *Runtime) JobStatusCounts() ([]JobStatusCount, error) {
+	var counts []JobStatusCount
+	err := r.DB.WithContext(r.Ctx).Model(&db.BackfillJob{}).
+		Select("phase, status, count(*) as count").
+		Group("phase, status").
+		Order("phase, status").
+		Scan(&counts).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to count jobs: %w", err)
+	}
+	return counts, nil
 }
@@ -1,11 +1,139 @@
 package runtime
 
 import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
 	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/rs/zerolog"
+
+	atdb "github.com/blebbit/atmunge/pkg/db"
+	"github.com/blebbit/atmunge/pkg/repo"
 )
 
+// RepoFetchOptions are the configured getRepo download limits,
+// downloading to dir and logging progress for large repos.
+func (r *Runtime) RepoFetchOptions(dir, did string) repo.GetRepoOptions {
+	log := zerolog.Ctx(r.Ctx).With().Str("module", "repo-fetch").Str("did", did).Logger()
+
+	return repo.GetRepoOptions{
+		Dir:      dir,
+		MaxBytes: int64(r.Cfg.RepoMaxSizeMb) << 20,
+		Timeout:  time.Duration(r.Cfg.RepoFetchTimeout) * time.Second,
+		Progress: func(read, total int64) {
+			log.Debug().Msgf("downloaded %d / %d bytes", read, total)
+		},
+	}
+}
+
+// BlobSyncOptions bounds blob syncs by the config, logging each blob
+func (r *Runtime) BlobSyncOptions(did string) repo.BlobSyncOptions {
+	log := zerolog.Ctx(r.Ctx).With().Str("module", "blob-sync").Str("did", did).Logger()
+
+	return repo.BlobSyncOptions{
+		Concurrency: r.Cfg.BlobConcurrency,
+		MaxBytes:    int64(r.Cfg.BlobMaxSizeMb) << 20,
+		Timeout:     time.Duration(r.Cfg.BlobFetchTimeout) * time.Second,
+		MimeTypes:   r.Cfg.BlobMimeTypes,
+		Shared:      r.Cfg.BlobStore == repo.BlobStoreShared,
+		Report: func(c string, size int64, err error) {
+			if err != nil {
+				log.Warn().Err(err).Msgf("failed to sync blob %s", c)
+				return
+			}
+			log.Debug().Msgf("synced blob %s (%d bytes)", c, size)
+		},
+	}
+}
+
+// VerifyRepo checks the signature on the root commit against the account's signing key
+func (r *Runtime) VerifyRepo(bs repo.Blockstore, did string) error {
+	key, err := r.SigningKey(r.Ctx, did)
+	if err != nil {
+		return fmt.Errorf("no signing key: %w", err)
+	}
+	commit, err := repo.VerifyCommit(bs, bs.Root(), key)
+	if err != nil {
+		return err
+	}
+	if commit.DID != did {
+		return fmt.Errorf("commit is for %s", commit.DID)
+	}
+	return nil
+}
+
+// RecordRepoChanges appends the record changes from oldRoot to the store's root to the
+// account's history file, returning a summary by collection for account_repos
+func (r *Runtime) RecordRepoChanges(bs repo.Blockstore, repoDir string, oldRoot cid.Cid, oldRev string) (atdb.JSONRaw, error) {
+	if oldRoot.Equals(bs.Root()) {
+		return json.Marshal(map[string]any{})
+	}
+	changes, err := repo.Diff(bs, oldRoot, bs, bs.Root(), repo.DiffOptions{})
+	if err != nil {
+		return nil, err
+	}
+	entry := repo.HistoryEntry{
+		Rev:     bs.Rev(),
+		Commit:  bs.Root().String(),
+		PrevRev: oldRev,
+		Time:    time.Now().UTC(),
+		Ops:     changes,
+	}
+	if err := repo.AppendHistory(filepath.Join(repoDir, repo.HistoryFile), entry); err != nil {
+		return nil, err
+	}
+	return json.Marshal(repo.SummarizeChanges(changes))
+}
+
+// updateRepoDBs applies a sync's record changes to the account's databases when enabled,
+// failures are logged since the sync itself succeeded and the next update compares the whole tree
+func (r *Runtime) updateRepoDBs(did string, bs repo.Blockstore, repoDir string) {
+	log := zerolog.Ctx(r.Ctx).With().Str("module", "repo-db").Str("did", did).Logger()
+
+	if r.Cfg.RepoSyncDuckDB {
+		up, err := repo.UpdateDuckDB(r.Ctx, bs, filepath.Join(repoDir, "repo.duckdb"), repo.UpdateOptions{})
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to update duckdb")
+		} else {
+			log.Debug().Msgf("duckdb at %s, %d created, %d updated, %d deleted", up.Rev, up.Created, up.Updated, up.Deleted)
+		}
+	}
+	if r.Cfg.RepoSyncSQLite {
+		up, err := repo.UpdateSQLite(r.Ctx, bs, filepath.Join(repoDir, "repo.sqlite"), repo.UpdateOptions{})
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to update sqlite")
+		} else {
+			log.Debug().Msgf("sqlite at %s, %d created, %d updated, %d deleted", up.Rev, up.Created, up.Updated, up.Deleted)
+		}
+	}
+}
+
+// compactRepo compacts a synced CAR, failures are logged since the sync itself succeeded
+func (r *Runtime) compactRepo(did, carPath string) {
+	log := zerolog.Ctx(r.Ctx).With().Str("module", "repo-compact").Str("did", did).Logger()
+
+	stats, err := repo.CompactCar(carPath, r.Cfg.RepoCompactKeep, r.Cfg.RepoCompressLevel)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to compact repo")
+		return
+	}
+	log.Debug().Msgf("kept %d of %d blocks, reclaimed %d bytes", stats.Kept, stats.Blocks, stats.Reclaimed())
+}
+
+// compressRepo keeps the CAR compressed at rest, failures leave it raw for the next sync
+func (r *Runtime) compressRepo(did, carPath string) {
+	log := zerolog.Ctx(r.Ctx).With().Str("module", "repo-compress").Str("did", did).Logger()
+
+	stats, err := repo.CompressCar(carPath, r.Cfg.RepoCompressLevel)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to compress repo")
+		return
+	}
+	log.Debug().Msgf("compressed %d bytes to %d (%.2fx)", stats.Raw, stats.Compressed, stats.Ratio())
+}
+
 func (r *Runtime) StartRepoMirror() {
 	log := zerolog.Ctx(r.Ctx).With().Str("module", "repo-mirror").Logger()
 	for {
@@ -2,17 +2,23 @@ package runtime
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
 	"time"
 
+	"github.com/rs/zerolog"
 	"golang.org/x/time/rate"
 	"gorm.io/gorm"
 
 	"github.com/blebbit/atmunge/pkg/config"
 	"github.com/blebbit/atmunge/pkg/db"
+	"github.com/blebbit/atmunge/pkg/lexicon"
+	"github.com/blebbit/atmunge/pkg/repo"
 	"github.com/blebbit/atmunge/pkg/rlproxy"
+	"github.com/blebbit/atmunge/pkg/storage"
+	"github.com/blebbit/atmunge/pkg/util/cassette"
 )
 
 type Runtime struct {
@@ -22,6 +28,11 @@ type Runtime struct {
 	DB     *gorm.DB
 	Proxy  *rlproxy.Proxy
 	Client *http.Client
+	Retry  rlproxy.RetryPolicy
+	// Store keeps repo artifacts, RepoDataDir is its local cache
+	Store storage.Storage
+	// layout is resolved from the config once, see Layout
+	layout repo.Layout
 
 	// PLC mirror fields
 	MaxDelay            time.Duration
@@ -33,6 +44,14 @@ type Runtime struct {
 	acctMutex            sync.RWMutex
 	lastAccountId        int
 	lastAccountTimestamp time.Time
+
+	// the recording transport, saved on Close
+	cassette *cassette.Transport
+
+	// stops persistProxyState, which closes proxyStateDone once it returns
+	proxyStateStop chan struct{}
+	proxyStateDone chan struct{}
+	closeOnce      sync.Once
 }
 
 func NewRuntime(ctx context.Context) (*Runtime, error) {
@@ -42,14 +61,63 @@ func NewRuntime(ctx context.Context) (*Runtime, error) {
 	}
 
 	client := &http.Client{}
+	var tape *cassette.Transport
+	if appCfg.HTTPCassette != "" {
+		tape, err = cassette.New(appCfg.HTTPCassette, cassette.Mode(appCfg.HTTPCassetteMode), nil)
+		if err != nil {
+			return nil, err
+		}
+		client = tape.Client()
+	}
+
+	proxyOpts := rlproxy.Options{
+		MaxConcurrency:   appCfg.ProxyMaxConcurrency,
+		BreakerThreshold: appCfg.ProxyBreakerThreshold,
+		BreakerCooldown:  time.Duration(appCfg.ProxyBreakerCooldown) * time.Second,
+		HostGroups:       appCfg.ProxyHostGroups,
+		Overrides:        appCfg.ProxyHostLimits,
+	}
 
 	r := &Runtime{
 		Ctx:      ctx,
 		Cfg:      appCfg,
-		Proxy:    rlproxy.New(client),
+		Proxy:    rlproxy.NewWithOptions(client, proxyOpts),
 		Client:   client,
+		cassette: tape,
 		limiter:  rate.NewLimiter(plcRateLimit, 4),
 		MaxDelay: plcMaxDelay,
+		Retry: rlproxy.RetryPolicy{
+			MaxAttempts: appCfg.ProxyRetryAttempts,
+			BaseDelay:   time.Duration(appCfg.ProxyRetryBaseMs) * time.Millisecond,
+			MaxDelay:    time.Duration(appCfg.ProxyRetryMaxMs) * time.Millisecond,
+		},
+	}
+
+	r.layout, err = repo.NewLayout(r.Cfg.RepoLayout, r.Cfg.RepoDataDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := repo.CheckBlobStore(r.Cfg.BlobStore); err != nil {
+		return nil, err
+	}
+	if len(r.Cfg.LexiconDirs) > 0 {
+		v, err := lexicon.New(r.Cfg.LexiconDirs...)
+		if err != nil {
+			return nil, err
+		}
+		lexicon.SetDefault(v)
+	}
+	if r.Cfg.RepoStorage != "" {
+		r.Store, err = storage.Open(ctx, r.Cfg.RepoStorage, storage.S3Options{
+			Endpoint:  r.Cfg.S3Endpoint,
+			Region:    r.Cfg.S3Region,
+			AccessKey: r.Cfg.S3AccessKey,
+			SecretKey: r.Cfg.S3SecretKey,
+			Insecure:  r.Cfg.S3Insecure,
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if r.Cfg.DBUrl != "" {
@@ -61,6 +129,12 @@ func NewRuntime(ctx context.Context) (*Runtime, error) {
 		r.DB = DB
 	}
 
+	if r.Cfg.ProxyStateFile != "" {
+		if err := r.startProxyState(); err != nil {
+			return nil, err
+		}
+	}
+
 	return r, nil
 }
 
@@ -92,3 +166,64 @@ func (r *Runtime) LastRecordTimestamp(ctx context.Context) (time.Time, error) {
 	}
 	return dbTimestamp, nil
 }
+
+// Close saves the learned proxy state and any recorded cassette before the process exits, logging failures.
+// Commands defer it after creating the runtime, their context is not cancelled on a normal exit.
+func (r *Runtime) Close() error {
+	var errs []error
+	r.closeOnce.Do(func() {
+		log := zerolog.Ctx(r.Ctx)
+		if r.proxyStateStop != nil {
+			close(r.proxyStateStop)
+			<-r.proxyStateDone
+			if err := r.Proxy.SaveState(r.Cfg.ProxyStateFile); err != nil {
+				log.Error().Err(err).Str("module", "rlproxy").Msg("failed to save rlproxy state")
+				errs = append(errs, err)
+			}
+		}
+		if r.cassette != nil {
+			if err := r.cassette.Save(); err != nil {
+				log.Error().Err(err).Str("module", "cassette").Msg("failed to save cassette")
+				errs = append(errs, err)
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// startProxyState restores the learned proxy state and saves it as it changes, until Close
+func (r *Runtime) startProxyState() error {
+	if err := r.Proxy.LoadState(r.Cfg.ProxyStateFile); err != nil {
+		return err
+	}
+	r.proxyStateStop = make(chan struct{})
+	r.proxyStateDone = make(chan struct{})
+	go r.persistProxyState()
+	return nil
+}
+
+// persistProxyState periodically saves what the proxy has learned about host rate limits
+func (r *Runtime) persistProxyState() {
+	log := zerolog.Ctx(r.Ctx).With().Str("module", "rlproxy").Logger()
+	defer close(r.proxyStateDone)
+
+	ticker := time.NewTicker(proxyStateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.proxyStateStop:
+			// Close saves the final state
+			return
+		case <-r.Ctx.Done():
+			if err := r.Proxy.SaveState(r.Cfg.ProxyStateFile); err != nil {
+				log.Error().Err(err).Msgf("failed to save rlproxy state")
+			}
+			return
+		case <-ticker.C:
+			if err := r.Proxy.SaveState(r.Cfg.ProxyStateFile); err != nil {
+				log.Error().Err(err).Msgf("failed to save rlproxy state")
+			}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package runtime
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/blebbit/atmunge/pkg/config"
+	atdb "github.com/blebbit/atmunge/pkg/db"
+	"github.com/blebbit/atmunge/pkg/repo"
+	"github.com/blebbit/atmunge/pkg/rlproxy"
+	"github.com/blebbit/atmunge/pkg/storage"
+	"github.com/blebbit/atmunge/pkg/util/cassette"
+)
+
+const (
+	testDID  = "did:plc:abcdefghijklmnopqrstuvwx"
+	testDID2 = "did:plc:zyxwvutsrqponmlkjihgfedc"
+)
+
+// newTestRuntime creates a Runtime using client for HTTP,
+// backed by a sqlite database in place of postgres
+func newTestRuntime(t *testing.T, client *http.Client) *Runtime {
+	t.Helper()
+
+	// unmatched requests are retried by some loops, so bound the test
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "atmunge.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sqlite allows a single writer, so workers share one connection
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	if err := atdb.MigrateModels(db); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		PlcUpstream: "https://plc.directory/export",
+		RepoDataDir: t.TempDir(),
+	}
+	layout, err := repo.NewLayout(cfg.RepoLayout, cfg.RepoDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Runtime{
+		Ctx:      ctx,
+		Cfg:      cfg,
+		layout:   layout,
+		DB:       db,
+		Proxy:    rlproxy.New(client),
+		Client:   client,
+		limiter:  rate.NewLimiter(rate.Inf, 1),
+		MaxDelay: plcMaxDelay,
+	}
+}
+
+// newReplayRuntime creates a test Runtime replaying HTTP from a cassette in testdata
+func newReplayRuntime(t *testing.T, name string) *Runtime {
+	t.Helper()
+
+	tr, err := cassette.New(filepath.Join("testdata", name), cassette.ModeReplay, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestRuntime(t, tr.Client())
+}
+
+func TestBackfillPlcLogs(t *testing.T) {
+	r := newReplayRuntime(t, "plc-export.json")
+
+	if err := r.BackfillPlcLogs(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Ctx.Err() != nil {
+		t.Fatal("backfill did not catch up before the test timeout")
+	}
+
+	var entries []atdb.PLCLogEntry
+	if err := r.DB.Order("plc_timestamp").Find(&entries).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d plc log entries, want 2", len(entries))
+	}
+	if entries[0].DID != testDID || entries[1].DID != testDID2 {
+		t.Errorf("got DIDs %s, %s", entries[0].DID, entries[1].DID)
+	}
+
+	var info atdb.AccountInfo
+	if err := r.DB.Where("did = ?", testDID).First(&info).Error; err != nil {
+		t.Fatal(err)
+	}
+	if info.PDS != "https://pds.test" || info.Handle != "alice.pds.test" {
+		t.Errorf("got account info pds=%q handle=%q", info.PDS, info.Handle)
+	}
+
+	want := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	if !r.lastRecordTimestamp.Equal(want) {
+		t.Errorf("lastRecordTimestamp = %s, want %s", r.lastRecordTimestamp, want)
+	}
+}
+
+func TestProcessRepoDescribe(t *testing.T) {
+	r := newReplayRuntime(t, "describe-repo.json")
+
+	repos := []atdb.PdsRepo{
+		{PDS: "https://pds.test", DID: testDID, Active: true},
+		{PDS: "https://pds.test", DID: testDID2, Active: true},
+	}
+	if err := r.DB.Create(&repos).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// active repo, describe is stored
+	if err := r.processRepoDescribe(r.Ctx, testDID); err != nil {
+		t.Fatal(err)
+	}
+	var info atdb.AccountInfo
+	if err := r.DB.Where("did = ?", testDID).First(&info).Error; err != nil {
+		t.Fatal(err)
+	}
+	if info.PDS != "https://pds.test" || len(info.Describe) == 0 {
+		t.Errorf("got account info pds=%q describe=%q", info.PDS, info.Describe)
+	}
+
+	// taken down repo, status is recorded
+	if err := r.processRepoDescribe(r.Ctx, testDID2); err != nil {
+		t.Fatal(err)
+	}
+	var repo atdb.PdsRepo
+	if err := r.DB.Where("did = ?", testDID2).First(&repo).Error; err != nil {
+		t.Fatal(err)
+	}
+	if repo.Status != "takendown" {
+		t.Errorf("got status %q, want takendown", repo.Status)
+	}
+}
+
+func TestCloseSavesProxyState(t *testing.T) {
+	r := newTestRuntime(t, &http.Client{})
+	r.Cfg.ProxyStateFile = filepath.Join(t.TempDir(), "rlproxy-state.json")
+	if err := r.startProxyState(); err != nil {
+		t.Fatal(err)
+	}
+
+	// learned well before the periodic save
+	r.Proxy.Restore([]rlproxy.HostState{{Host: "pds.test", Limit: 20, Burst: 40}})
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := rlproxy.New(nil)
+	if err := p.LoadState(r.Cfg.ProxyStateFile); err != nil {
+		t.Fatal(err)
+	}
+	if states := p.Snapshot(); len(states) != 1 || states[0].Limit != 20 {
+		t.Errorf("got saved state %+v, want the learned pds.test limit", states)
+	}
+}
+
+func TestPullRepoFilesSameSize(t *testing.T) {
+	r := newTestRuntime(t, &http.Client{})
+	store := storage.NewLocal(t.TempDir())
+	r.Store = store
+	layout := r.Layout()
+	key := layout.Key(testDID, repo.HistoryFile)
+	local := layout.Path(testDID, repo.HistoryFile)
+
+	put := func(content string, mtime time.Time) {
+		t.Helper()
+		if err := store.Put(r.Ctx, key, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(store.Path(key), time.Time{}, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pull := func(want string) {
+		t.Helper()
+		if err := r.PullRepoFiles(testDID); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("got cached %q, want %q", b, want)
+		}
+	}
+
+	now := time.Now()
+	put("rev-one\n", now.Add(-time.Hour))
+	pull("rev-one\n")
+
+	// rewritten with the same length
+	put("rev-two\n", now)
+	pull("rev-two\n")
+
+	// pushing keeps the cache fresh
+	if err := os.WriteFile(local, []byte("rev-333\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.PushRepoFiles(testDID); err != nil {
+		t.Fatal(err)
+	}
+	pull("rev-333\n")
+}
+
+func TestWalkRepos(t *testing.T) {
+	r := newTestRuntime(t, &http.Client{})
+	store := storage.NewLocal(t.TempDir())
+	r.Store = store
+	layout := r.Layout()
+
+	// accounts with a CAR in the store, not in the cache, a compressed one counted once
+	for key, content := range map[string]string{
+		layout.Key(testDID, "repo.car"):                       "car",
+		layout.Key(testDID, "repo.car"+repo.CompressedSuffix): "zst",
+		layout.Key(testDID2, repo.HistoryFile):                "{}",
+	} {
+		if err := store.Put(r.Ctx, key, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var dids []string
+	err := r.WalkRepos(func(did string) error {
+		dids = append(dids, did)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dids) != 1 || dids[0] != testDID {
+		t.Errorf("got accounts %v, want %s", dids, testDID)
+	}
+}
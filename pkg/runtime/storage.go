@@ -0,0 +1,142 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/blebbit/atmunge/pkg/repo"
+	"github.com/blebbit/atmunge/pkg/storage"
+)
+
+// repoFiles are the per-account artifacts synced between RepoDataDir and RepoStorage,
+// the CAR is kept raw or compressed
+var repoFiles = []string{"repo.car", "repo.car" + repo.CompressedSuffix, repo.HistoryFile, repo.BlobIndexFile}
+
+// Layout resolves the paths of account files in RepoDataDir, and their keys in the store.
+// It is resolved from the config by NewRuntime, later config changes do not affect it.
+func (r *Runtime) Layout() repo.Layout {
+	return r.layout
+}
+
+// RepoStore is where repo artifacts are kept.
+func (r *Runtime) RepoStore() storage.Storage {
+	if r.Store == nil {
+		return storage.NewLocal(r.Cfg.RepoDataDir)
+	}
+	return r.Store
+}
+
+// storeIsCache is true when artifacts are only kept in RepoDataDir,
+// so there is nothing to pull or push
+func (r *Runtime) storeIsCache() bool {
+	l, ok := r.RepoStore().(*storage.Local)
+	return ok && filepath.Clean(l.Dir) == filepath.Clean(r.Cfg.RepoDataDir)
+}
+
+// WalkRepos calls fn with every account that has a CAR in the repo store,
+// listing RepoStorage when RepoDataDir is only its cache.
+func (r *Runtime) WalkRepos(fn func(did string) error) error {
+	layout := r.Layout()
+	if r.storeIsCache() {
+		return layout.Walk(func(did, _ string) error {
+			return fn(did)
+		})
+	}
+	seen := make(map[string]bool)
+	return r.RepoStore().List(r.Ctx, "", func(oi storage.ObjectInfo) error {
+		did, name, ok := layout.ParseKey(oi.Key)
+		if !ok || (name != "repo.car" && name != "repo.car"+repo.CompressedSuffix) || seen[did] {
+			return nil
+		}
+		seen[did] = true
+		return fn(did)
+	})
+}
+
+// PullRepoFiles refreshes an account's files in the local cache from the store,
+// when they are missing or differ in size or modification time from the stored object.
+func (r *Runtime) PullRepoFiles(did string) error {
+	if r.storeIsCache() {
+		return nil
+	}
+	store := r.RepoStore()
+	layout := r.Layout()
+	for _, name := range repoFiles {
+		key := layout.Key(did, name)
+		local := layout.Path(did, name)
+
+		info, err := store.Stat(r.Ctx, key)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", key, err)
+		}
+		if cachedFresh(local, info) {
+			continue
+		}
+		if err := storage.GetFile(r.Ctx, store, key, local); err != nil {
+			return err
+		}
+		if err := stampModTime(local, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PushRepoFiles uploads an account's files from the local cache to the store.
+func (r *Runtime) PushRepoFiles(did string) error {
+	if r.storeIsCache() {
+		return nil
+	}
+	store := r.RepoStore()
+	layout := r.Layout()
+	for _, name := range repoFiles {
+		local := layout.Path(did, name)
+		if _, err := os.Stat(local); errors.Is(err, os.ErrNotExist) {
+			// drop the other form of the CAR after it was compressed or inflated
+			if strings.HasPrefix(name, "repo.car") {
+				if err := store.Delete(r.Ctx, layout.Key(did, name)); err != nil {
+					return fmt.Errorf("failed to remove %s for %s: %w", name, did, err)
+				}
+			}
+			continue
+		}
+		key := layout.Key(did, name)
+		if err := storage.PutFile(r.Ctx, store, key, local); err != nil {
+			return fmt.Errorf("failed to upload %s for %s: %w", name, did, err)
+		}
+		info, err := store.Stat(r.Ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", key, err)
+		}
+		if err := stampModTime(local, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cachedFresh is true when the local file is the copy last pulled or pushed for the object,
+// the same size alone misses index files rewritten with the same length
+func cachedFresh(local string, info *storage.ObjectInfo) bool {
+	fi, err := os.Stat(local)
+	if err != nil {
+		return false
+	}
+	// S3 keeps modification times to the second
+	return fi.Size() == info.Size && fi.ModTime().Unix() == info.ModTime.Unix()
+}
+
+// stampModTime sets the local file's modification time to the object's, for cachedFresh
+func stampModTime(local string, info *storage.ObjectInfo) error {
+	if err := os.Chtimes(local, time.Time{}, info.ModTime); err != nil {
+		return fmt.Errorf("failed to set modification time of %s: %w", local, err)
+	}
+	return nil
+}
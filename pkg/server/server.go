@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"gorm.io/gorm"
 
@@ -35,6 +36,7 @@ func NewServer(r *runtime.Runtime) *Server {
 	})
 
 	e.GET("/ready", s.Ready)
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
 	e.GET("/:did", s.DidDoc)
 	e.GET("/info/:acct", s.Info)
 	e.GET("/autocomplete/:token", s.Autocomplete)
@@ -0,0 +1,19 @@
+-- extract blob refs ($type: blob) anywhere in a record,
+-- avatars, banners, post images, video, ...
+INSERT INTO blobs (source, did, nsid, rkey, path, cid, mime_type, size)
+SELECT
+  r.cuid as source,
+  r.did as did,
+  r.nsid as nsid,
+  r.rkey as rkey,
+  t.fullkey as path,
+  json_extract_string(t.value, '$.ref."$link"') as cid,
+  json_extract_string(t.value, '$.mimeType') as mime_type,
+  CAST(json_extract(t.value, '$.size') AS BIGINT) as size
+FROM
+  records AS r,
+  json_tree(r.record) AS t
+WHERE
+  t.type = 'OBJECT'
+  AND json_extract_string(t.value, '$."$type"') = 'blob'
+ON CONFLICT (source, path) DO NOTHING;
@@ -0,0 +1,16 @@
+-- blob refs we extract from records
+CREATE TABLE IF NOT EXISTS blobs (
+  -- where the ref was found
+  source TEXT, -- a cuid
+  did TEXT,
+  nsid TEXT,
+  rkey TEXT,
+  path TEXT, -- json path in the record, e.g. $.embed.images[0].image
+
+  -- the blob
+  cid TEXT,
+  mime_type TEXT,
+  size BIGINT,
+
+  UNIQUE(source, path)
+);
@@ -0,0 +1,8 @@
+-- the commit the records of an account reflect, updates diff from it
+CREATE TABLE IF NOT EXISTS repo_state (
+  did TEXT PRIMARY KEY,
+  rev VARCHAR,
+  root VARCHAR, -- commit cid
+
+  updated_at TIMESTAMP
+);
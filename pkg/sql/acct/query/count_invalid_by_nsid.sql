@@ -0,0 +1,12 @@
+SELECT
+  nsid,
+  count(*) FILTER (WHERE extra->>'$.validation.status' = 'valid') AS valid,
+  count(*) FILTER (WHERE extra->>'$.validation.status' = 'invalid') AS invalid,
+  count(*) FILTER (WHERE extra->>'$.validation.status' = 'unknown') AS unknown,
+  -- converted before validation, rerun the duckdb phase
+  count(*) FILTER (WHERE extra->>'$.validation.status' IS NULL) AS unchecked,
+  any_value(extra->>'$.validation.error') FILTER (WHERE extra->>'$.validation.status' = 'invalid') AS example_error
+FROM
+  records
+GROUP BY nsid
+ORDER BY invalid desc, nsid;
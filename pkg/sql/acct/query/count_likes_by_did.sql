@@ -1,8 +1,8 @@
 SELECT
-  split_part(record->'$.subject.uri', '/', 3) as did,
+  split_part(json_extract_string(record, '$.subject.uri'), '/', 3) as did,
   count(*) as likes
 FROM records
   WHERE nsid = 'app.bsky.feed.like'
-GROUP BY did
+GROUP BY 1
 ORDER BY likes desc
-LIMIT 32;
\ No newline at end of file
+LIMIT 32;
@@ -0,0 +1,10 @@
+SELECT
+  lang,
+  count(*) FILTER (WHERE reply_parent_uri IS NULL) as posts,
+  count(*) FILTER (WHERE reply_parent_uri IS NOT NULL) as replies
+FROM (
+  SELECT unnest(coalesce(langs, ['']::VARCHAR[])) as lang, reply_parent_uri
+  FROM posts
+)
+GROUP BY lang
+ORDER BY posts + replies desc;
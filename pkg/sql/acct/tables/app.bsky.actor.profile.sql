@@ -0,0 +1,16 @@
+-- profiles, with the avatar and banner blob cids
+SELECT
+  r.cuid,
+  r.did,
+  r.rkey,
+  r.cid,
+  TRY_CAST(json_extract_string(r.record, '$.createdAt') AS TIMESTAMPTZ) AS created_at,
+  json_extract_string(r.record, '$.displayName') AS display_name,
+  json_extract_string(r.record, '$.description') AS description,
+  json_extract_string(r.record, '$.avatar.ref."$link"') AS avatar_cid,
+  json_extract_string(r.record, '$.banner.ref."$link"') AS banner_cid,
+  json_extract_string(r.record, '$.pinnedPost.uri') AS pinned_post_uri
+FROM
+  records AS r
+WHERE
+  r.nsid = 'app.bsky.actor.profile'
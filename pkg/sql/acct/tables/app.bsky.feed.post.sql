@@ -0,0 +1,27 @@
+-- posts, with the reply, embed and quote targets flattened
+SELECT
+  r.cuid,
+  r.did,
+  r.rkey,
+  r.cid,
+  TRY_CAST(json_extract_string(r.record, '$.createdAt') AS TIMESTAMPTZ) AS created_at,
+  json_extract_string(r.record, '$.text') AS text,
+  CAST(json_extract(r.record, '$.langs') AS VARCHAR[]) AS langs,
+  json_extract_string(r.record, '$.reply.root.uri') AS reply_root_uri,
+  json_extract_string(r.record, '$.reply.parent.uri') AS reply_parent_uri,
+  json_extract_string(r.record, '$.embed."$type"') AS embed_type,
+  coalesce(
+    json_extract_string(r.record, '$.embed.record.record.uri'),
+    json_extract_string(r.record, '$.embed.record.uri')
+  ) AS quote_uri,
+  json_extract_string(r.record, '$.embed.external.uri') AS external_uri,
+  CAST(coalesce(
+    json_array_length(r.record, '$.embed.images'),
+    json_array_length(r.record, '$.embed.media.images'),
+    0
+  ) AS INTEGER) AS image_count,
+  json_extract(r.record, '$.facets') AS facets
+FROM
+  records AS r
+WHERE
+  r.nsid = 'app.bsky.feed.post'
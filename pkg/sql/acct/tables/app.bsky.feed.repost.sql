@@ -0,0 +1,16 @@
+-- reposts, the subject uri split into its parts
+SELECT
+  r.cuid,
+  r.did,
+  r.rkey,
+  r.cid,
+  TRY_CAST(json_extract_string(r.record, '$.createdAt') AS TIMESTAMPTZ) AS created_at,
+  json_extract_string(r.record, '$.subject.uri') AS subject_uri,
+  json_extract_string(r.record, '$.subject.cid') AS subject_cid,
+  split_part(json_extract_string(r.record, '$.subject.uri'), '/', 3) AS subject_did,
+  split_part(json_extract_string(r.record, '$.subject.uri'), '/', 4) AS subject_nsid,
+  split_part(json_extract_string(r.record, '$.subject.uri'), '/', 5) AS subject_rkey
+FROM
+  records AS r
+WHERE
+  r.nsid = 'app.bsky.feed.repost'
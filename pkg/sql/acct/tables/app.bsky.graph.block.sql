@@ -0,0 +1,12 @@
+-- blocks
+SELECT
+  r.cuid,
+  r.did,
+  r.rkey,
+  r.cid,
+  TRY_CAST(json_extract_string(r.record, '$.createdAt') AS TIMESTAMPTZ) AS created_at,
+  json_extract_string(r.record, '$.subject') AS subject
+FROM
+  records AS r
+WHERE
+  r.nsid = 'app.bsky.graph.block'
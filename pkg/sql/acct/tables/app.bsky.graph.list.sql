@@ -0,0 +1,15 @@
+-- lists, purpose is a modlist, curatelist or referencelist token
+SELECT
+  r.cuid,
+  r.did,
+  r.rkey,
+  r.cid,
+  TRY_CAST(json_extract_string(r.record, '$.createdAt') AS TIMESTAMPTZ) AS created_at,
+  json_extract_string(r.record, '$.name') AS name,
+  json_extract_string(r.record, '$.purpose') AS purpose,
+  json_extract_string(r.record, '$.description') AS description,
+  json_extract_string(r.record, '$.avatar.ref."$link"') AS avatar_cid
+FROM
+  records AS r
+WHERE
+  r.nsid = 'app.bsky.graph.list'
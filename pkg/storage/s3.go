@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3 keeps objects in a bucket of an S3-compatible store (AWS, R2, MinIO, ...).
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 connects to the bucket, creating it when it does not exist.
+// Keys are stored under prefix when it is set.
+func NewS3(ctx context.Context, bucket, prefix string, opts S3Options) (*S3, error) {
+	if opts.Endpoint == "" {
+		opts.Endpoint = "s3.amazonaws.com"
+	}
+	var creds *credentials.Credentials
+	if opts.AccessKey != "" {
+		creds = credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, "")
+	} else {
+		creds = credentials.NewEnvAWS()
+	}
+	client, err := minio.New(opts.Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: !opts.Insecure,
+		Region: opts.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %w", err)
+	}
+
+	ok, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket %s: %w", bucket, err)
+	}
+	if !ok {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: opts.Region}); err != nil {
+			return nil, fmt.Errorf("failed to create bucket %s: %w", bucket, err)
+		}
+	}
+	return &S3{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *S3) object(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, s.bucket, s.object(key), r, size, minio.PutObjectOptions{})
+	return err
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.object(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s.err(err)
+	}
+	// GetObject is lazy, stat to surface missing keys here rather than on the first read
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, s.err(err)
+	}
+	return obj, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, s.object(key), minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s.err(err)
+	}
+	return &ObjectInfo{Key: key, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	return s.err(s.client.RemoveObject(ctx, s.bucket, s.object(key), minio.RemoveObjectOptions{}))
+}
+
+func (s *S3) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	strip := 0
+	if s.prefix != "" {
+		strip = len(s.prefix) + 1
+	}
+	objs := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.object(prefix),
+		Recursive: true,
+	})
+	for obj := range objs {
+		if obj.Err != nil {
+			return s.err(obj.Err)
+		}
+		if err := fn(ObjectInfo{Key: obj.Key[strip:], Size: obj.Size, ModTime: obj.LastModified}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// err maps missing keys to ErrNotFound
+func (s *S3) err(err error) error {
+	if err == nil {
+		return nil
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	return err
+}
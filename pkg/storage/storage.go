@@ -0,0 +1,117 @@
+// Package storage abstracts where repo artifacts (CARs, history, blobs) are kept,
+// either a local directory or an S3-compatible bucket.
+// Keys are slash separated paths like <did>/repo.car.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned for keys that do not exist.
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage is a flat key / object store.
+type Storage interface {
+	// Put stores size bytes from r under key, replacing any existing object
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get opens the object under key, the caller closes it
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every object with the key prefix, stopping at the first error
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+// S3Options configure the S3 client for s3:// URLs.
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// Insecure talks plain http, for a local MinIO
+	Insecure bool
+}
+
+// Open returns the storage for a URL:
+// a plain path or file:///path for a local directory, s3://bucket/prefix for a bucket.
+func Open(ctx context.Context, rawURL string, s3 S3Options) (Storage, error) {
+	if !strings.Contains(rawURL, "://") {
+		return NewLocal(rawURL), nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage url: %w", err)
+	}
+	switch u.Scheme {
+	case "file":
+		return NewLocal(u.Path), nil
+	case "s3":
+		return NewS3(ctx, u.Host, strings.Trim(u.Path, "/"), s3)
+	default:
+		return nil, fmt.Errorf("unsupported storage url scheme: %q", u.Scheme)
+	}
+}
+
+// Exists reports whether key is in the store.
+func Exists(ctx context.Context, s Storage, key string) (bool, error) {
+	_, err := s.Stat(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// PutFile uploads a local file to key.
+func PutFile(ctx context.Context, s Storage, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, key, f, fi.Size())
+}
+
+// GetFile downloads key to a local file, replacing it only once the download completes.
+func GetFile(ctx context.Context, s Storage, key, path string) error {
+	rc, err := s.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, rc)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	return os.Rename(f.Name(), path)
+}
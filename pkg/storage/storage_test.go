@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestLocal(t *testing.T) {
+	testStorage(t, NewLocal(t.TempDir()))
+}
+
+// TestS3 runs against a real bucket, e.g. the minio service in docker-compose.yml:
+//
+//	ATMUNGE_TEST_S3_ENDPOINT=localhost:9000 ATMUNGE_TEST_S3_ACCESS_KEY=atmunge ATMUNGE_TEST_S3_SECRET_KEY=atmunge-secret go test ./pkg/storage
+func TestS3(t *testing.T) {
+	endpoint := os.Getenv("ATMUNGE_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("ATMUNGE_TEST_S3_ENDPOINT not set")
+	}
+	ctx := context.Background()
+	prefix := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	s, err := Open(ctx, "s3://atmunge-test/"+prefix, S3Options{
+		Endpoint:  endpoint,
+		AccessKey: os.Getenv("ATMUNGE_TEST_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("ATMUNGE_TEST_S3_SECRET_KEY"),
+		Insecure:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s)
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	for _, u := range []string{dir, "file://" + dir} {
+		s, err := Open(context.Background(), u, S3Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l, ok := s.(*Local); !ok || l.Dir != dir {
+			t.Errorf("Open(%q) = %#v, want local %s", u, s, dir)
+		}
+	}
+	if _, err := Open(context.Background(), "ftp://host/dir", S3Options{}); err == nil {
+		t.Error("expected an error for an unsupported scheme")
+	}
+}
+
+// testStorage checks the behaviour every backend must share
+func testStorage(t *testing.T, s Storage) {
+	ctx := context.Background()
+	did := "did:plc:abc123"
+
+	if _, err := s.Stat(ctx, did+"/repo.car"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Stat on a missing key = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Get(ctx, did+"/repo.car"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get on a missing key = %v, want ErrNotFound", err)
+	}
+	if ok, err := Exists(ctx, s, did+"/repo.car"); err != nil || ok {
+		t.Fatalf("Exists on a missing key = %v, %v", ok, err)
+	}
+
+	put := func(key, data string) {
+		t.Helper()
+		if err := s.Put(ctx, key, bytes.NewReader([]byte(data)), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(did+"/repo.car", "car v1")
+	put(did+"/repo.car", "car v2 replaced")
+	put(did+"/blobs/bafkrei1.blob", "blob one")
+	put(did+"/blobs/bafkrei2.blob", "blob two")
+	put("did:plc:other/repo.car", "other")
+
+	info, err := s.Stat(ctx, did+"/repo.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Key != did+"/repo.car" || info.Size != int64(len("car v2 replaced")) {
+		t.Errorf("Stat = %+v", info)
+	}
+
+	rc, err := s.Get(ctx, did+"/repo.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "car v2 replaced" {
+		t.Errorf("Get = %q", got)
+	}
+
+	list := func(prefix string) []string {
+		t.Helper()
+		var keys []string
+		err := s.List(ctx, prefix, func(oi ObjectInfo) error {
+			keys = append(keys, oi.Key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	if keys := list(did + "/blobs/"); len(keys) != 2 || keys[0] != did+"/blobs/bafkrei1.blob" {
+		t.Errorf("List blobs = %v", keys)
+	}
+	if keys := list(did + "/"); len(keys) != 3 {
+		t.Errorf("List account = %v", keys)
+	}
+	if keys := list("did:plc:missing/"); len(keys) != 0 {
+		t.Errorf("List missing prefix = %v", keys)
+	}
+
+	// file helpers round trip through the store
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.car")
+	if err := os.WriteFile(src, []byte("from a file"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutFile(ctx, s, did+"/file.car", src); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "cache", did, "file.car")
+	if err := GetFile(ctx, s, did+"/file.car", dst); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(dst); string(b) != "from a file" {
+		t.Errorf("GetFile wrote %q", b)
+	}
+
+	if err := s.Delete(ctx, did+"/blobs/bafkrei1.blob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, did+"/blobs/bafkrei1.blob"); err != nil {
+		t.Fatalf("Delete on a missing key = %v", err)
+	}
+	if ok, err := Exists(ctx, s, did+"/blobs/bafkrei1.blob"); err != nil || ok {
+		t.Errorf("Exists after delete = %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,229 @@
+// Package cassette provides a record/replay http.RoundTripper,
+// so code that talks to PDSes, relays, and plc.directory can be tested offline.
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"unicode/utf8"
+)
+
+type Mode string
+
+const (
+	// ModeReplay serves responses from the cassette and never touches the network
+	ModeReplay Mode = "replay"
+	// ModeRecord passes requests through and appends them to the cassette, written out by Save
+	ModeRecord Mode = "record"
+)
+
+// ErrNoInteraction is returned in replay mode when no recorded interaction matches a request.
+var ErrNoInteraction = errors.New("cassette: no recorded interaction for request")
+
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+type Request struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+type Response struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers,omitempty"`
+	// Body is used for text, BodyBase64 for binary (e.g. CAR files)
+	Body       string `json:"body,omitempty"`
+	BodyBase64 []byte `json:"bodyBase64,omitempty"`
+}
+
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Transport is an http.RoundTripper which records to or replays from a cassette file.
+type Transport struct {
+	mode Mode
+	path string
+	next http.RoundTripper
+
+	mu       sync.Mutex
+	cassette Cassette
+	used     []bool
+	// interactions recorded since the last Save
+	unsaved bool
+}
+
+// New creates a Transport for the cassette at path.
+// In replay mode the file must exist, in record mode it is created or appended to.
+// next is the transport used when recording, http.DefaultTransport when nil.
+func New(path string, mode Mode, next http.RoundTripper) (*Transport, error) {
+	if mode != ModeReplay && mode != ModeRecord {
+		return nil, fmt.Errorf("cassette: unknown mode %q", mode)
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	t := &Transport{
+		mode: mode,
+		path: path,
+		next: next,
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if mode == ModeRecord && errors.Is(err, os.ErrNotExist) {
+			return t, nil
+		}
+		return nil, fmt.Errorf("failed to read cassette %s: %w", path, err)
+	}
+	if err := json.Unmarshal(b, &t.cassette); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cassette %s: %w", path, err)
+	}
+	t.used = make([]bool, len(t.cassette.Interactions))
+
+	return t, nil
+}
+
+// Client returns an http.Client using this Transport.
+func (t *Transport) Client() *http.Client {
+	return &http.Client{Transport: t}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch t.mode {
+	case ModeReplay:
+		return t.replay(req)
+	case ModeRecord:
+		return t.record(req)
+	default:
+		return nil, fmt.Errorf("cassette: unknown mode %q", t.mode)
+	}
+}
+
+// replay returns the first unused interaction matching the method and URL,
+// falling back to the last used match so repeated polling requests keep working
+func (t *Transport) replay(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	url := req.URL.String()
+	found := -1
+	for i, in := range t.cassette.Interactions {
+		if in.Request.Method != req.Method || in.Request.URL != url {
+			continue
+		}
+		found = i
+		if !t.used[i] {
+			break
+		}
+	}
+	if found < 0 {
+		return nil, fmt.Errorf("%w: %s %s", ErrNoInteraction, req.Method, url)
+	}
+	t.used[found] = true
+
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	return t.cassette.Interactions[found].Response.toHTTP(req), nil
+}
+
+func (t *Transport) record(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	in := Interaction{
+		Request: Request{
+			Method: req.Method,
+			URL:    req.URL.String(),
+		},
+		Response: Response{
+			Status:  resp.StatusCode,
+			Headers: resp.Header.Clone(),
+		},
+	}
+	if utf8.Valid(body) {
+		in.Response.Body = string(body)
+	} else {
+		in.Response.BodyBase64 = body
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cassette.Interactions = append(t.cassette.Interactions, in)
+	t.used = append(t.used, true)
+	t.unsaved = true
+
+	return resp, nil
+}
+
+// Save writes the interactions recorded so far to disk, rewriting the cassette once per call.
+// Recording sessions call it when done, it does nothing in replay mode or when nothing new was recorded.
+func (t *Transport) Save() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.mode != ModeRecord || !t.unsaved {
+		return nil
+	}
+	if err := t.save(); err != nil {
+		return err
+	}
+	t.unsaved = false
+	return nil
+}
+
+func (t *Transport) save() error {
+	b, err := json.MarshalIndent(t.cassette, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal cassette: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create cassette directory: %w", err)
+	}
+	tempPath := t.path + ".tmp"
+	if err := os.WriteFile(tempPath, b, 0o644); err != nil {
+		return fmt.Errorf("failed to write cassette: %w", err)
+	}
+	return os.Rename(tempPath, t.path)
+}
+
+func (r Response) toHTTP(req *http.Request) *http.Response {
+	body := r.BodyBase64
+	if body == nil {
+		body = []byte(r.Body)
+	}
+	header := r.Headers.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status)),
+		StatusCode:    r.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
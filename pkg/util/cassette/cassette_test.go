@@ -0,0 +1,89 @@
+package cassette
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/text":
+			w.Header().Set("ratelimit-remaining", "42")
+			w.Write([]byte("hello"))
+		case "/binary":
+			w.Write([]byte{0xff, 0x00, 0xfe})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	rec, err := New(path, ModeRecord, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/text", "/binary", "/missing"} {
+		resp, err := rec.Client().Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	srv.Close()
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("cassette written before Save: %v", err)
+	}
+	if err := rec.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	play, err := New(path, ModeReplay, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := play.Client()
+
+	cases := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/text", http.StatusOK, "hello"},
+		{"/binary", http.StatusOK, "\xff\x00\xfe"},
+		{"/missing", http.StatusNotFound, ""},
+	}
+	for _, tc := range cases {
+		resp, err := client.Get(srv.URL + tc.path)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.path, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || string(b) != tc.body {
+			t.Errorf("%s: got %d %q, want %d %q", tc.path, resp.StatusCode, b, tc.status, tc.body)
+		}
+	}
+
+	resp, err := client.Get(srv.URL + "/text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("ratelimit-remaining") != "42" {
+		t.Errorf("headers were not replayed: %v", resp.Header)
+	}
+
+	_, err = client.Get(srv.URL + "/never")
+	if !errors.Is(err, ErrNoInteraction) {
+		t.Errorf("got %v, want ErrNoInteraction", err)
+	}
+}
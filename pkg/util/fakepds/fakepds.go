@@ -0,0 +1,471 @@
+// Package fakepds is an in-process PDS and PLC directory for tests.
+// It serves generated repos over the sync and repo XRPC endpoints the backfill uses,
+// and can be told to fail requests the way real hosts do.
+package fakepds
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/blebbit/atmunge/pkg/plc"
+)
+
+// plcEpoch is the timestamp of the first PLC operation, each later one is a second after
+var plcEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Server is a fake PDS, which is also the PLC directory for its accounts.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	repos    map[string]*Repo
+	plcLog   []plc.OperationLogEntry
+	faults   map[string][]fault
+	requests map[string]int
+}
+
+type fault struct {
+	status int
+	count  int
+}
+
+// New starts a fake PDS, close it when done.
+func New() *Server {
+	s := &Server{
+		repos:    make(map[string]*Repo),
+		faults:   make(map[string][]fault),
+		requests: make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /xrpc/com.atproto.server.describeServer", s.handleDescribeServer)
+	mux.HandleFunc("GET /xrpc/com.atproto.sync.listRepos", s.handleListRepos)
+	mux.HandleFunc("GET /xrpc/com.atproto.repo.describeRepo", s.handleDescribeRepo)
+	mux.HandleFunc("GET /xrpc/com.atproto.sync.getRepo", s.handleGetRepo)
+	mux.HandleFunc("GET /xrpc/com.atproto.sync.listBlobs", s.handleListBlobs)
+	mux.HandleFunc("GET /xrpc/com.atproto.sync.getBlob", s.handleGetBlob)
+	mux.HandleFunc("GET /export", s.handleExport)
+
+	s.Server = httptest.NewServer(s.withFaults(mux))
+	return s
+}
+
+// PlcURL is the PLC export endpoint, for config.PlcUpstream.
+func (s *Server) PlcURL() string {
+	return s.URL + "/export"
+}
+
+// CreateRepo creates an account with an initial commit of records,
+// and appends its creation to the PLC log.
+func (s *Server) CreateRepo(handle string, records Records) (*Repo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := newRepo(handle)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s.repos[r.DID]; ok {
+		return nil, fmt.Errorf("repo for %s already exists", handle)
+	}
+	if err := r.commit(records); err != nil {
+		return nil, err
+	}
+
+	pub, err := r.Key.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	op := plc.Op{
+		Type:                "plc_operation",
+		RotationKeys:        []string{pub.DIDKey()},
+		VerificationMethods: map[string]string{"atproto": pub.DIDKey()},
+		AlsoKnownAs:         []string{"at://" + handle},
+		Services: map[string]plc.Service{
+			"atproto_pds": {Type: "AtprotoPersonalDataServer", Endpoint: s.URL},
+		},
+	}
+	opCid, err := op.CID()
+	if err != nil {
+		return nil, err
+	}
+	created := plcEpoch.Add(time.Duration(len(s.plcLog)) * time.Second)
+	s.plcLog = append(s.plcLog, plc.OperationLogEntry{
+		DID:       r.DID,
+		Operation: plc.Operation{Value: op},
+		CID:       opCid.String(),
+		CreatedAt: created.Format("2006-01-02T15:04:05.000Z"),
+	})
+
+	s.repos[r.DID] = r
+	return r, nil
+}
+
+// Commit applies record changes to an account as a new commit, returning the new rev.
+func (s *Server) Commit(did string, records Records) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.repos[did]
+	if !ok {
+		return "", fmt.Errorf("no repo for %s", did)
+	}
+	if err := r.commit(records); err != nil {
+		return "", err
+	}
+	return r.Rev(), nil
+}
+
+// SetStatus changes an account's status, e.g. "takendown" or "deactivated", empty for active.
+func (s *Server) SetStatus(did, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.repos[did]
+	if !ok {
+		return fmt.Errorf("no repo for %s", did)
+	}
+	r.Status = status
+	return nil
+}
+
+// AddBlob stores a blob for an account, returning its CID.
+func (s *Server) AddBlob(did string, b []byte) (cid.Cid, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.repos[did]
+	if !ok {
+		return cid.Undef, fmt.Errorf("no repo for %s", did)
+	}
+	return r.addBlob(b)
+}
+
+// RemoveBlob deletes a blob of an account, as when the records using it are deleted.
+func (s *Server) RemoveBlob(did string, c cid.Cid) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.repos[did]
+	if !ok {
+		return fmt.Errorf("no repo for %s", did)
+	}
+	for i := range r.blobs {
+		if r.blobs[i].cid.Equals(c) {
+			r.blobs = append(r.blobs[:i], r.blobs[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no blob %s for %s", c, did)
+}
+
+// SetBlobData replaces the bytes served for a blob, keeping its CID, to fake a corrupt blob.
+func (s *Server) SetBlobData(did string, c cid.Cid, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.repos[did]
+	if !ok {
+		return fmt.Errorf("no repo for %s", did)
+	}
+	for i := range r.blobs {
+		if r.blobs[i].cid.Equals(c) {
+			r.blobs[i].data = b
+			return nil
+		}
+	}
+	return fmt.Errorf("no blob %s for %s", c, did)
+}
+
+// Fail makes the next count requests to an endpoint respond with status.
+// The endpoint is an XRPC method (e.g. "com.atproto.sync.getRepo"), "export" for the PLC log, or empty for any.
+// 429 responses carry ratelimit headers asking the client to wait until the next second.
+func (s *Server) Fail(endpoint string, status, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[endpoint] = append(s.faults[endpoint], fault{status: status, count: count})
+}
+
+// Requests returns how many requests an endpoint has received, including failed ones.
+func (s *Server) Requests(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[endpoint]
+}
+
+func endpointName(path string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(path, "/xrpc/"), "/")
+}
+
+func (s *Server) withFaults(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		endpoint := endpointName(req.URL.Path)
+
+		s.mu.Lock()
+		s.requests[endpoint]++
+		status := s.takeFault(endpoint)
+		if status == 0 {
+			status = s.takeFault("")
+		}
+		s.mu.Unlock()
+
+		if status == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("ratelimit-limit", "3000")
+			w.Header().Set("ratelimit-policy", "3000;w=300")
+			w.Header().Set("ratelimit-remaining", "0")
+			w.Header().Set("ratelimit-reset", strconv.FormatInt(time.Now().Add(time.Second).Unix(), 10))
+			writeError(w, status, "RateLimitExceeded", "Rate Limit Exceeded")
+			return
+		}
+		writeError(w, status, "InternalServerError", "Internal Server Error")
+	})
+}
+
+// takeFault pops a fault for the endpoint, the lock must be held
+func (s *Server) takeFault(endpoint string) int {
+	faults := s.faults[endpoint]
+	if len(faults) == 0 {
+		return 0
+	}
+	f := &faults[0]
+	f.count--
+	if f.count <= 0 {
+		s.faults[endpoint] = faults[1:]
+	}
+	return f.status
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, name, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": name, "message": msg})
+}
+
+// lookupRepo finds the repo for a request, writing the XRPC error when it is missing or not active
+func (s *Server) lookupRepo(w http.ResponseWriter, did string) (*Repo, bool) {
+	r, ok := s.repos[did]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "RepoNotFound", "Could not find repo for DID: "+did)
+		return nil, false
+	}
+	switch r.Status {
+	case "":
+		return r, true
+	case "takendown":
+		writeError(w, http.StatusBadRequest, "RepoTakendown", "Repo has been takendown: "+did)
+	case "deactivated":
+		writeError(w, http.StatusBadRequest, "RepoDeactivated", "Repo has been deactivated: "+did)
+	default:
+		writeError(w, http.StatusBadRequest, "RepoNotFound", "Repo is "+r.Status+": "+did)
+	}
+	return nil, false
+}
+
+func (s *Server) handleDescribeServer(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, map[string]any{
+		"did":                  "did:web:" + req.Host,
+		"availableUserDomains": []string{".test"},
+		"inviteCodeRequired":   false,
+	})
+}
+
+type listReposRepo struct {
+	DID    string `json:"did"`
+	Head   string `json:"head"`
+	Rev    string `json:"rev"`
+	Active bool   `json:"active"`
+	Status string `json:"status,omitempty"`
+}
+
+func (s *Server) handleListRepos(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	limit := queryLimit(req, 500, 1000)
+	cursor := req.URL.Query().Get("cursor")
+
+	dids := make([]string, 0, len(s.repos))
+	for did := range s.repos {
+		if did > cursor {
+			dids = append(dids, did)
+		}
+	}
+	sort.Strings(dids)
+	if len(dids) > limit {
+		dids = dids[:limit]
+	}
+
+	resp := struct {
+		Cursor string          `json:"cursor,omitempty"`
+		Repos  []listReposRepo `json:"repos"`
+	}{
+		Repos: make([]listReposRepo, 0, len(dids)),
+	}
+	for _, did := range dids {
+		r := s.repos[did]
+		resp.Repos = append(resp.Repos, listReposRepo{
+			DID:    did,
+			Head:   r.Head().String(),
+			Rev:    r.Rev(),
+			Active: r.Status == "",
+			Status: r.Status,
+		})
+	}
+	// like a real PDS, the cursor is set while there are repos, even on the last page
+	if len(dids) > 0 {
+		resp.Cursor = dids[len(dids)-1]
+	}
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleDescribeRepo(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.lookupRepo(w, req.URL.Query().Get("repo"))
+	if !ok {
+		return
+	}
+	cols, err := r.Collections()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalServerError", err.Error())
+		return
+	}
+
+	writeJSON(w, map[string]any{
+		"handle": r.Handle,
+		"did":    r.DID,
+		"didDoc": map[string]any{
+			"id":          r.DID,
+			"alsoKnownAs": []string{"at://" + r.Handle},
+		},
+		"collections":     cols,
+		"handleIsCorrect": true,
+	})
+}
+
+func (s *Server) handleGetRepo(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.lookupRepo(w, req.URL.Query().Get("did"))
+	if !ok {
+		return
+	}
+	b, err := r.CAR(req.URL.Query().Get("since"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalServerError", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.ipld.car")
+	w.Write(b)
+}
+
+func (s *Server) handleListBlobs(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.lookupRepo(w, req.URL.Query().Get("did"))
+	if !ok {
+		return
+	}
+
+	limit := queryLimit(req, 500, 1000)
+	start := 0
+	if cursor := req.URL.Query().Get("cursor"); cursor != "" {
+		for i, b := range r.blobs {
+			if b.cid.String() == cursor {
+				start = i + 1
+				break
+			}
+		}
+	}
+	end := min(start+limit, len(r.blobs))
+
+	resp := struct {
+		Cursor string   `json:"cursor,omitempty"`
+		Cids   []string `json:"cids"`
+	}{
+		Cids: make([]string, 0, end-start),
+	}
+	for _, b := range r.blobs[start:end] {
+		resp.Cids = append(resp.Cids, b.cid.String())
+	}
+	if end < len(r.blobs) {
+		resp.Cursor = r.blobs[end-1].cid.String()
+	}
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleGetBlob(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.lookupRepo(w, req.URL.Query().Get("did"))
+	if !ok {
+		return
+	}
+	want := req.URL.Query().Get("cid")
+	for _, b := range r.blobs {
+		if b.cid.String() == want {
+			w.Header().Set("Content-Type", http.DetectContentType(b.data))
+			w.Write(b.data)
+			return
+		}
+	}
+	writeError(w, http.StatusBadRequest, "BlobNotFound", "Blob not found")
+}
+
+// handleExport serves the PLC log as jsonlines, like plc.directory/export
+func (s *Server) handleExport(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	limit := queryLimit(req, 10, 1000)
+	after := req.URL.Query().Get("after")
+
+	w.Header().Set("Content-Type", "application/jsonlines")
+	enc := json.NewEncoder(w)
+	n := 0
+	for _, entry := range s.plcLog {
+		if entry.CreatedAt <= after {
+			continue
+		}
+		if n >= limit {
+			break
+		}
+		enc.Encode(entry)
+		n++
+	}
+}
+
+func queryLimit(req *http.Request, def, maxLimit int) int {
+	limit, err := strconv.Atoi(req.URL.Query().Get("limit"))
+	if err != nil {
+		limit, err = strconv.Atoi(req.URL.Query().Get("count"))
+	}
+	if err != nil || limit <= 0 {
+		return def
+	}
+	return min(limit, maxLimit)
+}
@@ -0,0 +1,288 @@
+package fakepds
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/data"
+	indigoRepo "github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/bluesky-social/indigo/atproto/repo/mst"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+	"github.com/multiformats/go-multihash"
+)
+
+var cidBuilder = cid.V1Builder{Codec: cid.DagCBOR, MhType: multihash.SHA2_256}
+
+// Records maps record paths (collection/rkey) to record values, a nil value deletes the record.
+// Values must be encodable by indigo's atproto/data package.
+type Records map[string]map[string]any
+
+// Repo is a generated account repo, kept as the blocks of each commit
+// so getRepo can serve both full repos and diffs since a rev.
+type Repo struct {
+	DID    string
+	Handle string
+	Key    *crypto.PrivateKeyK256
+	// Status is empty for active accounts, otherwise "takendown", "deactivated", ...
+	Status string
+
+	clock   syntax.TIDClock
+	tree    mst.Tree
+	commits []repoCommit
+	blobs   []repoBlob
+}
+
+type repoCommit struct {
+	cid    cid.Cid
+	rev    string
+	blocks []blocks.Block
+}
+
+type repoBlob struct {
+	cid  cid.Cid
+	data []byte
+}
+
+// DIDForHandle derives a stable did:plc for a handle, so tests can predict it.
+func DIDForHandle(handle string) string {
+	sum := sha256.Sum256([]byte(handle))
+	id := base32.StdEncoding.EncodeToString(sum[:])
+	return "did:plc:" + strings.ToLower(id[:24])
+}
+
+// SampleRecords generates a profile and n posts, one a minute from 2024-01-01.
+func SampleRecords(handle string, n int) Records {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := syntax.NewTIDClock(0)
+
+	recs := Records{
+		"app.bsky.actor.profile/self": {
+			"$type":       "app.bsky.actor.profile",
+			"displayName": handle,
+		},
+	}
+	for i := range n {
+		created := start.Add(time.Duration(i) * time.Minute)
+		recs["app.bsky.feed.post/"+clock.Next().String()] = map[string]any{
+			"$type":     "app.bsky.feed.post",
+			"text":      fmt.Sprintf("post %d from %s", i, handle),
+			"createdAt": created.Format(syntax.AtprotoDatetimeLayout),
+		}
+	}
+	return recs
+}
+
+func newRepo(handle string) (*Repo, error) {
+	key, err := crypto.GeneratePrivateKeyK256()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return &Repo{
+		DID:    DIDForHandle(handle),
+		Handle: handle,
+		Key:    key,
+		clock:  syntax.NewTIDClock(0),
+		tree:   mst.NewEmptyTree(),
+	}, nil
+}
+
+// Rev is the rev of the latest commit.
+func (r *Repo) Rev() string {
+	if len(r.commits) == 0 {
+		return ""
+	}
+	return r.commits[len(r.commits)-1].rev
+}
+
+// Head is the CID of the latest commit.
+func (r *Repo) Head() cid.Cid {
+	if len(r.commits) == 0 {
+		return cid.Undef
+	}
+	return r.commits[len(r.commits)-1].cid
+}
+
+// commit applies the record changes and signs a new commit
+func (r *Repo) commit(records Records) error {
+	ctx := context.Background()
+	bs := &blockMap{}
+
+	for path, val := range records {
+		if val == nil {
+			if _, err := r.tree.Remove([]byte(path)); err != nil {
+				return fmt.Errorf("failed to remove %s: %w", path, err)
+			}
+			continue
+		}
+
+		b, err := data.MarshalCBOR(val)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s: %w", path, err)
+		}
+		c, err := cidBuilder.Sum(b)
+		if err != nil {
+			return err
+		}
+		blk, err := blocks.NewBlockWithCid(b, c)
+		if err != nil {
+			return err
+		}
+		if err := bs.Put(ctx, blk); err != nil {
+			return err
+		}
+		if _, err := r.tree.Insert([]byte(path), c); err != nil {
+			return fmt.Errorf("failed to insert %s: %w", path, err)
+		}
+	}
+
+	root, err := r.tree.WriteDiffBlocks(ctx, bs)
+	if err != nil {
+		return fmt.Errorf("failed to write MST blocks: %w", err)
+	}
+
+	commit := indigoRepo.Commit{
+		DID:     r.DID,
+		Version: 3,
+		Data:    *root,
+		Rev:     r.clock.Next().String(),
+	}
+	if err := commit.Sign(r.Key); err != nil {
+		return fmt.Errorf("failed to sign commit: %w", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := commit.MarshalCBOR(buf); err != nil {
+		return fmt.Errorf("failed to marshal commit: %w", err)
+	}
+	c, err := cidBuilder.Sum(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	blk, err := blocks.NewBlockWithCid(buf.Bytes(), c)
+	if err != nil {
+		return err
+	}
+	if err := bs.Put(ctx, blk); err != nil {
+		return err
+	}
+
+	r.commits = append(r.commits, repoCommit{cid: c, rev: commit.Rev, blocks: bs.blocks})
+	return nil
+}
+
+// CAR encodes the repo as a CARv1 rooted at the latest commit,
+// with only the blocks from commits after since when it is set.
+func (r *Repo) CAR(since string) ([]byte, error) {
+	ctx := context.Background()
+	buf := new(bytes.Buffer)
+
+	w, err := storage.NewWritable(buf, []cid.Cid{r.Head()}, car.WriteAsCarV1(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CAR writer: %w", err)
+	}
+	for _, c := range r.commits {
+		if since != "" && c.rev <= since {
+			continue
+		}
+		for _, blk := range c.blocks {
+			if err := w.Put(ctx, blk.Cid().KeyString(), blk.RawData()); err != nil {
+				return nil, fmt.Errorf("failed to write block: %w", err)
+			}
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Collections lists the distinct collections in the repo.
+func (r *Repo) Collections() ([]string, error) {
+	seen := make(map[string]bool)
+	err := r.tree.Walk(func(key []byte, _ cid.Cid) error {
+		nsid, _, _ := strings.Cut(string(key), "/")
+		seen[nsid] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cols := make([]string, 0, len(seen))
+	for nsid := range seen {
+		cols = append(cols, nsid)
+	}
+	sort.Strings(cols)
+	return cols, nil
+}
+
+// addBlob stores a blob, returning its raw CID
+func (r *Repo) addBlob(b []byte) (cid.Cid, error) {
+	c, err := cid.V1Builder{Codec: cid.Raw, MhType: multihash.SHA2_256}.Sum(b)
+	if err != nil {
+		return cid.Undef, err
+	}
+	r.blobs = append(r.blobs, repoBlob{cid: c, data: b})
+	return c, nil
+}
+
+// blockMap is the write side of a blockstore, collecting the blocks for one commit
+type blockMap struct {
+	blocks []blocks.Block
+}
+
+func (bm *blockMap) Put(_ context.Context, blk blocks.Block) error {
+	bm.blocks = append(bm.blocks, blk)
+	return nil
+}
+
+func (bm *blockMap) PutMany(ctx context.Context, blks []blocks.Block) error {
+	bm.blocks = append(bm.blocks, blks...)
+	return nil
+}
+
+func (bm *blockMap) Get(_ context.Context, c cid.Cid) (blocks.Block, error) {
+	for _, blk := range bm.blocks {
+		if blk.Cid().Equals(c) {
+			return blk, nil
+		}
+	}
+	return nil, fmt.Errorf("block not found: %s", c)
+}
+
+func (bm *blockMap) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	_, err := bm.Get(ctx, c)
+	return err == nil, nil
+}
+
+func (bm *blockMap) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	blk, err := bm.Get(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	return len(blk.RawData()), nil
+}
+
+func (bm *blockMap) DeleteBlock(context.Context, cid.Cid) error {
+	return fmt.Errorf("blockMap is append only")
+}
+
+func (bm *blockMap) AllKeysChan(context.Context) (<-chan cid.Cid, error) {
+	ch := make(chan cid.Cid, len(bm.blocks))
+	for _, blk := range bm.blocks {
+		ch <- blk.Cid()
+	}
+	close(ch)
+	return ch, nil
+}
+
+func (bm *blockMap) HashOnRead(bool) {}